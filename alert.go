@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type AlertStatus string
+
+const (
+	AlertFiring   AlertStatus = "firing"
+	AlertResolved AlertStatus = "resolved"
+)
+
+// Alert represents a notification sent for a rule that has started
+// or stopped firing for a device.
+type Alert struct {
+	Rule     string            `json:"rule"`
+	Device   string            `json:"device,omitempty"`
+	Module   string            `json:"module"`
+	Status   AlertStatus       `json:"status"`
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Count    int               `json:"count"`
+	StartsAt time.Time         `json:"starts_at"`
+	EndsAt   time.Time         `json:"ends_at"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+}
+
+func (a Alert) Title() string {
+	if len(a.Device) == 0 {
+		return fmt.Sprintf("[%s] %s", a.Status, a.Rule)
+	}
+	return fmt.Sprintf("[%s] %s: %s", a.Status, a.Rule, a.Device)
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("%s (%s %q x%d since %s)", a.Title(), a.Module, a.Message, a.Count, a.StartsAt.Format(time.RFC3339))
+}
+
+type alertKey struct {
+	rule   int
+	device string
+}
+
+type alertState struct {
+	consecutive int
+	matches     []time.Time
+	firing      bool
+	startsAt    time.Time
+	lastMatch   time.Time
+	notified    time.Time
+	last        Event
+}
+
+// AlertEngine evaluates alert rules against the events logged by the
+// monitors and sends notifications when alerts fire or resolve.
+// Repeated matches for an alert that is already firing are
+// suppressed until the repeat interval has elapsed and the total
+// number of notifications is limited to maxPerHour.
+type AlertEngine struct {
+	bus            *EventBus
+	rules          []AlertRule
+	notifiers      []Notifier
+	repeatInterval time.Duration
+	maxPerHour     int
+	events         chan Event
+	notifications  chan Alert
+
+	mu    sync.Mutex
+	state map[alertKey]*alertState
+	sent  []time.Time
+}
+
+func NewAlertEngine(bus *EventBus, rules []AlertRule, notifiers []Notifier, repeatInterval time.Duration, maxPerHour int) *AlertEngine {
+	if repeatInterval == 0 {
+		repeatInterval = DefaultAlertRepeatInterval
+	}
+	return &AlertEngine{
+		bus:            bus,
+		rules:          rules,
+		notifiers:      notifiers,
+		repeatInterval: repeatInterval,
+		maxPerHour:     maxPerHour,
+		events:         make(chan Event, 1000),
+		notifications:  make(chan Alert, 100),
+		state:          map[alertKey]*alertState{},
+	}
+}
+
+func (e *AlertEngine) log(ctx context.Context, device, format string, args ...any) {
+	e.bus.Info(ctx, "alert", device, format, args...)
+}
+
+func (e *AlertEngine) warn(ctx context.Context, device, format string, args ...any) {
+	e.bus.Warn(ctx, "alert", device, format, args...)
+}
+
+// HandleEvent is an EventHandler that queues events for evaluation,
+// events are dropped rather than blocking the monitors if the queue
+// is full.
+func (e *AlertEngine) HandleEvent(ctx context.Context, ev Event) {
+	if ev.Module == "alert" {
+		return
+	}
+	select {
+	case e.events <- ev:
+	default:
+	}
+}
+
+func (e *AlertEngine) Run(ctx context.Context) error {
+	go e.dispatch(ctx)
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-e.events:
+			e.handle(ctx, ev)
+		case now := <-ticker.C:
+			e.expire(ctx, now)
+		}
+	}
+}
+
+func (e *AlertEngine) dispatch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case a := <-e.notifications:
+			for _, n := range e.notifiers {
+				if err := n.Notify(ctx, a); err != nil {
+					e.bus.Error(ctx, "alert", a.Device, "notification failed", "notifier", n.Name(), "alert", a.Title(), "err", err)
+				}
+			}
+		}
+	}
+}
+
+func (r AlertRule) applies(ev Event) bool {
+	if r.Module != string(ev.Module) {
+		return false
+	}
+	if len(r.Devices) > 0 && !r.Devices[ev.Device] {
+		return false
+	}
+	return r.Match[ev.Message] || r.Resolve[ev.Message]
+}
+
+func (e *AlertEngine) handle(ctx context.Context, ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, rule := range e.rules {
+		if !rule.applies(ev) {
+			continue
+		}
+		key := alertKey{rule: i, device: ev.Device}
+		st, ok := e.state[key]
+		if !ok {
+			st = &alertState{}
+			e.state[key] = st
+		}
+		if rule.Resolve[ev.Message] {
+			st.consecutive = 0
+			if st.firing {
+				e.resolve(ctx, rule, st, ev.When)
+			}
+			continue
+		}
+		st.consecutive++
+		st.lastMatch = ev.When
+		st.last = ev
+		if rule.Window > 0 {
+			st.matches = append(pruneBefore(st.matches, ev.When.Add(-rule.Window)), ev.When)
+		}
+		if !rule.triggered(st) {
+			continue
+		}
+		if !st.firing {
+			st.firing = true
+			st.startsAt = ev.When
+			e.notify(ctx, rule, st, AlertFiring, ev.When)
+			continue
+		}
+		if ev.When.Sub(st.notified) >= e.repeatInterval {
+			e.notify(ctx, rule, st, AlertFiring, ev.When)
+		}
+	}
+}
+
+func (r AlertRule) triggered(st *alertState) bool {
+	if r.Window > 0 {
+		return len(st.matches) > r.Count
+	}
+	return st.consecutive >= r.Count
+}
+
+// expire resolves alerts whose window no longer contains enough
+// matches, or that have not seen a matching event for resolve_after.
+func (e *AlertEngine) expire(ctx context.Context, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, st := range e.state {
+		rule := e.rules[key.rule]
+		if rule.Window > 0 {
+			st.matches = pruneBefore(st.matches, now.Add(-rule.Window))
+		}
+		if !st.firing {
+			continue
+		}
+		if rule.Window > 0 && !rule.triggered(st) {
+			e.resolve(ctx, rule, st, now)
+			continue
+		}
+		if rule.ResolveAfter > 0 && now.Sub(st.lastMatch) >= rule.ResolveAfter {
+			e.resolve(ctx, rule, st, now)
+		}
+	}
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+func (e *AlertEngine) resolve(ctx context.Context, rule AlertRule, st *alertState, now time.Time) {
+	e.notify(ctx, rule, st, AlertResolved, now)
+	st.firing = false
+	st.consecutive = 0
+	st.matches = nil
+}
+
+func (e *AlertEngine) notify(ctx context.Context, rule AlertRule, st *alertState, status AlertStatus, now time.Time) {
+	a := Alert{
+		Rule:     rule.Name,
+		Device:   st.last.Device,
+		Module:   rule.Module,
+		Status:   status,
+		Severity: rule.Severity,
+		Message:  st.last.Message,
+		Count:    st.consecutive,
+		StartsAt: st.startsAt,
+		Attrs:    st.last.AttrMap(),
+	}
+	if rule.Window > 0 {
+		a.Count = len(st.matches)
+	}
+	if status == AlertResolved {
+		a.EndsAt = now
+	}
+	st.notified = now
+	e.sent = pruneBefore(e.sent, now.Add(-time.Hour))
+	if e.maxPerHour > 0 && len(e.sent) >= e.maxPerHour {
+		e.warn(ctx, a.Device, "alert rate limit exceeded", "alert", a.Title(), "max_per_hour", e.maxPerHour)
+		return
+	}
+	e.sent = append(e.sent, now)
+	if status == AlertFiring {
+		e.warn(ctx, a.Device, "alert", "alert", a.String())
+	} else {
+		e.log(ctx, a.Device, "alert", "alert", a.String())
+	}
+	select {
+	case e.notifications <- a:
+	default:
+		e.warn(ctx, a.Device, "notification queue full", "alert", a.Title())
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"cloudeng.io/cmdutil/keystore"
+)
+
+// Notifier is implemented by the various destinations that alerts
+// can be sent to.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, a Alert) error
+}
+
+// NewNotifier creates the Notifier specified by cfg, the keys are used
+// to obtain any credentials referred to by its key_id.
+func NewNotifier(cfg NotifierConfig, keys keystore.Keys) (Notifier, error) {
+	name := cfg.Name
+	if len(name) == 0 {
+		name = cfg.Type
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = DefaultNotifierTimeout
+	}
+	var auth keystore.KeyInfo
+	if len(cfg.AuthID) > 0 {
+		var ok bool
+		if auth, ok = keys[cfg.AuthID]; !ok {
+			return nil, fmt.Errorf("notifier %q: key_id %q not found", name, cfg.AuthID)
+		}
+	}
+	switch cfg.Type {
+	case "webhook":
+		if len(cfg.URL) == 0 {
+			return nil, fmt.Errorf("notifier %q: url must be specified", name)
+		}
+		return &webhookNotifier{name: name, url: cfg.URL, headers: cfg.Headers, auth: auth, timeout: timeout}, nil
+	case "ntfy":
+		if len(cfg.URL) == 0 {
+			return nil, fmt.Errorf("notifier %q: url must be specified", name)
+		}
+		return &ntfyNotifier{name: name, url: cfg.URL, priority: cfg.Priority, auth: auth, timeout: timeout}, nil
+	case "pushover":
+		if len(auth.User) == 0 || len(auth.Token) == 0 {
+			return nil, fmt.Errorf("notifier %q: key_id with user and token must be specified", name)
+		}
+		u := cfg.URL
+		if len(u) == 0 {
+			u = "https://api.pushover.net/1/messages.json"
+		}
+		return &pushoverNotifier{name: name, url: u, priority: cfg.Priority, auth: auth, timeout: timeout}, nil
+	case "email":
+		if len(cfg.Server) == 0 || len(cfg.From) == 0 || len(cfg.To) == 0 {
+			return nil, fmt.Errorf("notifier %q: server, from and to must be specified", name)
+		}
+		return &emailNotifier{name: name, server: cfg.Server, from: cfg.From, to: cfg.To, auth: auth, timeout: timeout}, nil
+	case "command":
+		if len(cfg.Command) == 0 {
+			return nil, fmt.Errorf("notifier %q: command must be specified", name)
+		}
+		return &commandNotifier{name: name, command: cfg.Command, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("notifier %q: unsupported type %q", name, cfg.Type)
+}
+
+func (c Config) Notifiers() ([]Notifier, error) {
+	if c.Alerts == nil {
+		return nil, nil
+	}
+	notifiers := make([]Notifier, 0, len(c.Alerts.Notifiers))
+	for _, cfg := range c.Alerts.Notifiers {
+		n, err := NewNotifier(cfg, c.auth)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+func httpPost(ctx context.Context, timeout time.Duration, req *http.Request) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// webhookNotifier POSTs the alert as JSON.
+type webhookNotifier struct {
+	name    string
+	url     string
+	headers map[string]string
+	auth    keystore.KeyInfo
+	timeout time.Duration
+}
+
+func (n *webhookNotifier) Name() string {
+	return n.name
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, a Alert) error {
+	buf, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+	if len(n.auth.User) > 0 {
+		req.SetBasicAuth(n.auth.User, n.auth.Token)
+	} else if len(n.auth.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+n.auth.Token)
+	}
+	return httpPost(ctx, n.timeout, req)
+}
+
+// ntfyNotifier publishes the alert to an ntfy topic URL.
+type ntfyNotifier struct {
+	name     string
+	url      string
+	priority string
+	auth     keystore.KeyInfo
+	timeout  time.Duration
+}
+
+func (n *ntfyNotifier) Name() string {
+	return n.name
+}
+
+func (n *ntfyNotifier) Notify(ctx context.Context, a Alert) error {
+	req, err := http.NewRequest("POST", n.url, strings.NewReader(a.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", a.Title())
+	req.Header.Set("Tags", string(a.Status)+","+a.Severity)
+	if len(n.priority) > 0 {
+		req.Header.Set("Priority", n.priority)
+	}
+	if len(n.auth.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+n.auth.Token)
+	}
+	return httpPost(ctx, n.timeout, req)
+}
+
+// pushoverNotifier sends the alert using the Pushover message API,
+// the key's user and token are used as the Pushover user and
+// application tokens.
+type pushoverNotifier struct {
+	name     string
+	url      string
+	priority string
+	auth     keystore.KeyInfo
+	timeout  time.Duration
+}
+
+func (n *pushoverNotifier) Name() string {
+	return n.name
+}
+
+func (n *pushoverNotifier) Notify(ctx context.Context, a Alert) error {
+	form := url.Values{
+		"token":   {n.auth.Token},
+		"user":    {n.auth.User},
+		"title":   {a.Title()},
+		"message": {a.String()},
+	}
+	if len(n.priority) > 0 {
+		form.Set("priority", n.priority)
+	}
+	req, err := http.NewRequest("POST", n.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return httpPost(ctx, n.timeout, req)
+}
+
+// emailNotifier sends the alert via SMTP, using STARTTLS if the server
+// supports it and PLAIN authentication if a key_id is configured.
+type emailNotifier struct {
+	name    string
+	server  string
+	from    string
+	to      []string
+	auth    keystore.KeyInfo
+	timeout time.Duration
+}
+
+func (n *emailNotifier) Name() string {
+	return n.name
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, a Alert) error {
+	host, _, err := net.SplitHostPort(n.server)
+	if err != nil {
+		return err
+	}
+	var sa smtp.Auth
+	if len(n.auth.User) > 0 {
+		sa = smtp.PlainAuth("", n.auth.User, n.auth.Token, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: netmon: %s\r\n", a.Title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "\r\n%s\r\n", a.String())
+	for k, v := range a.Attrs {
+		fmt.Fprintf(&msg, "%s: %s\r\n", k, v)
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	dialer := net.Dialer{Timeout: n.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", n.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The deadline bounds the entire exchange and cancelation of ctx
+	// interrupts it.
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	return sendMail(conn, host, sa, n.from, n.to, msg.Bytes())
+}
+
+// sendMail is smtp.SendMail using an existing connection.
+func sendMail(conn net.Conn, host string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp server does not support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// commandNotifier runs a local command with the alert as JSON on its
+// standard input and summarized in NETMON_ALERT_* environment variables.
+type commandNotifier struct {
+	name    string
+	command []string
+	timeout time.Duration
+}
+
+func (n *commandNotifier) Name() string {
+	return n.name
+}
+
+func (n *commandNotifier) Notify(ctx context.Context, a Alert) error {
+	buf, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, n.command[0], n.command[1:]...)
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Env = append(os.Environ(),
+		"NETMON_ALERT_RULE="+a.Rule,
+		"NETMON_ALERT_DEVICE="+a.Device,
+		"NETMON_ALERT_STATUS="+string(a.Status),
+		"NETMON_ALERT_SEVERITY="+a.Severity,
+		"NETMON_ALERT_MESSAGE="+a.Message,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
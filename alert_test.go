@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func drainAlerts(e *AlertEngine) []Alert {
+	var alerts []Alert
+	for {
+		select {
+		case a := <-e.notifications:
+			alerts = append(alerts, a)
+		default:
+			return alerts
+		}
+	}
+}
+
+func TestAlertConsecutive(t *testing.T) {
+	ctx := context.Background()
+	rules := []AlertRule{{
+		Name:     "ping-down",
+		Module:   "ping",
+		Match:    stringSet([]string{"timeout"}),
+		Resolve:  stringSet([]string{"ok"}),
+		Count:    3,
+		Severity: "critical",
+	}}
+	e := NewAlertEngine(NewEventBus(), rules, nil, time.Hour, 0)
+	now := time.Now()
+	event := func(msg string, offset time.Duration) {
+		e.handle(ctx, Event{When: now.Add(offset), Device: "cam1", Module: "ping", Message: msg})
+	}
+
+	event("timeout", 0)
+	event("timeout", time.Second)
+	event("ok", 2*time.Second)
+	event("timeout", 3*time.Second)
+	event("timeout", 4*time.Second)
+	if got := drainAlerts(e); len(got) != 0 {
+		t.Fatalf("unexpected alerts: %v", got)
+	}
+	event("timeout", 5*time.Second)
+	event("timeout", 6*time.Second)
+	alerts := drainAlerts(e)
+	if got, want := len(alerts), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := alerts[0].Status, AlertFiring; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := alerts[0].Device, "cam1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	event("ok", 7*time.Second)
+	alerts = drainAlerts(e)
+	if got, want := len(alerts), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := alerts[0].Status, AlertResolved; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAlertWindow(t *testing.T) {
+	ctx := context.Background()
+	rules := []AlertRule{{
+		Name:   "rtsp-flapping",
+		Module: "rtsp",
+		Match:  stringSet([]string{"playback ended"}),
+		Count:  2,
+		Window: 10 * time.Minute,
+	}}
+	e := NewAlertEngine(NewEventBus(), rules, nil, time.Hour, 1)
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		e.handle(ctx, Event{When: now.Add(time.Duration(i) * time.Minute), Device: "cam2", Module: "rtsp", Message: "playback ended"})
+	}
+	if got, want := len(drainAlerts(e)), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// Rate limited to one notification per hour.
+	e.expire(ctx, now.Add(20*time.Minute))
+	if got, want := len(drainAlerts(e)), 0; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if e.state[alertKey{rule: 0, device: "cam2"}].firing {
+		t.Errorf("alert should have been resolved")
+	}
+}
+
+// serveSMTP implements just enough of SMTP to accept a single message.
+func serveSMTP(conn net.Conn, received chan<- string) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 localhost\r\n")
+	var msg strings.Builder
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO":
+			fmt.Fprintf(conn, "250 localhost\r\n")
+		case "DATA":
+			fmt.Fprintf(conn, "354 go ahead\r\n")
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			fmt.Fprintf(conn, "250 ok\r\n")
+		case "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			received <- msg.String()
+			return
+		default:
+			fmt.Fprintf(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	hang := make(chan struct{})
+	defer close(hang)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		serveSMTP(conn, received)
+		// Accept, but never respond to, the next connection.
+		if conn, err = ln.Accept(); err == nil {
+			<-hang
+			conn.Close()
+		}
+	}()
+
+	n := &emailNotifier{name: "email", server: ln.Addr().String(), from: "netmon@example.com", to: []string{"ops@example.com"}, timeout: 250 * time.Millisecond}
+	a := Alert{Rule: "cam down", Device: "cam1", Message: "failed"}
+	if err := n.Notify(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; !strings.Contains(msg, "Subject: netmon: ") || !strings.Contains(msg, "To: ops@example.com") {
+		t.Errorf("unexpected message: %v", msg)
+	}
+
+	start := time.Now()
+	if err := n.Notify(ctx, a); err == nil {
+		t.Errorf("expected an error")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("notify took %v", took)
+	}
+}
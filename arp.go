@@ -4,42 +4,76 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"io"
+	"log/slog"
+	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type ARPMonitor struct {
-	l        *Logger
+	events   *EventBus
 	interval time.Duration
+	source   arpSource
 	devices  map[string]Device
 	mu       sync.Mutex
 	previous []arpEntry
 }
 
-func NewARPMonitor(l *Logger, interval time.Duration) *ARPMonitor {
+func NewARPMonitor(events *EventBus, interval time.Duration) *ARPMonitor {
 	return &ARPMonitor{
-		l:        l,
+		events:   events,
 		interval: interval,
 		devices:  make(map[string]Device),
 	}
 }
 
 func (m *ARPMonitor) log(ctx context.Context, format string, args ...any) {
-	m.l.Log(ctx, "arp", format, args...)
+	m.events.Info(ctx, "arp", "", format, args...)
 }
 
-func (m *ARPMonitor) warn(ctx context.Context, format string, args ...any) {
-	m.l.Warn(ctx, "arp", format, args...)
+func (m *ARPMonitor) stateChange(ctx context.Context, level slog.Level, device string, e arpEntry, format string, args ...any) {
+	m.events.Publish(ctx, Event{
+		Level:   level,
+		Device:  device,
+		Module:  "arp",
+		Kind:    EventStateChange,
+		Message: format,
+		Attrs:   attrs(append([]any{"ip", e.ip, "mac", e.mac, "iface", e.iface, "state", e.state}, args...)...),
+	})
 }
 
-func (m *ARPMonitor) MonitorAll(ctx context.Context, devs []Device) error {
+// arpDevices returns the devices keyed by their current address, devices
+// whose hostname has not yet been resolved are omitted.
+func arpDevices(devs []Device) map[string]Device {
+	devices := make(map[string]Device, len(devs))
 	for _, dev := range devs {
-		m.devices[dev.IP] = dev
+		dev = dev.current()
+		if dev.ipAddr.IsValid() {
+			devices[dev.IP] = dev
+		}
+	}
+	return devices
+}
+
+// MonitorAll monitors the ARP table entries for the specified devices,
+// the current address of each device is used so that entries follow a
+// device whose hostname resolves to a new address.
+func (m *ARPMonitor) MonitorAll(ctx context.Context, devs []Device) error {
+	if m.source == nil {
+		m.source = newARPSource()
 	}
+	m.log(ctx, "using arp source", "source", m.source.name())
 	for {
-		table, err := readARPTable(ctx, m.devices)
+		// Entries that are removed are attributed using the devices
+		// that were current when they were last seen.
+		previous := m.devices
+		m.devices = arpDevices(devs)
+		table, err := m.source.read(ctx, m.devices)
 		if err != nil {
 			return err
 		}
@@ -48,18 +82,26 @@ func (m *ARPMonitor) MonitorAll(ctx context.Context, devs []Device) error {
 			return ctx.Err()
 		case <-time.After(m.interval):
 		}
-		added, removed, changed := compareTables(m.previous, table)
+		added, removed, changed, transitions := compareTables(m.previous, table)
 		shown := false
 		for _, e := range added {
-			m.log(ctx, "added arp entry", "name", m.devices[e.ip], "ip", e.ip, "mac", e.mac, "iface", e.iface)
+			m.stateChange(ctx, slog.LevelInfo, m.devices[e.ip].Name, e, "added arp entry")
 			shown = true
 		}
 		for _, e := range removed {
-			m.log(ctx, "removed arp entry", "name", m.devices[e.ip], "ip", e.ip, "mac", e.mac, "iface", e.iface)
+			m.stateChange(ctx, slog.LevelInfo, previous[e.ip].Name, e, "removed arp entry")
 			shown = true
 		}
 		for _, e := range changed {
-			m.warn(ctx, "changed arp entry", "name", m.devices[e.current.ip], "ip", e.current.ip, "mac", e.current.mac, "iface", e.current.iface, "previous_mac", e.previous.mac, "previous_iface", e.previous.iface)
+			m.stateChange(ctx, slog.LevelWarn, m.devices[e.current.ip].Name, e.current, "changed arp entry", "previous_mac", e.previous.mac, "previous_iface", e.previous.iface)
+			shown = true
+		}
+		for _, e := range transitions {
+			level := slog.LevelInfo
+			if e.current.state.unreachable() {
+				level = slog.LevelWarn
+			}
+			m.stateChange(ctx, level, m.devices[e.current.ip].Name, e.current, "arp entry state changed", "previous_state", e.previous.state)
 			shown = true
 		}
 		if !shown {
@@ -75,7 +117,10 @@ type changedARPEntry struct {
 	previous, current arpEntry
 }
 
-func compareTables(a, b []arpEntry) (added, removed []arpEntry, changed []changedARPEntry) {
+// compareTables returns the entries that were added or removed between
+// a and b, those whose MAC address changed and those whose neighbor
+// state changed.
+func compareTables(a, b []arpEntry) (added, removed []arpEntry, changed, transitions []changedARPEntry) {
 	am := make(map[string]arpEntry)
 	bm := make(map[string]arpEntry)
 	for _, e := range a {
@@ -99,30 +144,99 @@ func compareTables(a, b []arpEntry) (added, removed []arpEntry, changed []change
 		if !ok {
 			continue
 		}
-		if be.mac != ae.mac {
+		// An incomplete or failed entry has no MAC address, so treat
+		// a MAC 'change' to or from an empty address as a state
+		// transition rather than a MAC change.
+		if be.mac != ae.mac && len(be.mac) > 0 && len(ae.mac) > 0 {
 			changed = append(changed, changedARPEntry{
 				previous: ae,
 				current:  be,
 			})
 		}
+		if be.state != ae.state {
+			transitions = append(transitions, changedARPEntry{
+				previous: ae,
+				current:  be,
+			})
+		}
 	}
-	return added, removed, changed
+	return added, removed, changed, transitions
+}
+
+// arpState represents the state of a neighbor (ARP/NDP) table entry.
+type arpState string
+
+const (
+	arpStateIncomplete arpState = "INCOMPLETE"
+	arpStateReachable  arpState = "REACHABLE"
+	arpStateStale      arpState = "STALE"
+	arpStateDelay      arpState = "DELAY"
+	arpStateProbe      arpState = "PROBE"
+	arpStateFailed     arpState = "FAILED"
+	arpStateNoARP      arpState = "NOARP"
+	arpStatePermanent  arpState = "PERMANENT"
+	// arpStateComplete is used by sources, such as /proc/net/arp, that
+	// only report whether an entry is complete rather than its
+	// detailed reachability state.
+	arpStateComplete arpState = "COMPLETE"
+)
+
+func (s arpState) unreachable() bool {
+	return s == arpStateIncomplete || s == arpStateFailed
 }
 
 type arpEntry struct {
 	ip    string
 	mac   string
 	iface string
+	state arpState
+}
+
+// arpSource is implemented by the various means of obtaining the
+// system's ARP/neighbor table.
+type arpSource interface {
+	name() string
+	read(ctx context.Context, devices map[string]Device) ([]arpEntry, error)
+}
+
+// platformARPSource is an arpSource that may not be available on
+// all systems.
+type platformARPSource interface {
+	arpSource
+	available() bool
+}
+
+// newARPSource returns the first of the platform specific ARP sources
+// that is available at runtime, falling back to running 'arp -an'.
+func newARPSource() arpSource {
+	for _, src := range platformARPSources() {
+		if src.available() {
+			return src
+		}
+	}
+	return arpCommand{}
 }
 
-var arpRE = regexp.MustCompile(`\((?P<ip>[0-9.]+)\) at (?P<mac>[0-9a-f:]+) on (?P<iface>\w+)`)
+// arpCommand obtains the ARP table by running 'arp -an' and parsing
+// its BSD/macOS style output.
+type arpCommand struct{}
 
-func readARPTable(ctx context.Context, devices map[string]Device) (table []arpEntry, err error) {
+func (arpCommand) name() string {
+	return "arp -an"
+}
+
+var arpRE = regexp.MustCompile(`\((?P<ip>[0-9.]+)\) at (?P<mac>[0-9a-f:]+|\(incomplete\)) on (?P<iface>\w+)`)
+
+func (arpCommand) read(ctx context.Context, devices map[string]Device) ([]arpEntry, error) {
 	out, err := exec.CommandContext(ctx, "arp", "-an").Output()
 	if err != nil {
-		return
+		return nil, err
 	}
-	sc := bufio.NewScanner(bytes.NewReader(out))
+	return parseARPCommand(bytes.NewReader(out), devices)
+}
+
+func parseARPCommand(rd io.Reader, devices map[string]Device) (table []arpEntry, err error) {
+	sc := bufio.NewScanner(rd)
 	for sc.Scan() {
 		l := sc.Text()
 		matches := arpRE.FindStringSubmatch(l)
@@ -132,11 +246,85 @@ func readARPTable(ctx context.Context, devices map[string]Device) (table []arpEn
 		if _, ok := devices[matches[1]]; !ok {
 			continue
 		}
-		table = append(table, arpEntry{
+		entry := arpEntry{
 			ip:    matches[1],
 			mac:   matches[2],
 			iface: matches[3],
-		})
+			state: arpStateReachable,
+		}
+		switch {
+		case entry.mac == "(incomplete)":
+			entry.mac = ""
+			entry.state = arpStateIncomplete
+		case strings.Contains(l, " permanent"):
+			entry.state = arpStatePermanent
+		}
+		table = append(table, entry)
+	}
+	return table, sc.Err()
+}
+
+const (
+	atfComplete  = 0x02 // ATF_COM
+	atfPermanent = 0x04 // ATF_PERM
+)
+
+// procARP obtains the ARP table by reading /proc/net/arp on Linux.
+type procARP struct {
+	filename string
+}
+
+func (p procARP) name() string {
+	return p.filename
+}
+
+func (p procARP) available() bool {
+	_, err := os.Stat(p.filename)
+	return err == nil
+}
+
+func (p procARP) read(ctx context.Context, devices map[string]Device) ([]arpEntry, error) {
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcARP(f, devices)
+}
+
+// parseProcARP parses the contents of /proc/net/arp, ie:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.1      0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+func parseProcARP(rd io.Reader, devices map[string]Device) (table []arpEntry, err error) {
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 6 || fields[0] == "IP" {
+			continue
+		}
+		if _, ok := devices[fields[0]]; !ok {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[2], 0, 32)
+		if err != nil {
+			continue
+		}
+		entry := arpEntry{
+			ip:    fields[0],
+			mac:   fields[3],
+			iface: fields[5],
+		}
+		switch {
+		case flags&atfPermanent != 0:
+			entry.state = arpStatePermanent
+		case flags&atfComplete != 0:
+			entry.state = arpStateComplete
+		default:
+			entry.state = arpStateIncomplete
+			entry.mac = ""
+		}
+		table = append(table, entry)
 	}
 	return table, sc.Err()
 }
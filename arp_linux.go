@@ -0,0 +1,125 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func platformARPSources() []platformARPSource {
+	return []platformARPSource{
+		netlinkARP{},
+		procARP{filename: "/proc/net/arp"},
+	}
+}
+
+// netlinkARP obtains the neighbor table, including the detailed state
+// of each entry, via a netlink RTM_GETNEIGH dump.
+type netlinkARP struct{}
+
+func (netlinkARP) name() string {
+	return "netlink"
+}
+
+func (netlinkARP) available() bool {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return false
+	}
+	unix.Close(fd)
+	return true
+}
+
+func (netlinkARP) read(ctx context.Context, devices map[string]Device) ([]arpEntry, error) {
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETNEIGH, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("netlink neighbor dump: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("netlink neighbor dump: %w", err)
+	}
+	ifnames := map[int32]string{}
+	var table []arpEntry
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWNEIGH {
+			continue
+		}
+		entry, ifindex, ok := parseNeighMsg(msg.Data)
+		if !ok {
+			continue
+		}
+		if _, ok := devices[entry.ip]; !ok {
+			continue
+		}
+		name, ok := ifnames[ifindex]
+		if !ok {
+			if ifc, err := net.InterfaceByIndex(int(ifindex)); err == nil {
+				name = ifc.Name
+			}
+			ifnames[ifindex] = name
+		}
+		entry.iface = name
+		table = append(table, entry)
+	}
+	return table, nil
+}
+
+func parseNeighMsg(data []byte) (arpEntry, int32, bool) {
+	if len(data) < unix.SizeofNdMsg {
+		return arpEntry{}, 0, false
+	}
+	nd := (*unix.NdMsg)(unsafe.Pointer(&data[0]))
+	entry := arpEntry{state: neighState(nd.State)}
+	attrs := data[unix.SizeofNdMsg:]
+	for len(attrs) >= unix.SizeofRtAttr {
+		alen := int(binary.NativeEndian.Uint16(attrs[0:2]))
+		atype := binary.NativeEndian.Uint16(attrs[2:4])
+		if alen < unix.SizeofRtAttr || alen > len(attrs) {
+			break
+		}
+		val := attrs[unix.SizeofRtAttr:alen]
+		switch atype {
+		case unix.NDA_DST:
+			if addr, ok := netip.AddrFromSlice(val); ok {
+				entry.ip = addr.Unmap().String()
+			}
+		case unix.NDA_LLADDR:
+			entry.mac = net.HardwareAddr(val).String()
+		}
+		alen = (alen + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+		if alen > len(attrs) {
+			break
+		}
+		attrs = attrs[alen:]
+	}
+	return entry, nd.Ifindex, len(entry.ip) > 0
+}
+
+func neighState(state uint16) arpState {
+	switch {
+	case state&unix.NUD_PERMANENT != 0:
+		return arpStatePermanent
+	case state&unix.NUD_REACHABLE != 0:
+		return arpStateReachable
+	case state&unix.NUD_STALE != 0:
+		return arpStateStale
+	case state&unix.NUD_DELAY != 0:
+		return arpStateDelay
+	case state&unix.NUD_PROBE != 0:
+		return arpStateProbe
+	case state&unix.NUD_FAILED != 0:
+		return arpStateFailed
+	case state&unix.NUD_NOARP != 0:
+		return arpStateNoARP
+	}
+	return arpStateIncomplete
+}
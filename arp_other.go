@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func platformARPSources() []platformARPSource {
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseARPTables(t *testing.T) {
+	devices := map[string]Device{
+		"192.168.1.1": {Name: "router", IP: "192.168.1.1"},
+		"192.168.1.2": {Name: "camera", IP: "192.168.1.2"},
+		"192.168.1.3": {Name: "nas", IP: "192.168.1.3"},
+	}
+
+	proc := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.1      0x1         0x2         aa:bb:cc:dd:ee:01     *        eth0
+192.168.1.2      0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.3      0x1         0x6         aa:bb:cc:dd:ee:03     *        eth0
+192.168.1.4      0x1         0x2         aa:bb:cc:dd:ee:04     *        eth0
+`
+	table, err := parseProcARP(strings.NewReader(proc), devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := table, []arpEntry{
+		{ip: "192.168.1.1", mac: "aa:bb:cc:dd:ee:01", iface: "eth0", state: arpStateComplete},
+		{ip: "192.168.1.2", iface: "eth0", state: arpStateIncomplete},
+		{ip: "192.168.1.3", mac: "aa:bb:cc:dd:ee:03", iface: "eth0", state: arpStatePermanent},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	bsd := `? (192.168.1.1) at aa:bb:cc:dd:ee:1 on en0 ifscope [ethernet]
+? (192.168.1.2) at (incomplete) on en0 ifscope [ethernet]
+? (192.168.1.3) at aa:bb:cc:dd:ee:3 on en0 ifscope permanent [ethernet]
+? (192.168.1.4) at aa:bb:cc:dd:ee:4 on en0 ifscope [ethernet]
+`
+	table, err = parseARPCommand(strings.NewReader(bsd), devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := table, []arpEntry{
+		{ip: "192.168.1.1", mac: "aa:bb:cc:dd:ee:1", iface: "en0", state: arpStateReachable},
+		{ip: "192.168.1.2", iface: "en0", state: arpStateIncomplete},
+		{ip: "192.168.1.3", mac: "aa:bb:cc:dd:ee:3", iface: "en0", state: arpStatePermanent},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCompareARPTables(t *testing.T) {
+	prev := []arpEntry{
+		{ip: "10.0.0.1", mac: "aa", state: arpStateReachable},
+		{ip: "10.0.0.2", mac: "bb", state: arpStateReachable},
+		{ip: "10.0.0.3", mac: "cc", state: arpStateReachable},
+	}
+	cur := []arpEntry{
+		{ip: "10.0.0.1", mac: "aa", state: arpStateStale},
+		{ip: "10.0.0.2", mac: "dd", state: arpStateReachable},
+		{ip: "10.0.0.3", state: arpStateFailed},
+		{ip: "10.0.0.4", mac: "ee", state: arpStateReachable},
+	}
+	added, removed, changed, transitions := compareTables(prev, cur)
+	if got, want := len(added), 1; got != want {
+		t.Errorf("added: got %v, want %v", got, want)
+	}
+	if got, want := len(removed), 0; got != want {
+		t.Errorf("removed: got %v, want %v", got, want)
+	}
+	if got, want := len(changed), 1; got != want || changed[0].current.ip != "10.0.0.2" {
+		t.Errorf("changed: got %v, want %v", changed, want)
+	}
+	if got, want := len(transitions), 2; got != want {
+		t.Errorf("transitions: got %v, want %v", got, want)
+	}
+}
+
+type fakeARPSource struct {
+	tables chan []arpEntry
+}
+
+func (fakeARPSource) name() string {
+	return "fake"
+}
+
+func (s fakeARPSource) read(ctx context.Context, devices map[string]Device) ([]arpEntry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case all := <-s.tables:
+		var table []arpEntry
+		for _, e := range all {
+			if _, ok := devices[e.ip]; ok {
+				table = append(table, e)
+			}
+		}
+		return table, nil
+	}
+}
+
+func TestARPAddressChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var received []string
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		if ev.Kind != EventStateChange {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, ev.Message+" "+ev.Device+" "+attrString(ev, "ip"))
+	})
+	addr := newSharedAddr(netip.Addr{})
+	devs := []Device{{Name: "nas", IP: "nas.lan", hostname: "nas.lan", addr: addr}}
+	src := fakeARPSource{tables: make(chan []arpEntry)}
+	m := NewARPMonitor(bus, time.Millisecond)
+	m.source = src
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- m.MonitorAll(ctx, devs)
+	}()
+
+	table := []arpEntry{
+		{ip: "10.0.0.1", mac: "aa", state: arpStateReachable},
+		{ip: "10.0.0.2", mac: "aa", state: arpStateReachable},
+	}
+	src.tables <- table
+	addr.store(netip.MustParseAddr("10.0.0.1"))
+	src.tables <- table
+	addr.store(netip.MustParseAddr("10.0.0.2"))
+	src.tables <- table
+	src.tables <- table
+	cancel()
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(received)
+	if want := []string{
+		"added arp entry nas 10.0.0.1",
+		"added arp entry nas 10.0.0.2",
+		"removed arp entry nas 10.0.0.1",
+	}; !reflect.DeepEqual(received, want) {
+		t.Errorf("got %v, want %v", received, want)
+	}
+}
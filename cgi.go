@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/cookiejar"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,11 +21,11 @@ import (
 )
 
 type CGIMonitor struct {
-	l *Logger
+	events *EventBus
 }
 
-func NewCGIMonitor(l *Logger) *CGIMonitor {
-	return &CGIMonitor{l: l}
+func NewCGIMonitor(events *EventBus) *CGIMonitor {
+	return &CGIMonitor{events: events}
 }
 
 type perHostState struct {
@@ -51,7 +57,7 @@ func (s *CGIMonitor) MonitorAll(ctx context.Context, invocations []CGIInvocation
 	var g errgroup.T
 	for _, invocation := range invocations {
 		k := invocation.IPAddr.String()
-		r := &cgiGet{config: invocation, hostState: perHost[k], l: s.l}
+		r := &cgiGet{config: invocation, hostState: perHost[k], events: s.events}
 		g.Go(func() error {
 			return r.issueCalls(ctx)
 		})
@@ -62,34 +68,49 @@ func (s *CGIMonitor) MonitorAll(ctx context.Context, invocations []CGIInvocation
 type cgiGet struct {
 	config    CGIInvocation
 	hostState *perHostState
-	l         *Logger
+	events    *EventBus
+	fields    map[string]string // fields parsed from the previous response.
 }
 
-func (c *cgiGet) log(ctx context.Context, format string, args ...any) {
-	c.l.Log(ctx, "cgi", format, args...)
-}
-
-func (c *cgiGet) warn(ctx context.Context, format string, args ...any) {
-	c.l.Warn(ctx, "cgi", format, args...)
+func (c *cgiGet) publish(ctx context.Context, ev Event) {
+	ev.Module = "cgi"
+	ev.Device = c.config.Name
+	if len(c.config.Action) > 0 {
+		ev.Attrs = append(ev.Attrs, slog.String("action", c.config.Action))
+	}
+	c.events.Publish(ctx, ev)
 }
 
 func (c *cgiGet) issueCalls(ctx context.Context) error {
 	for {
-		inv := c.config
-		url := fmt.Sprintf("%s://%s:%d/%s", inv.Scheme, inv.IPAddr.String(), inv.Port, inv.Path)
-		if err := c.call(ctx, url, inv); err != nil {
+		inv := c.config.current()
+		if !inv.IPAddr.IsValid() {
+			// The device's hostname has yet to be resolved.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(inv.Interval):
+			}
+			continue
+		}
+		req, err := inv.request(time.Now())
+		url := req.safeURL
+		if err == nil {
+			err = c.call(ctx, req, inv)
+		}
+		if err != nil {
 			if errors.Is(err, context.Canceled) {
-				c.warn(ctx, "exiting", "name", inv.Name, "url", url, "err", ctx.Err())
+				c.publish(ctx, Event{Level: slog.LevelWarn, Kind: EventInfo, Message: "exiting", Err: ctx.Err(), Attrs: attrs("url", url)})
 				return err
 			}
-			c.warn(ctx, "call failed", "name", inv.Name, "url", url, "err", err)
+			c.publish(ctx, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: "call failed", Err: err, Attrs: attrs("url", url)})
 		}
 		if inv.OnceOnly {
 			return nil
 		}
 		select {
 		case <-ctx.Done():
-			c.warn(ctx, "exiting", "name", inv.Name, "url", url, "err", ctx.Err())
+			c.publish(ctx, Event{Level: slog.LevelWarn, Kind: EventInfo, Message: "exiting", Err: ctx.Err(), Attrs: attrs("url", url)})
 			return ctx.Err()
 		case <-time.After(inv.Interval):
 		}
@@ -97,26 +118,45 @@ func (c *cgiGet) issueCalls(ctx context.Context) error {
 	}
 }
 
-func (c *cgiGet) call(ctx context.Context, url string, inv CGIInvocation) error {
+func (c *cgiGet) call(ctx context.Context, r cgiRequest, inv CGIInvocation) error {
 	c.hostState.Lock()
 	defer c.hostState.Unlock()
 	ctx, cancel := context.WithTimeout(ctx, inv.Timeout)
 	defer cancel()
-	client := &http.Client{
-		Transport: &digest.Transport{
-			Jar:      c.hostState.jar,
-			Username: inv.Auth.User,
-			Password: inv.Auth.Token,
-		},
+	url := r.safeURL
+	var body io.Reader
+	if len(r.body) > 0 {
+		body = strings.NewReader(r.body)
 	}
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, inv.Method, r.url, body)
 	if err != nil {
 		return err
 	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{CheckRedirect: redirectPolicy(inv.Redirects)}
+	switch inv.AuthScheme {
+	case "digest":
+		client.Transport = &digest.Transport{
+			Jar:      c.hostState.jar,
+			Username: inv.Auth.User,
+			Password: inv.Auth.Token,
+		}
+	case "basic":
+		client.Jar = c.hostState.jar
+		req.SetBasicAuth(inv.Auth.User, inv.Auth.Token)
+	case "bearer":
+		client.Jar = c.hostState.jar
+		req.Header.Set("Authorization", "Bearer "+inv.Auth.Token)
+	default:
+		client.Jar = c.hostState.jar
+	}
+	start := time.Now()
 	res, err := client.Do(req)
 	if err != nil {
 		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-			c.log(ctx, "timeout", "name", inv.Name, "url", "timeout", inv.Timeout, url, "err", err)
+			c.publish(ctx, Event{Level: slog.LevelWarn, Kind: EventTimeout, Message: "timeout", Latency: time.Since(start), Err: err, Attrs: attrs("url", url, slog.Duration("timeout", inv.Timeout))})
 			return nil
 		}
 		return err
@@ -126,6 +166,155 @@ func (c *cgiGet) call(ctx context.Context, url string, inv CGIInvocation) error
 	if err != nil {
 		return err
 	}
-	c.log(ctx, "ok", "name", inv.Name, "url", url, "body", string(buf))
+	latency := time.Since(start)
+	if assertion, expected, got := inv.check(res.StatusCode, buf, latency); len(assertion) > 0 {
+		c.publish(ctx, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: "assertion failed", Latency: latency, Attrs: attrs("url", url, "status", res.StatusCode, "assertion", assertion, "expected", expected, "got", got)})
+		return nil
+	}
+	if inv.Parser == nil {
+		c.publish(ctx, Event{Level: slog.LevelInfo, Kind: EventProbeOK, Message: "ok", Latency: latency, Attrs: attrs("url", url, "status", res.StatusCode, "body", string(buf))})
+		return nil
+	}
+	fields, err := inv.Parser.parse(buf)
+	if err != nil {
+		c.publish(ctx, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: "parse failed", Latency: latency, Err: err, Attrs: attrs("url", url, "status", res.StatusCode, "body", string(buf))})
+		return nil
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	group := make([]any, 0, len(names)*2)
+	for _, name := range names {
+		group = append(group, name, fields[name])
+	}
+	c.publish(ctx, Event{Level: slog.LevelInfo, Kind: EventProbeOK, Message: "ok", Latency: latency, Attrs: attrs("url", url, "status", res.StatusCode, slog.Group("fields", group...))})
+	c.compareFields(ctx, url, inv, fields)
+	return nil
+}
+
+// compareFields reports changes in the watched fields, and decreases in
+// the counters, since the previous response. Fields missing from a
+// response retain their previous values.
+func (c *cgiGet) compareFields(ctx context.Context, url string, inv CGIInvocation, fields map[string]string) {
+	prev := c.fields
+	c.fields = maps.Clone(fields)
+	for k, v := range prev {
+		if _, ok := c.fields[k]; !ok {
+			c.fields[k] = v
+		}
+	}
+	if prev == nil {
+		return
+	}
+	for _, f := range inv.Changes {
+		cur, ok := fields[f]
+		if p, pok := prev[f]; ok && pok && cur != p {
+			c.publish(ctx, Event{Level: slog.LevelWarn, Kind: EventStateChange, Message: "changed field", Attrs: attrs("url", url, "field", f, "value", cur, "previous", p)})
+		}
+	}
+	for _, f := range inv.Counters {
+		cur, err := strconv.ParseFloat(fields[f], 64)
+		if err != nil {
+			continue
+		}
+		if p, err := strconv.ParseFloat(prev[f], 64); err == nil && cur < p {
+			c.publish(ctx, Event{Level: slog.LevelWarn, Kind: EventStateChange, Message: "counter reset", Attrs: attrs("url", url, "field", f, "value", fields[f], "previous", prev[f])})
+		}
+	}
+}
+
+// redirectPolicy returns the http.Client CheckRedirect function for
+// the configured redirect policy.
+func redirectPolicy(policy string) func(*http.Request, []*http.Request) error {
+	switch policy {
+	case "none":
+		return func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	case "same_host":
+		return func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host != via[0].URL.Host {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		}
+	}
 	return nil
 }
+
+// check returns the first assertion that the response fails, if any,
+// along with the expected and actual values.
+func (inv CGIInvocation) check(status int, body []byte, latency time.Duration) (assertion, expected, got string) {
+	switch {
+	case len(inv.Status) > 0 && !slices.Contains(inv.Status, status):
+		return "status", fmt.Sprintf("%v", inv.Status), strconv.Itoa(status)
+	case len(inv.Status) == 0 && status >= 400:
+		return "status", "< 400", strconv.Itoa(status)
+	case inv.MaxLatency > 0 && latency > inv.MaxLatency:
+		return "latency", inv.MaxLatency.String(), latency.String()
+	case inv.BodyMatch != nil && !inv.BodyMatch.Match(body):
+		return "body", inv.BodyMatch.String(), ""
+	}
+	if len(inv.JSON) == 0 {
+		return "", "", ""
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "json", "valid json", err.Error()
+	}
+	paths := make([]string, 0, len(inv.JSON))
+	for path := range inv.JSON {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		want := inv.JSON[path]
+		val, ok := jsonPath(v, path)
+		if !ok {
+			return "json " + path, want, "missing"
+		}
+		if got := jsonString(val); got != want {
+			return "json " + path, want, got
+		}
+	}
+	return "", "", ""
+}
+
+// jsonPath returns the value at the dot separated path within v, array
+// elements are selected by their index, eg. storage.0.status.
+func jsonPath(v any, path string) (any, bool) {
+	for _, p := range strings.Split(path, ".") {
+		switch t := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = t[p]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil, false
+			}
+			v = t[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func jsonString(v any) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http/cookiejar"
+	"net/netip"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"cloudeng.io/cmdutil/keystore"
+)
+
+type DeviceCGIFlags struct {
+	ConfigFlags
+	Confirm bool `subcmd:"confirm,false,run the action, without it the request that would be issued is displayed but not sent"`
+}
+
+// cgiTemplateData is the data available to CGI path, body and header
+// templates. Secret and User return the token and user for a key in the
+// keystore, secrets are redacted when a request is logged.
+type cgiTemplateData struct {
+	Device string
+	IP     string
+	Port   int
+	Now    time.Time
+	keys   keystore.Keys
+	redact bool
+}
+
+func (d cgiTemplateData) key(id string) (keystore.KeyInfo, error) {
+	k, ok := d.keys[id]
+	if !ok {
+		return k, fmt.Errorf("unknown key %q", id)
+	}
+	return k, nil
+}
+
+func (d cgiTemplateData) Secret(id string) (string, error) {
+	k, err := d.key(id)
+	if d.redact || err != nil {
+		return "****", err
+	}
+	return k.Token, nil
+}
+
+func (d cgiTemplateData) User(id string) (string, error) {
+	k, err := d.key(id)
+	return k.User, err
+}
+
+type cgiTemplates struct {
+	path, body *template.Template
+	headers    map[string]*template.Template
+	keys       keystore.Keys
+}
+
+func newCGITemplates(path, body string, headers map[string]string, keys keystore.Keys) (*cgiTemplates, error) {
+	t := &cgiTemplates{headers: map[string]*template.Template{}, keys: keys}
+	var err error
+	if t.path, err = template.New("path").Option("missingkey=error").Parse(path); err != nil {
+		return nil, err
+	}
+	if t.body, err = template.New("body").Option("missingkey=error").Parse(body); err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		if t.headers[k], err = template.New(k).Option("missingkey=error").Parse(v); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// cgiRequest is a CGI invocation with its templates expanded.
+type cgiRequest struct {
+	url     string
+	safeURL string // url with any secrets redacted.
+	body    string
+	// safeBody is body with any secrets redacted.
+	safeBody string
+	headers  map[string]string
+}
+
+func expand(t *template.Template, data cgiTemplateData) (string, error) {
+	var out strings.Builder
+	if err := t.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// request expands the invocation's templates for the specified time.
+func (inv CGIInvocation) request(now time.Time) (cgiRequest, error) {
+	host := netip.AddrPortFrom(inv.IPAddr, uint16(inv.Port)).String()
+	if inv.templates == nil {
+		url := fmt.Sprintf("%s://%s/%s", inv.Scheme, host, inv.Path)
+		return cgiRequest{url: url, safeURL: url, body: inv.Body, safeBody: inv.Body, headers: inv.Headers}, nil
+	}
+	data := cgiTemplateData{Device: inv.Name, IP: inv.IPAddr.String(), Port: inv.Port, Now: now, keys: inv.templates.keys}
+	var req cgiRequest
+	path, err := expand(inv.templates.path, data)
+	if err != nil {
+		return req, err
+	}
+	req.url = fmt.Sprintf("%s://%s/%s", inv.Scheme, host, path)
+	data.redact = true
+	if path, err = expand(inv.templates.path, data); err != nil {
+		return req, err
+	}
+	req.safeURL = fmt.Sprintf("%s://%s/%s", inv.Scheme, host, path)
+	if req.safeBody, err = expand(inv.templates.body, data); err != nil {
+		return req, err
+	}
+	data.redact = false
+	if req.body, err = expand(inv.templates.body, data); err != nil {
+		return req, err
+	}
+	req.headers = make(map[string]string, len(inv.templates.headers))
+	for k, t := range inv.templates.headers {
+		if req.headers[k], err = expand(t, data); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// CGI runs a named action for a device, eg. to reboot it.
+func (d *Devices) CGI(ctx context.Context, flags any, args []string) error {
+	fv := flags.(*DeviceCGIFlags)
+	config, err := ParseConfig(ctx, fv.ConfigFlags)
+	if err != nil {
+		return err
+	}
+	actions, err := config.CGIActions()
+	if err != nil {
+		return err
+	}
+	device, name := args[0], args[1]
+	var available []string
+	for _, inv := range actions {
+		if inv.Name != device {
+			continue
+		}
+		if inv.Action != name {
+			available = append(available, inv.Action)
+			continue
+		}
+		return runCGIAction(ctx, inv, fv.Confirm)
+	}
+	if len(available) == 0 {
+		return fmt.Errorf("device %q has no actions", device)
+	}
+	return fmt.Errorf("device %q has no action %q, available actions: %v", device, name, strings.Join(available, ", "))
+}
+
+func runCGIAction(ctx context.Context, inv CGIInvocation, confirm bool) error {
+	if !inv.IPAddr.IsValid() {
+		return fmt.Errorf("device %q has no address", inv.Name)
+	}
+	req, err := inv.request(time.Now())
+	if err != nil {
+		return err
+	}
+	if !confirm {
+		fmt.Printf("%s %s\n", inv.Method, req.safeURL)
+		if len(req.safeBody) > 0 {
+			fmt.Println(req.safeBody)
+		}
+		return fmt.Errorf("action %q for %q was not run, specify --confirm to run it", inv.Action, inv.Name)
+	}
+	levels := LogLevels{Default: slog.LevelInfo}
+	h, err := NewLogHandler(os.Stdout, "text", levels)
+	if err != nil {
+		return err
+	}
+	events := NewEventBus()
+	events.Subscribe(NewLogger(LogSink{Handler: h, Levels: levels}).HandleEvent)
+	failed := false
+	events.Subscribe(func(_ context.Context, ev Event) {
+		if ev.Kind == EventProbeFailed || ev.Kind == EventTimeout || ev.Level >= slog.LevelWarn {
+			failed = true
+		}
+	})
+	jar, _ := cookiejar.New(nil)
+	c := &cgiGet{config: inv, hostState: &perHostState{jar: jar}, events: events}
+	if err := c.call(ctx, req, inv); err != nil {
+		return err
+	}
+	if failed {
+		return fmt.Errorf("action %q for %q failed", inv.Action, inv.Name)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmdutil/keystore"
+)
+
+func TestCGITemplates(t *testing.T) {
+	keys := keystore.Keys{"cam": {User: "admin", Token: "s3cret"}}
+	tmpl, err := newCGITemplates(
+		`set.cgi?time={{.Now.Unix}}&user={{.User "cam"}}&pw={{.Secret "cam"}}`,
+		`{"name": "{{.Device}}", "ip": "{{.IP}}", "pw": "{{.Secret "cam"}}"}`,
+		map[string]string{"X-Time": `{{.Now.Format "2006-01-02"}}`},
+		keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := CGIInvocation{Name: "cam1", Scheme: "http", IPAddr: netip.MustParseAddr("10.0.0.1"), Port: 80, templates: tmpl}
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	req, err := inv.request(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ got, want string }{
+		{req.url, "http://10.0.0.1:80/set.cgi?time=1727784000&user=admin&pw=s3cret"},
+		{req.safeURL, "http://10.0.0.1:80/set.cgi?time=1727784000&user=admin&pw=****"},
+		{req.body, `{"name": "cam1", "ip": "10.0.0.1", "pw": "s3cret"}`},
+		{req.safeBody, `{"name": "cam1", "ip": "10.0.0.1", "pw": "****"}`},
+		{req.headers["X-Time"], "2024-10-01"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got %v, want %v", tc.got, tc.want)
+		}
+	}
+
+	tmpl, _ = newCGITemplates(`{{.Secret "missing"}}`, "", nil, keys)
+	inv.templates = tmpl
+	if _, err := inv.request(now); err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := newCGITemplates(`{{.Now`, "", nil, keys); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestCGIActionConfirm(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+	}))
+	defer srv.Close()
+	addr := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	tmpl, err := newCGITemplates("reboot.cgi", `{"device": "{{.Device}}"}`, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := CGIInvocation{Name: "cam1", Action: "reboot", Scheme: "http", Method: "POST", AuthScheme: "none", Timeout: time.Second, IPAddr: addr.Addr(), Port: int(addr.Port()), templates: tmpl}
+
+	ctx := context.Background()
+	if err := runCGIAction(ctx, inv, false); err == nil || !strings.Contains(err.Error(), "--confirm") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(requests) != 0 {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	if err := runCGIAction(ctx, inv, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(requests, ","), `POST /reboot.cgi {"device": "cam1"}`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// cgiParser extracts named fields from the body of a CGI response.
+type cgiParser interface {
+	parse(body []byte) (map[string]string, error)
+}
+
+func newCGIParser(kind string, fields map[string]string) (cgiParser, error) {
+	switch kind {
+	case "kv":
+		return kvParser{fields: fields}, nil
+	case "json":
+		return jsonParser{fields: fields}, nil
+	case "xml":
+		return xmlParser{fields: fields}, nil
+	case "regex":
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("the regex parser requires fields")
+		}
+		p := regexParser{fields: map[string]*regexp.Regexp{}}
+		for name, expr := range fields {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", name, err)
+			}
+			p.fields[name] = re
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("invalid parse %q, must be one of kv, json, xml or regex", kind)
+}
+
+// selectFields returns the values of the requested fields, keyed by
+// field name, or all of the values if no fields are requested.
+func selectFields(values, fields map[string]string) map[string]string {
+	if len(fields) == 0 {
+		return values
+	}
+	res := make(map[string]string, len(fields))
+	for name, key := range fields {
+		if v, ok := values[key]; ok {
+			res[name] = v
+		}
+	}
+	return res
+}
+
+// kvParser parses key=value lines, eg. root.Properties.Firmware.Version=10.12.
+type kvParser struct {
+	fields map[string]string
+}
+
+func (p kvParser) parse(body []byte) (map[string]string, error) {
+	values := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), "=")
+		if !ok {
+			continue
+		}
+		values[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, errors.New("no key=value pairs found")
+	}
+	return selectFields(values, p.fields), nil
+}
+
+// jsonParser extracts values using the same dot separated paths as the
+// json assertions.
+type jsonParser struct {
+	fields map[string]string
+}
+
+func (p jsonParser) parse(body []byte) (map[string]string, error) {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	res := map[string]string{}
+	if len(p.fields) == 0 {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, errors.New("not a json object")
+		}
+		for k, val := range obj {
+			res[k] = jsonString(val)
+		}
+		return res, nil
+	}
+	for name, path := range p.fields {
+		if val, ok := jsonPath(v, path); ok {
+			res[name] = jsonString(val)
+		}
+	}
+	return res, nil
+}
+
+// xmlParser extracts the text of elements and the values of attributes
+// using dot separated paths of element names starting with the root
+// element, with attributes prefixed by @, eg. DeviceInfo.model or
+// DeviceInfo.@version. Only the first occurrence of a path is used.
+type xmlParser struct {
+	fields map[string]string
+}
+
+func (p xmlParser) parse(body []byte) (map[string]string, error) {
+	values := map[string]string{}
+	set := func(path, value string) {
+		if _, ok := values[path]; !ok {
+			values[path] = value
+		}
+	}
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var stack []string
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			path := strings.Join(stack, ".")
+			for _, a := range t.Attr {
+				set(path+".@"+a.Name.Local, a.Value)
+			}
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if v := strings.TrimSpace(text.String()); len(v) > 0 {
+				set(strings.Join(stack, "."), v)
+			}
+			text.Reset()
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(values) == 0 {
+		return nil, errors.New("no xml elements found")
+	}
+	return selectFields(values, p.fields), nil
+}
+
+// regexParser extracts the first sub-match, or the entire match if there
+// are no sub-expressions, of each field's regular expression.
+type regexParser struct {
+	fields map[string]*regexp.Regexp
+}
+
+func (p regexParser) parse(body []byte) (map[string]string, error) {
+	res := map[string]string{}
+	for name, re := range p.fields {
+		m := re.FindSubmatch(body)
+		switch {
+		case len(m) > 1:
+			res[name] = string(m[1])
+		case len(m) == 1:
+			res[name] = string(m[0])
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"cloudeng.io/cmdutil/keystore"
+)
+
+func TestCGIAssertions(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status":
+			if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"model": "cam", "storage": [{"status": "ok", "free": 1024}], "ir": true}`)
+		case "/token":
+			if r.Header.Get("Authorization") != "Bearer secret" || r.Method != "POST" || r.Header.Get("X-Test") != "yes" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, "ok")
+		case "/moved":
+			http.Redirect(w, r, "/status", http.StatusFound)
+		case "/slow":
+			time.Sleep(20 * time.Millisecond)
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	jar, _ := cookiejar.New(nil)
+	auth := keystore.KeyInfo{User: "admin", Token: "secret"}
+	addr := netip.MustParseAddrPort(srv.Listener.Addr().String())
+
+	for i, tc := range []struct {
+		path      string
+		inv       CGIInvocation
+		assertion string
+		got       string
+	}{
+		{"status", CGIInvocation{AuthScheme: "basic", JSON: map[string]string{"model": "cam", "storage.0.free": "1024", "ir": "true"}}, "", ""},
+		{"status", CGIInvocation{AuthScheme: "basic", JSON: map[string]string{"storage.0.status": "failed"}}, "json storage.0.status", "ok"},
+		{"status", CGIInvocation{AuthScheme: "basic", JSON: map[string]string{"storage.1.status": "ok"}}, "json storage.1.status", "missing"},
+		{"status", CGIInvocation{AuthScheme: "basic", BodyMatch: regexp.MustCompile(`"model": "cam"`)}, "", ""},
+		{"status", CGIInvocation{AuthScheme: "basic", BodyMatch: regexp.MustCompile(`nvr`)}, "body", ""},
+		{"status", CGIInvocation{AuthScheme: "none"}, "status", "401"},
+		{"token", CGIInvocation{AuthScheme: "bearer", Method: "POST", Headers: map[string]string{"X-Test": "yes"}}, "", ""},
+		{"token", CGIInvocation{AuthScheme: "bearer"}, "status", "403"},
+		{"moved", CGIInvocation{AuthScheme: "basic", Redirects: "follow"}, "", ""},
+		{"moved", CGIInvocation{AuthScheme: "basic", Redirects: "none", Status: []int{200}}, "status", "302"},
+		{"moved", CGIInvocation{AuthScheme: "basic", Redirects: "none", Status: []int{301, 302}}, "", ""},
+		{"slow", CGIInvocation{AuthScheme: "none", MaxLatency: time.Millisecond}, "latency", ""},
+		{"error", CGIInvocation{AuthScheme: "none"}, "status", "500"},
+	} {
+		inv := tc.inv
+		inv.Name, inv.Auth, inv.Timeout = "cam1", auth, time.Second
+		inv.Scheme, inv.IPAddr, inv.Port, inv.Path = "http", addr.Addr(), int(addr.Port()), tc.path
+		if len(inv.Method) == 0 {
+			inv.Method = "GET"
+		}
+		req, err := inv.request(time.Now())
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		r := &cgiGet{config: inv, hostState: &perHostState{jar: jar}, events: bus}
+		received = nil
+		if err := r.call(ctx, req, inv); err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if len(received) != 1 {
+			t.Fatalf("%v: got %v events", i, len(received))
+		}
+		ev := received[0]
+		if len(tc.assertion) == 0 {
+			if ev.Kind != EventProbeOK {
+				t.Errorf("%v: got %v %v %v", i, ev.Kind, attrString(ev, "assertion"), attrString(ev, "got"))
+			}
+			continue
+		}
+		if got, want := ev.Message, "assertion failed"; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := attrString(ev, "assertion"), tc.assertion; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := attrString(ev, "got"), tc.got; len(want) > 0 && got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestCGIParsers(t *testing.T) {
+	for i, tc := range []struct {
+		kind   string
+		fields map[string]string
+		body   string
+		want   map[string]string
+	}{
+		{"kv", nil, "root.Brand=AXIS\nroot.Firmware.Version = \"10.12\"\n\n", map[string]string{"root.Brand": "AXIS", "root.Firmware.Version": "10.12"}},
+		{"kv", map[string]string{"firmware": "root.Firmware.Version", "missing": "root.Missing"}, "root.Brand=AXIS\nroot.Firmware.Version=10.12\n", map[string]string{"firmware": "10.12"}},
+		{"json", nil, `{"model": "cam", "uptime": 3600, "ok": true}`, map[string]string{"model": "cam", "uptime": "3600", "ok": "true"}},
+		{"json", map[string]string{"status": "storage.0.status"}, `{"storage": [{"status": "ok"}]}`, map[string]string{"status": "ok"}},
+		{"xml", nil, `<?xml version="1.0"?><DeviceInfo version="2.0"><model> DS-2CD </model><firmwareVersion>V5.7</firmwareVersion></DeviceInfo>`,
+			map[string]string{"DeviceInfo.@version": "2.0", "DeviceInfo.model": "DS-2CD", "DeviceInfo.firmwareVersion": "V5.7"}},
+		{"xml", map[string]string{"fw": "DeviceInfo.firmwareVersion"}, `<DeviceInfo><firmwareVersion>V5.7</firmwareVersion></DeviceInfo>`, map[string]string{"fw": "V5.7"}},
+		{"regex", map[string]string{"uptime": `up (\d+) s`, "model": `CAM-\w+`}, "model CAM-X1, up 42 s", map[string]string{"uptime": "42", "model": "CAM-X1"}},
+	} {
+		p, err := newCGIParser(tc.kind, tc.fields)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		got, err := p.parse([]byte(tc.body))
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+	for _, kind := range []string{"kv", "json", "xml"} {
+		p, _ := newCGIParser(kind, nil)
+		if _, err := p.parse([]byte("<<not valid>>")); err == nil {
+			t.Errorf("%v: expected an error", kind)
+		}
+	}
+	if _, err := newCGIParser("regex", nil); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestCGIFieldChanges(t *testing.T) {
+	ctx := context.Background()
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	parser, _ := newCGIParser("kv", nil)
+	jar, _ := cookiejar.New(nil)
+	inv := CGIInvocation{Name: "cam1", Method: "GET", AuthScheme: "none", Timeout: time.Second, Parser: parser, Changes: []string{"firmware"}, Counters: []string{"uptime"}}
+	r := &cgiGet{config: inv, hostState: &perHostState{jar: jar}, events: bus}
+
+	var msgs []string
+	for _, b := range []string{
+		"firmware=1.0\nuptime=100\n",
+		"firmware=1.0\nuptime=200\n",
+		"uptime=300\n", // a missing field is not a change.
+		"firmware=1.1\nuptime=10\n",
+	} {
+		body = b
+		received = nil
+		if err := r.call(ctx, cgiRequest{url: srv.URL, safeURL: srv.URL}, inv); err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range received {
+			msgs = append(msgs, ev.Message+" "+attrString(ev, "field")+" "+attrString(ev, "previous"))
+		}
+	}
+	want := []string{"ok  ", "ok  ", "ok  ", "ok  ", "changed field firmware 1.0", "counter reset uptime 300"}
+	if !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %v, want %v", msgs, want)
+	}
+	if got, want := received[0].Attrs[2].String(), "fields=[firmware=1.1 uptime=10]"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -3,18 +3,28 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"cloudeng.io/cmdutil/cmdyaml"
 	"cloudeng.io/cmdutil/keystore"
 	"cloudeng.io/macos/keychainfs"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 const (
 	DefaultICMPTimeout      = 5 * time.Second
 	DefaultICMPPingInterval = 5 * time.Second
+	DefaultICMPStatsWindow  = 100
+	DefaultICMPSummary      = 5 * time.Minute
+	DefaultICMPSpacing      = 100 * time.Millisecond
+	MaxICMPPayloadSize      = 65507 // IPv4 maximum less the IP and ICMP headers.
 
 	DefaultRTSPTimeout  = 5 * time.Second
 	DefaultRTSPInterval = 30 * time.Second
@@ -23,43 +33,221 @@ const (
 	DefaultCGITimeout  = 5 * time.Second
 	DefaultCGIInterval = time.Minute
 	DefaultCGIPort     = 80
+	DefaultCGITLSPort  = 443
+
+	DefaultTCPTimeout  = 5 * time.Second
+	DefaultTCPInterval = 30 * time.Second
+
+	DefaultDNSTimeout         = 5 * time.Second
+	DefaultDNSInterval        = time.Minute
+	DefaultDNSResolveInterval = 5 * time.Minute
+	DefaultDNSPort            = 53
+	DefaultDNSTLSPort         = 853
+
+	DefaultTLSTimeout  = 10 * time.Second
+	DefaultTLSInterval = time.Hour
 
 	DefaultARPInterval = 10 * time.Second
+
+	DefaultPathInterval    = 5 * time.Minute
+	DefaultPathTimeout     = 2 * time.Second
+	DefaultPathMaxHops     = 30
+	DefaultPathProbes      = 3
+	DefaultPathLatencyStep = 50 * time.Millisecond
+
+	DefaultRoutingInterval = 10 * time.Second
+
+	DefaultSyslogPort    = 514
+	DefaultSyslogTLSPort = 6514
+
+	DefaultAlertRepeatInterval = time.Hour
+	DefaultAlertResolveAfter   = time.Hour
+	DefaultNotifierTimeout     = 10 * time.Second
 )
 
 type Device struct {
-	Name   string      `yaml:"name"`
-	Ignore bool        `yaml:"ignore,omitempty"`
-	IP     string      `yaml:"ip"`
-	AuthID string      `yaml:"key_id,omitempty"`
-	RTSP   *RTSPConfig `yaml:"rtsp,omitempty"`
-	ICMP   *ICMPConfig `yaml:"icmp,omitempty"`
-	CGI    []CGIConfig `yaml:"cgi,omitempty"`
-	ipAddr netip.Addr
+	Name    string            `yaml:"name"`
+	Ignore  bool              `yaml:"ignore,omitempty"`
+	IP      string            `yaml:"ip"`
+	AuthID  string            `yaml:"key_id,omitempty"`
+	RTSP    *RTSPConfig       `yaml:"rtsp,omitempty"`
+	ICMP    *ICMPConfig       `yaml:"icmp,omitempty"`
+	Path    *PathConfig       `yaml:"path,omitempty"`
+	CGI     []CGIConfig       `yaml:"cgi,omitempty"`
+	Actions []CGIActionConfig `yaml:"actions,omitempty"`
+	TCP     []TCPConfig       `yaml:"tcp,omitempty"`
+	DNS     []DNSConfig       `yaml:"dns,omitempty"`
+	TLS     []TLSConfig       `yaml:"tls,omitempty"`
+	Syslog  *SyslogConfig     `yaml:"syslog,omitempty"`
+	ipAddr  netip.Addr
+	// hostname is set when IP is specified as a hostname rather than
+	// an address, in which case IP is replaced by the resolved address
+	// and addr tracks the address as the hostname is re-resolved.
+	hostname string
+	addr     *sharedAddr
 }
 
+// ICMPConfig configures pinging of a device. StatsWindow is the number
+// of most recent probes used to calculate the loss, round trip time and
+// jitter statistics which are logged every SummaryInterval.
+//
+// Each round sends Count echo requests Spacing apart, each with a payload
+// of PayloadSize bytes. DontFragment sets the DF bit for IPv4 and TTL
+// the IPv4 TTL or IPv6 hop limit; together with a large payload these
+// can be used to detect MTU black holes.
 type ICMPConfig struct {
-	Interval time.Duration `yaml:"interval,omitempty"`
-	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	Interval        time.Duration `yaml:"interval,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	StatsWindow     int           `yaml:"stats_window,omitempty"`
+	SummaryInterval time.Duration `yaml:"summary_interval,omitempty"`
+	Count           int           `yaml:"count,omitempty"`
+	Spacing         time.Duration `yaml:"spacing,omitempty"`
+	PayloadSize     int           `yaml:"payload_size,omitempty"`
+	DontFragment    bool          `yaml:"dont_fragment,omitempty"`
+	TTL             int           `yaml:"ttl,omitempty"`
+}
+
+// PathConfig configures tracing of the path to a device. Every Interval
+// Probes echo requests are sent with each TTL up to MaxHops and the hops
+// that respond within Timeout are recorded. A change in the average
+// round trip time at a hop of at least LatencyStep is reported as a
+// change in the path.
+type PathConfig struct {
+	Interval    time.Duration `yaml:"interval,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	MaxHops     int           `yaml:"max_hops,omitempty"`
+	Probes      int           `yaml:"probes,omitempty"`
+	LatencyStep time.Duration `yaml:"latency_step,omitempty"`
 }
 
+// RTSPConfig configures an RTSP stream. Media is one of H264 (the
+// default), H265, MJPEG, MPEG4Audio (or AAC), Opus, G711 or MPEGTS and
+// selects the track to be monitored. If AllTracks is set every audio and
+// video track in the session description is monitored and Media, if set,
+// must be one of them.
 type RTSPConfig struct {
-	Path     string        `yaml:"path,omitempty"`
-	AuthID   string        `yaml:"key_id,omitempty"`
-	Port     int           `yaml:"port,omitempty"`
-	Media    string        `yaml:"media,omitempty"`
-	Interval time.Duration `yaml:"interval,omitempty"`
-	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	Path      string        `yaml:"path,omitempty"`
+	AuthID    string        `yaml:"key_id,omitempty"`
+	Port      int           `yaml:"port,omitempty"`
+	Media     string        `yaml:"media,omitempty"`
+	AllTracks bool          `yaml:"all_tracks,omitempty"`
+	Interval  time.Duration `yaml:"interval,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
 }
 
+// CGIConfig configures an HTTP request to a device and the assertions
+// made on its response. Auth is one of digest (the default), basic,
+// bearer or none. Redirects is one of follow (the default), none, in
+// which case the redirect itself is the response, or same_host to only
+// follow redirects to the same host. Without status, any status below
+// 400 is acceptable. Body_match is a regular expression that the body
+// must match and json maps dot separated paths into a JSON response,
+// eg. storage.0.status, to their expected values.
+//
+// Path, body and header values are templates, see cgiTemplateData,
+// eg. /cgi-bin/time.cgi?now={{.Now.Unix}}&pw={{.Secret "cam"}}.
+//
+// Parse is one of kv, json, xml or regex and is used to extract the
+// named fields from the response body, each field is a key for kv, a dot
+// separated path for json and xml, eg. DeviceInfo.firmwareVersion, or
+// a regular expression whose first sub-match is the value for regex.
+// For all but regex, all values are extracted if no fields are given.
+// A change in any of the fields listed in changes is reported, as is a
+// decrease in the value of any of the counters, eg. uptime.
 type CGIConfig struct {
-	Path     string        `yaml:"path,omitempty"`
-	Scheme   string        `yaml:"scheme,omitempty"`
-	Port     int           `yaml:"port,omitempty"`
-	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	Path       string            `yaml:"path,omitempty"`
+	Scheme     string            `yaml:"scheme,omitempty"`
+	Port       int               `yaml:"port,omitempty"`
+	Timeout    time.Duration     `yaml:"timeout,omitempty"`
+	Interval   time.Duration     `yaml:"interval,omitempty"`
+	OnceOnly   bool              `yaml:"once_only,omitempty"`
+	AuthID     string            `yaml:"key_id,omitempty"`
+	Auth       string            `yaml:"auth,omitempty"`
+	Method     string            `yaml:"method,omitempty"`
+	Headers    map[string]string `yaml:"headers,omitempty"`
+	Body       string            `yaml:"body,omitempty"`
+	Redirects  string            `yaml:"redirects,omitempty"`
+	Status     []int             `yaml:"status,omitempty"`
+	BodyMatch  string            `yaml:"body_match,omitempty"`
+	JSON       map[string]string `yaml:"json,omitempty"`
+	MaxLatency time.Duration     `yaml:"max_latency,omitempty"`
+	Parse      string            `yaml:"parse,omitempty"`
+	Fields     map[string]string `yaml:"fields,omitempty"`
+	Changes    []string          `yaml:"changes,omitempty"`
+	Counters   []string          `yaml:"counters,omitempty"`
+}
+
+// CGIActionConfig defines a named CGI request, eg. to reboot a camera or
+// set its clock, that is run on demand by 'devices cgi' or, if interval
+// is specified, on that schedule by 'devices monitor --cgi-actions'.
+type CGIActionConfig struct {
+	Name      string `yaml:"name"`
+	CGIConfig `yaml:",inline"`
+}
+
+// TCPConfig configures connecting to one or more TCP ports on a device.
+// If banner is specified, the first line sent by the device, eg. an SSH
+// or SMTP greeting, is read and must match the regular expression.
+type TCPConfig struct {
+	Ports    []int         `yaml:"ports"`
 	Interval time.Duration `yaml:"interval,omitempty"`
-	OnceOnly bool          `yaml:"once_only,omitempty"`
-	AuthID   string        `yaml:"key_id,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	Banner   string        `yaml:"banner,omitempty"`
+}
+
+// DNSConfig configures a DNS query and the checks made on its answer.
+// Queries configured for a device are sent to that device unless
+// server is specified. Transport is one of udp (the default), tcp or
+// tls (DNS over TLS), in which case tls_name is the name used to verify
+// the server's certificate, it defaults to the server's address.
+// Expect lists the addresses that must be returned, cname a name that
+// must appear in the CNAME chain and min_ttl the smallest acceptable
+// TTL for any of the answers.
+type DNSConfig struct {
+	Server    string        `yaml:"server,omitempty"`
+	Transport string        `yaml:"transport,omitempty"`
+	TLSName   string        `yaml:"tls_name,omitempty"`
+	Name      string        `yaml:"name"`
+	Type      string        `yaml:"type,omitempty"`
+	Expect    []string      `yaml:"expect,omitempty"`
+	CNAME     string        `yaml:"cname,omitempty"`
+	MinTTL    time.Duration `yaml:"min_ttl,omitempty"`
+	Interval  time.Duration `yaml:"interval,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+}
+
+// TLSConfig configures checking the certificate presented on a port.
+// Server_name is sent as the SNI and used to verify the certificate.
+// Warn_days lists the number of days before expiry at which to warn.
+type TLSConfig struct {
+	Port       int           `yaml:"port,omitempty"`
+	ServerName string        `yaml:"server_name,omitempty"`
+	Interval   time.Duration `yaml:"interval,omitempty"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+	WarnDays   []int         `yaml:"warn_days,omitempty"`
+}
+
+// SyslogConfig configures how the syslog messages sent by a device are
+// attributed to it and filtered. Messages are attributed to a device by
+// their source IP address or by any of the hostnames listed here.
+type SyslogConfig struct {
+	Hostnames []string           `yaml:"hostnames,omitempty"`
+	Rules     []SyslogRuleConfig `yaml:"rules,omitempty"`
+}
+
+// SyslogRuleConfig specifies an action, one of keep, drop or escalate,
+// for the syslog messages that match all of the specified facilities,
+// have a severity at least as severe as severity and whose content
+// matches the regular expression match. Facilities and severities may
+// be specified by name (eg. daemon, local0, warning) or number. The
+// first matching rule applies and messages that match no rule are kept.
+// Escalated messages are logged as warnings with the message
+// "escalated syslog" so that they may be used in alert rules.
+type SyslogRuleConfig struct {
+	Action     string   `yaml:"action"`
+	Facilities []string `yaml:"facilities,omitempty"`
+	Severity   string   `yaml:"severity,omitempty"`
+	Match      string   `yaml:"match,omitempty"`
 }
 
 func (r RTSPConfig) String() string {
@@ -81,15 +269,28 @@ func (d Device) String() string {
 }
 
 type ICMPOption struct {
-	Devices  []string      `yaml:"devices"`
-	Interval time.Duration `yaml:"interval,omitempty"`
-	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	Devices         []string      `yaml:"devices"`
+	Interval        time.Duration `yaml:"interval,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	StatsWindow     int           `yaml:"stats_window,omitempty"`
+	SummaryInterval time.Duration `yaml:"summary_interval,omitempty"`
 }
 
 func (i ICMPOption) String() string {
 	return fmt.Sprintf("interval: %v", i.Interval)
 }
 
+// PathOption configures path monitoring, the values specified here are
+// used for devices that do not specify their own.
+type PathOption struct {
+	Devices     []string      `yaml:"devices"`
+	Interval    time.Duration `yaml:"interval,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	MaxHops     int           `yaml:"max_hops,omitempty"`
+	Probes      int           `yaml:"probes,omitempty"`
+	LatencyStep time.Duration `yaml:"latency_step,omitempty"`
+}
+
 type RTSPOption struct {
 	Devices  []string      `yaml:"devices"`
 	Interval time.Duration `yaml:"interval,omitempty"`
@@ -111,17 +312,154 @@ type CGIOption struct {
 	Timeout  time.Duration `yaml:"timeout,omitempty"`
 }
 
+type TCPOption struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+}
+
+// DNSOption configures DNS monitoring. Queries are sent to the servers
+// they specify and are attributed to the device with that address, if
+// any. Devices whose ip is specified as a hostname are re-resolved every
+// resolve_interval, whether or not dns monitoring is enabled, a change in
+// address is reported and is used by the device's other monitors from
+// their next probe or connection. A hostname that cannot be resolved at
+// startup is retried and the device is not monitored until it resolves.
+type DNSOption struct {
+	Interval        time.Duration `yaml:"interval,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	ResolveInterval time.Duration `yaml:"resolve_interval,omitempty"`
+	Queries         []DNSConfig   `yaml:"queries,omitempty"`
+}
+
+// TLSOption configures TLS certificate monitoring. Devices without any
+// tls configuration are checked on the ports of their https cgi
+// invocations.
+type TLSOption struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	WarnDays []int         `yaml:"warn_days,omitempty"`
+}
+
+// AlertRuleConfig defines the conditions under which an alert fires
+// for a device. Events are matched by module and message, eg. module
+// "ping" and message "timeout". Without a window, the alert fires
+// after count consecutive matches and resolves on any of the resolve
+// messages. With a window, the alert fires when more than count
+// matches occur within the window and resolves once they no longer do.
+// Alerts with neither resolve messages nor a window resolve once no
+// matching events have been seen for resolve_after.
+type AlertRuleConfig struct {
+	Name         string        `yaml:"name"`
+	Devices      []string      `yaml:"devices,omitempty"`
+	Module       string        `yaml:"module"`
+	Match        []string      `yaml:"match"`
+	Resolve      []string      `yaml:"resolve,omitempty"`
+	Count        int           `yaml:"count,omitempty"`
+	Window       time.Duration `yaml:"window,omitempty"`
+	ResolveAfter time.Duration `yaml:"resolve_after,omitempty"`
+	Severity     string        `yaml:"severity,omitempty"`
+}
+
+// NotifierConfig configures a destination for alert notifications.
+// Type is one of webhook, email, ntfy, pushover or command.
+type NotifierConfig struct {
+	Name     string            `yaml:"name"`
+	Type     string            `yaml:"type"`
+	URL      string            `yaml:"url,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	AuthID   string            `yaml:"key_id,omitempty"`
+	Server   string            `yaml:"server,omitempty"`
+	From     string            `yaml:"from,omitempty"`
+	To       []string          `yaml:"to,omitempty"`
+	Priority string            `yaml:"priority,omitempty"`
+	Command  []string          `yaml:"command,omitempty"`
+	Timeout  time.Duration     `yaml:"timeout,omitempty"`
+}
+
+type AlertsOption struct {
+	RepeatInterval time.Duration     `yaml:"repeat_interval,omitempty"`
+	MaxPerHour     int               `yaml:"max_per_hour,omitempty"`
+	Rules          []AlertRuleConfig `yaml:"rules"`
+	Notifiers      []NotifierConfig  `yaml:"notifiers"`
+}
+
+// LogSinkConfig configures an additional destination for log records.
+// Type is one of file, stdout, stderr or syslog, Format is one of json
+// or text and Level is specified as for the --log-level flag, eg.
+// "warn,rtsp=debug". Syslog sinks send records to the server at Address
+// using Network, one of udp (the default), tcp or tls, and Tag as the
+// application name.
+type LogSinkConfig struct {
+	Type    string `yaml:"type"`
+	Path    string `yaml:"path,omitempty"`
+	Network string `yaml:"network,omitempty"`
+	Address string `yaml:"address,omitempty"`
+	Tag     string `yaml:"tag,omitempty"`
+	Format  string `yaml:"format,omitempty"`
+	Level   string `yaml:"level,omitempty"`
+}
+
+// LoggingOption configures the level and format of the log file and
+// any additional sinks, the command line flags take precedence over
+// the level and format specified here.
+type LoggingOption struct {
+	Level  string          `yaml:"level,omitempty"`
+	Format string          `yaml:"format,omitempty"`
+	Sinks  []LogSinkConfig `yaml:"sinks,omitempty"`
+}
+
+// SyslogListenerConfig configures a syslog listener. Network is one of
+// udp (the default), tcp or tls, with tls requiring cert_file and
+// key_file. Format is one of rfc3164, rfc5424, rfc6587 or auto (the
+// default) to detect the format of each message. Address defaults to
+// all interfaces on port 514, or 6514 for tls, use a port above 1024
+// to run without root privileges.
+type SyslogListenerConfig struct {
+	Network  string `yaml:"network,omitempty"`
+	Address  string `yaml:"address,omitempty"`
+	Format   string `yaml:"format,omitempty"`
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+}
+
+// SyslogRelayConfig configures an upstream syslog collector that the
+// received messages are relayed to in RFC 5424 format, preserving their
+// original timestamps and hostnames. Network is one of udp (the
+// default), tcp or tls, and ca_file optionally specifies the
+// certificate authorities used to verify a tls collector.
+type SyslogRelayConfig struct {
+	Network string `yaml:"network,omitempty"`
+	Address string `yaml:"address"`
+	CAFile  string `yaml:"ca_file,omitempty"`
+}
+
+// SyslogOption configures the syslog server. Messages that are not
+// dropped are written to a plain text file per device per day in
+// archive_dir, if specified, and relayed to all of the relays.
+type SyslogOption struct {
+	Listeners  []SyslogListenerConfig `yaml:"listeners"`
+	ArchiveDir string                 `yaml:"archive_dir,omitempty"`
+	Relays     []SyslogRelayConfig    `yaml:"relays,omitempty"`
+}
+
 type Options struct {
 	ICMP    *ICMPOption    `yaml:"icmp"`
+	Path    *PathOption    `yaml:"path"`
 	RTSP    *RTSPOption    `yaml:"rtsp"`
 	ARP     *ARPOption     `yaml:"arp"`
 	Routing *RoutingOption `yaml:"routing"`
 	CGI     *CGIOption     `yaml:"cgi"`
+	TCP     *TCPOption     `yaml:"tcp"`
+	DNS     *DNSOption     `yaml:"dns"`
+	TLS     *TLSOption     `yaml:"tls"`
+	Syslog  *SyslogOption  `yaml:"syslog"`
 }
 
 type Config struct {
-	Options Options  `yaml:"options"`
-	Devices []Device `yaml:"devices"`
+	Options Options        `yaml:"options"`
+	Devices []Device       `yaml:"devices"`
+	Alerts  *AlertsOption  `yaml:"alerts"`
+	Logging *LoggingOption `yaml:"logging"`
 	auth    keystore.Keys
 	devices map[string]*Device
 }
@@ -152,23 +490,80 @@ func ParseConfig(ctx context.Context, flags ConfigFlags) (*Config, error) {
 		if device.Ignore {
 			continue
 		}
-		if len(device.IP) > 0 {
-			device.ipAddr, err = ParseIPAddr(device.IP)
+		if device.RTSP != nil && len(device.RTSP.Media) > 0 {
+			media, err := rtspMediaName(device.RTSP.Media)
 			if err != nil {
 				return nil, fmt.Errorf("device %q: %v", device.Name, err)
 			}
+			device.RTSP.Media = media
+		}
+		if len(device.IP) > 0 {
+			if err := device.resolve(ctx); err != nil {
+				return nil, fmt.Errorf("device %q: %v", device.Name, err)
+			}
 		}
 		config.devices[config.Devices[i].Name] = device
 	}
 	return &config, err
 }
 
+// resolve parses the device's IP, resolving it if it is a hostname. A
+// hostname that cannot be resolved is not an error, the device is kept
+// without an address until the hostname is re-resolved and its monitors
+// wait until then.
+func (d *Device) resolve(ctx context.Context) error {
+	addr, err := ParseIPAddr(d.IP)
+	if err == nil {
+		d.ipAddr = addr
+		return nil
+	}
+	if !isHostname(d.IP) {
+		return err
+	}
+	d.hostname = d.IP
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", d.IP)
+	if err != nil || len(addrs) == 0 {
+		fmt.Fprintf(os.Stderr, "warning: device %q: failed to resolve %v, will retry: %v\n", d.Name, d.hostname, err)
+		d.addr = newSharedAddr(netip.Addr{})
+		return nil
+	}
+	d.ipAddr = preferredAddr(addrs)
+	d.IP = d.ipAddr.String()
+	d.addr = newSharedAddr(d.ipAddr)
+	return nil
+}
+
+// current returns the device with its current address, IP is left
+// as the hostname until it has been resolved.
+func (d Device) current() Device {
+	d.ipAddr = d.addr.load(d.ipAddr)
+	if d.ipAddr.IsValid() {
+		d.IP = d.ipAddr.String()
+	}
+	return d
+}
+
 type ICMPDevice struct {
-	Name     string
-	IP       string
-	Interval time.Duration
-	Timeout  time.Duration
-	ipAddr   netip.Addr
+	Name            string
+	IP              string
+	Interval        time.Duration
+	Timeout         time.Duration
+	StatsWindow     int
+	SummaryInterval time.Duration
+	Count           int
+	Spacing         time.Duration
+	PayloadSize     int
+	DontFragment    bool
+	TTL             int
+	ipAddr          netip.Addr
+	addr            *sharedAddr
+}
+
+// current returns the device with its current address.
+func (d ICMPDevice) current() ICMPDevice {
+	d.ipAddr = d.addr.load(d.ipAddr)
+	d.IP = d.ipAddr.String()
+	return d
 }
 
 func (c Config) deviceNamesFor(names []string) []string {
@@ -226,24 +621,139 @@ func (c Config) ICMPDevices() ([]ICMPDevice, error) {
 			Name:   d.Name,
 			IP:     d.IP,
 			ipAddr: d.ipAddr,
+			addr:   d.addr,
 		}
-		v.Interval, v.Timeout = defaultIntervalTimeout(d.ICMP.Interval, d.ICMP.Timeout, c.Options.ICMP.Interval, c.Options.ICMP.Timeout)
+		var dc ICMPConfig
+		if d.ICMP != nil {
+			dc = *d.ICMP
+		}
+		v.Interval, v.Timeout = defaultIntervalTimeout(dc.Interval, dc.Timeout, c.Options.ICMP.Interval, c.Options.ICMP.Timeout)
 		v.Interval, v.Timeout = defaultIntervalTimeout(v.Interval, v.Timeout, DefaultICMPTimeout, DefaultICMPPingInterval)
+		v.StatsWindow, v.SummaryInterval = c.Options.ICMP.StatsWindow, c.Options.ICMP.SummaryInterval
+		if dc.StatsWindow > 0 {
+			v.StatsWindow = dc.StatsWindow
+		}
+		if dc.SummaryInterval > 0 {
+			v.SummaryInterval = dc.SummaryInterval
+		}
+		switch {
+		case dc.Count < 0:
+			return nil, fmt.Errorf("device %q: invalid icmp count: %v", name, dc.Count)
+		case dc.PayloadSize < 0 || dc.PayloadSize > MaxICMPPayloadSize:
+			return nil, fmt.Errorf("device %q: invalid icmp payload_size: %v, must be at most %v", name, dc.PayloadSize, MaxICMPPayloadSize)
+		case dc.TTL < 0 || dc.TTL > 255:
+			return nil, fmt.Errorf("device %q: invalid icmp ttl: %v", name, dc.TTL)
+		}
+		v.Count, v.Spacing = max(dc.Count, 1), dc.Spacing
+		if v.Spacing <= 0 {
+			v.Spacing = DefaultICMPSpacing
+		}
+		v.PayloadSize, v.DontFragment, v.TTL = dc.PayloadSize, dc.DontFragment, dc.TTL
+		if v.StatsWindow <= 0 {
+			v.StatsWindow = DefaultICMPStatsWindow
+		}
+		if v.SummaryInterval <= 0 {
+			v.SummaryInterval = DefaultICMPSummary
+		}
+		cfg = append(cfg, v)
+	}
+	return cfg, nil
+}
+
+type PathDevice struct {
+	Name        string
+	IP          string
+	Interval    time.Duration
+	Timeout     time.Duration
+	MaxHops     int
+	Probes      int
+	LatencyStep time.Duration
+	ipAddr      netip.Addr
+	addr        *sharedAddr
+}
+
+// current returns the device with its current address.
+func (d PathDevice) current() PathDevice {
+	d.ipAddr = d.addr.load(d.ipAddr)
+	d.IP = d.ipAddr.String()
+	return d
+}
+
+func firstPositive[T int | time.Duration](values ...T) T {
+	for _, v := range values {
+		if v > 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+func (c Config) PathDevices() ([]PathDevice, error) {
+	if c.Options.Path == nil {
+		return nil, nil
+	}
+	opts := c.Options.Path
+	names := c.deviceNamesFor(opts.Devices)
+	cfg := make([]PathDevice, 0, len(names))
+	for _, name := range names {
+		d, ok := c.devices[name]
+		if !ok {
+			return nil, fmt.Errorf("device %q not found\n", name)
+		}
+		if d.Ignore {
+			continue
+		}
+		var dc PathConfig
+		if d.Path != nil {
+			dc = *d.Path
+		}
+		v := PathDevice{
+			Name:        d.Name,
+			IP:          d.IP,
+			Interval:    firstPositive(dc.Interval, opts.Interval, DefaultPathInterval),
+			Timeout:     firstPositive(dc.Timeout, opts.Timeout, DefaultPathTimeout),
+			MaxHops:     firstPositive(dc.MaxHops, opts.MaxHops, DefaultPathMaxHops),
+			Probes:      firstPositive(dc.Probes, opts.Probes, DefaultPathProbes),
+			LatencyStep: firstPositive(dc.LatencyStep, opts.LatencyStep, DefaultPathLatencyStep),
+			ipAddr:      d.ipAddr,
+			addr:        d.addr,
+		}
+		if v.MaxHops > 255 {
+			return nil, fmt.Errorf("device %q: invalid path max_hops: %v", name, v.MaxHops)
+		}
 		cfg = append(cfg, v)
 	}
 	return cfg, nil
 }
 
 type RTSPDevice struct {
-	Name     string
-	IP       string
-	Port     int
-	URL      string
-	SafeURL  string // no password
-	Media    string
-	Interval time.Duration
-	Timeout  time.Duration
-	ipAddr   netip.Addr
+	Name      string
+	IP        string
+	Port      int
+	URL       string
+	SafeURL   string // no password
+	Media     string
+	AllTracks bool
+	Interval  time.Duration
+	Timeout   time.Duration
+	ipAddr    netip.Addr
+	addr      *sharedAddr
+	auth      keystore.KeyInfo
+	path      string
+}
+
+func (d *RTSPDevice) setURLs() {
+	d.URL = fmt.Sprintf("rtsp://%s:%s@%s:%d/%s", d.auth.User, d.auth.Token, d.IP, d.Port, d.path)
+	d.SafeURL = fmt.Sprintf("rtsp://%s:%s@%s:%d/%s", d.auth.User, "****", d.IP, d.Port, d.path)
+}
+
+// current returns the device with its current address.
+func (d RTSPDevice) current() RTSPDevice {
+	if addr := d.addr.load(d.ipAddr); addr != d.ipAddr {
+		d.ipAddr, d.IP = addr, addr.String()
+		d.setURLs()
+	}
+	return d
 }
 
 func (c Config) RTSPDevices() ([]RTSPDevice, error) {
@@ -262,35 +772,58 @@ func (c Config) RTSPDevices() ([]RTSPDevice, error) {
 			continue
 		}
 		v := RTSPDevice{
-			Name:   d.Name,
-			IP:     d.IP,
-			Media:  "H264",
-			ipAddr: d.ipAddr,
+			Name:      d.Name,
+			IP:        d.IP,
+			Media:     d.RTSP.Media,
+			AllTracks: d.RTSP.AllTracks,
+			ipAddr:    d.ipAddr,
+			addr:      d.addr,
 		}
-		if len(d.RTSP.Media) != 0 {
-			v.Media = d.RTSP.Media
+		if len(v.Media) == 0 && !v.AllTracks {
+			v.Media = "H264"
 		}
 		v.Port = defaultPort(d.RTSP.Port, DefaultRSTPPort)
 		v.Interval, v.Timeout = defaultIntervalTimeout(d.RTSP.Interval, d.RTSP.Timeout, c.Options.RTSP.Interval, c.Options.RTSP.Timeout)
 		v.Timeout, v.Interval = defaultIntervalTimeout(v.Interval, v.Timeout, DefaultRTSPTimeout, DefaultRTSPInterval)
-		auth := c.defaultAuthID(d.RTSP.AuthID, d.AuthID)
-		v.URL = fmt.Sprintf("rtsp://%s:%s@%s:%d/%s", auth.User, auth.Token, v.IP, v.Port, d.RTSP.Path)
-		v.SafeURL = fmt.Sprintf("rtsp://%s:%s@%s:%d/%s", auth.User, "****", v.IP, v.Port, d.RTSP.Path)
+		v.auth = c.defaultAuthID(d.RTSP.AuthID, d.AuthID)
+		v.path = d.RTSP.Path
+		v.setURLs()
 		cfg = append(cfg, v)
 	}
 	return cfg, nil
 }
 
 type CGIInvocation struct {
-	Name     string
-	Scheme   string
-	Path     string
-	Port     int
-	Interval time.Duration
-	Timeout  time.Duration
-	OnceOnly bool
-	Auth     keystore.KeyInfo
-	IPAddr   netip.Addr
+	Name       string
+	Scheme     string
+	Path       string
+	Port       int
+	Interval   time.Duration
+	Timeout    time.Duration
+	OnceOnly   bool
+	Auth       keystore.KeyInfo
+	AuthScheme string
+	Method     string
+	Headers    map[string]string
+	Body       string
+	Redirects  string
+	Status     []int
+	BodyMatch  *regexp.Regexp
+	JSON       map[string]string
+	MaxLatency time.Duration
+	Parser     cgiParser
+	Changes    []string
+	Counters   []string
+	Action     string
+	IPAddr     netip.Addr
+	addr       *sharedAddr
+	templates  *cgiTemplates
+}
+
+// current returns the invocation with the device's current address.
+func (inv CGIInvocation) current() CGIInvocation {
+	inv.IPAddr = inv.addr.load(inv.IPAddr)
+	return inv
 }
 
 func (c Config) CGIInvocations() ([]CGIInvocation, error) {
@@ -303,27 +836,428 @@ func (c Config) CGIInvocations() ([]CGIInvocation, error) {
 			continue
 		}
 		for _, invocation := range device.CGI {
-			v := CGIInvocation{
-				Name:     device.Name,
-				Path:     invocation.Path,
-				IPAddr:   device.ipAddr,
-				Scheme:   invocation.Scheme,
-				OnceOnly: invocation.OnceOnly,
-				Port:     invocation.Port,
-			}
-			if v.Scheme == "" {
-				v.Scheme = "http"
+			v, err := c.cgiInvocation(device, invocation)
+			if err != nil {
+				return nil, fmt.Errorf("device %q: cgi %q: %v", device.Name, invocation.Path, err)
 			}
-			v.Port = defaultPort(v.Port, DefaultCGIPort)
-			v.Interval, v.Timeout = defaultIntervalTimeout(invocation.Interval, invocation.Timeout, c.Options.CGI.Interval, c.Options.CGI.Timeout)
-			v.Interval, v.Timeout = defaultIntervalTimeout(v.Interval, v.Timeout, DefaultCGIInterval, DefaultCGITimeout)
-			v.Auth = c.defaultAuthID(invocation.AuthID, device.AuthID)
 			invocations = append(invocations, v)
 		}
 	}
 	return invocations, nil
 }
 
+// CGIActions returns all of the actions configured for all devices,
+// actions are only scheduled if they specify an interval.
+func (c Config) CGIActions() ([]CGIInvocation, error) {
+	var actions []CGIInvocation
+	for _, device := range c.Devices {
+		if device.Ignore {
+			continue
+		}
+		for _, action := range device.Actions {
+			if len(action.Name) == 0 {
+				return nil, fmt.Errorf("device %q: action with no name", device.Name)
+			}
+			v, err := c.cgiInvocation(&device, action.CGIConfig)
+			if err != nil {
+				return nil, fmt.Errorf("device %q: action %q: %v", device.Name, action.Name, err)
+			}
+			v.Action = action.Name
+			v.Interval = action.Interval
+			actions = append(actions, v)
+		}
+	}
+	return actions, nil
+}
+
+func (c Config) cgiInvocation(device *Device, invocation CGIConfig) (CGIInvocation, error) {
+	v := CGIInvocation{
+		Name:       device.Name,
+		Path:       invocation.Path,
+		IPAddr:     device.ipAddr,
+		addr:       device.addr,
+		Scheme:     invocation.Scheme,
+		OnceOnly:   invocation.OnceOnly,
+		Port:       invocation.Port,
+		AuthScheme: invocation.Auth,
+		Method:     strings.ToUpper(invocation.Method),
+		Headers:    invocation.Headers,
+		Body:       invocation.Body,
+		Redirects:  invocation.Redirects,
+		Status:     invocation.Status,
+		JSON:       invocation.JSON,
+		MaxLatency: invocation.MaxLatency,
+		Changes:    invocation.Changes,
+		Counters:   invocation.Counters,
+	}
+	if err := v.validate(invocation); err != nil {
+		return v, err
+	}
+	var err error
+	if v.templates, err = newCGITemplates(v.Path, v.Body, v.Headers, c.auth); err != nil {
+		return v, err
+	}
+	if v.Scheme == "https" {
+		v.Port = defaultPort(v.Port, DefaultCGITLSPort)
+	}
+	v.Port = defaultPort(v.Port, DefaultCGIPort)
+	var opts CGIOption
+	if c.Options.CGI != nil {
+		opts = *c.Options.CGI
+	}
+	v.Interval, v.Timeout = defaultIntervalTimeout(invocation.Interval, invocation.Timeout, opts.Interval, opts.Timeout)
+	v.Interval, v.Timeout = defaultIntervalTimeout(v.Interval, v.Timeout, DefaultCGIInterval, DefaultCGITimeout)
+	v.Auth = c.defaultAuthID(invocation.AuthID, device.AuthID)
+	return v, nil
+}
+
+// validate applies defaults to, and validates, the request and
+// assertion settings.
+func (v *CGIInvocation) validate(cfg CGIConfig) error {
+	if v.Scheme == "" {
+		v.Scheme = "http"
+	}
+	if v.Scheme != "http" && v.Scheme != "https" {
+		return fmt.Errorf("invalid scheme %q, must be http or https", v.Scheme)
+	}
+	if v.Method == "" {
+		v.Method = "GET"
+	}
+	switch v.AuthScheme {
+	case "":
+		v.AuthScheme = "digest"
+	case "digest", "basic", "bearer", "none":
+	default:
+		return fmt.Errorf("invalid auth %q, must be one of digest, basic, bearer or none", v.AuthScheme)
+	}
+	switch v.Redirects {
+	case "":
+		v.Redirects = "follow"
+	case "follow", "none", "same_host":
+	default:
+		return fmt.Errorf("invalid redirects %q, must be one of follow, none or same_host", v.Redirects)
+	}
+	for _, s := range v.Status {
+		if s < 100 || s > 599 {
+			return fmt.Errorf("invalid status %v", s)
+		}
+	}
+	if len(cfg.BodyMatch) > 0 {
+		var err error
+		if v.BodyMatch, err = regexp.Compile(cfg.BodyMatch); err != nil {
+			return fmt.Errorf("invalid body_match: %w", err)
+		}
+	}
+	if len(cfg.Parse) == 0 {
+		if len(cfg.Fields) > 0 || len(v.Changes) > 0 || len(v.Counters) > 0 {
+			return fmt.Errorf("fields, changes and counters require parse to be specified")
+		}
+		return nil
+	}
+	var err error
+	if v.Parser, err = newCGIParser(cfg.Parse, cfg.Fields); err != nil {
+		return err
+	}
+	for _, f := range append(slices.Clone(v.Changes), v.Counters...) {
+		if _, ok := cfg.Fields[f]; len(cfg.Fields) > 0 && !ok {
+			return fmt.Errorf("unknown field %q", f)
+		}
+	}
+	return nil
+}
+
+type TCPProbe struct {
+	Name     string
+	Port     int
+	Interval time.Duration
+	Timeout  time.Duration
+	Banner   *regexp.Regexp
+	IPAddr   netip.Addr
+	addr     *sharedAddr
+}
+
+// current returns the probe with the device's current address.
+func (p TCPProbe) current() TCPProbe {
+	p.IPAddr = p.addr.load(p.IPAddr)
+	return p
+}
+
+// TCPProbes returns a probe for every port configured for every device,
+// in the order in which they are configured.
+func (c Config) TCPProbes() ([]TCPProbe, error) {
+	if c.Options.TCP == nil {
+		return nil, nil
+	}
+	var probes []TCPProbe
+	for _, device := range c.Devices {
+		if device.Ignore {
+			continue
+		}
+		if len(device.TCP) > 0 && !device.ipAddr.IsValid() && len(device.hostname) == 0 {
+			return nil, fmt.Errorf("device %q: tcp probes require an ip address", device.Name)
+		}
+		for _, cfg := range device.TCP {
+			var banner *regexp.Regexp
+			if len(cfg.Banner) > 0 {
+				var err error
+				if banner, err = regexp.Compile(cfg.Banner); err != nil {
+					return nil, fmt.Errorf("device %q: invalid tcp banner: %w", device.Name, err)
+				}
+			}
+			interval, timeout := defaultIntervalTimeout(cfg.Interval, cfg.Timeout, c.Options.TCP.Interval, c.Options.TCP.Timeout)
+			interval, timeout = defaultIntervalTimeout(interval, timeout, DefaultTCPInterval, DefaultTCPTimeout)
+			for _, port := range cfg.Ports {
+				if port <= 0 || port > 65535 {
+					return nil, fmt.Errorf("device %q: invalid tcp port: %v", device.Name, port)
+				}
+				probes = append(probes, TCPProbe{
+					Name:     device.Name,
+					Port:     port,
+					Interval: interval,
+					Timeout:  timeout,
+					Banner:   banner,
+					IPAddr:   device.ipAddr,
+					addr:     device.addr,
+				})
+			}
+		}
+	}
+	return probes, nil
+}
+
+type DNSQuery struct {
+	Device    string
+	Server    netip.AddrPort
+	Transport string
+	TLSName   string
+	Name      string
+	Type      dnsmessage.Type
+	Expect    []netip.Addr
+	CNAME     string
+	MinTTL    time.Duration
+	Interval  time.Duration
+	Timeout   time.Duration
+}
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+// DNSQueries returns the queries configured for all devices followed by
+// the globally configured queries.
+func (c Config) DNSQueries() ([]DNSQuery, error) {
+	if c.Options.DNS == nil {
+		return nil, nil
+	}
+	var queries []DNSQuery
+	for _, device := range c.Devices {
+		if device.Ignore {
+			continue
+		}
+		for _, cfg := range device.DNS {
+			q, err := c.dnsQuery(cfg, device.ipAddr)
+			if err != nil {
+				return nil, fmt.Errorf("device %q: %v", device.Name, err)
+			}
+			q.Device = device.Name
+			queries = append(queries, q)
+		}
+	}
+	for _, cfg := range c.Options.DNS.Queries {
+		q, err := c.dnsQuery(cfg, netip.Addr{})
+		if err != nil {
+			return nil, fmt.Errorf("dns query %q: %v", cfg.Name, err)
+		}
+		q.Device = q.Server.Addr().String()
+		for _, d := range c.devices {
+			if d.ipAddr == q.Server.Addr() {
+				q.Device = d.Name
+				break
+			}
+		}
+		queries = append(queries, q)
+	}
+	return queries, nil
+}
+
+func (c Config) dnsQuery(cfg DNSConfig, server netip.Addr) (DNSQuery, error) {
+	q := DNSQuery{
+		Transport: cfg.Transport,
+		TLSName:   cfg.TLSName,
+		Name:      cfg.Name,
+		CNAME:     cfg.CNAME,
+		MinTTL:    cfg.MinTTL,
+	}
+	if len(q.Name) == 0 {
+		return q, fmt.Errorf("no name to query")
+	}
+	port := DefaultDNSPort
+	switch q.Transport {
+	case "":
+		q.Transport = "udp"
+	case "udp", "tcp":
+	case "tls":
+		port = DefaultDNSTLSPort
+	default:
+		return q, fmt.Errorf("invalid transport %q, must be one of udp, tcp or tls", q.Transport)
+	}
+	switch {
+	case len(cfg.Server) > 0:
+		if ap, err := netip.ParseAddrPort(cfg.Server); err == nil {
+			q.Server = ap
+			break
+		}
+		addr, err := ParseIPAddr(cfg.Server)
+		if err != nil {
+			return q, err
+		}
+		q.Server = netip.AddrPortFrom(addr, uint16(port))
+	case server.IsValid():
+		q.Server = netip.AddrPortFrom(server, uint16(port))
+	default:
+		return q, fmt.Errorf("no server specified")
+	}
+	if len(q.TLSName) == 0 {
+		q.TLSName = q.Server.Addr().String()
+	}
+	typ := strings.ToUpper(cfg.Type)
+	if len(typ) == 0 {
+		typ = "A"
+	}
+	var ok bool
+	if q.Type, ok = dnsTypes[typ]; !ok {
+		return q, fmt.Errorf("unsupported record type %q", cfg.Type)
+	}
+	for _, e := range cfg.Expect {
+		addr, err := ParseIPAddr(e)
+		if err != nil {
+			return q, err
+		}
+		q.Expect = append(q.Expect, addr)
+	}
+	q.Interval, q.Timeout = defaultIntervalTimeout(cfg.Interval, cfg.Timeout, c.Options.DNS.Interval, c.Options.DNS.Timeout)
+	q.Interval, q.Timeout = defaultIntervalTimeout(q.Interval, q.Timeout, DefaultDNSInterval, DefaultDNSTimeout)
+	return q, nil
+}
+
+type TLSProbe struct {
+	Name       string
+	Port       int
+	ServerName string
+	Interval   time.Duration
+	Timeout    time.Duration
+	// Thresholds are the times before expiry at which to warn, in
+	// decreasing order.
+	Thresholds []time.Duration
+	IPAddr     netip.Addr
+	addr       *sharedAddr
+}
+
+// current returns the probe with the device's current address.
+func (p TLSProbe) current() TLSProbe {
+	p.IPAddr = p.addr.load(p.IPAddr)
+	return p
+}
+
+var defaultTLSWarnDays = []int{30, 7, 1}
+
+// TLSProbes returns a probe for every port configured for every device,
+// or for the https cgi ports of devices with no tls configuration.
+func (c Config) TLSProbes() ([]TLSProbe, error) {
+	if c.Options.TLS == nil {
+		return nil, nil
+	}
+	var probes []TLSProbe
+	for _, device := range c.Devices {
+		if device.Ignore {
+			continue
+		}
+		cfgs := device.TLS
+		if len(cfgs) == 0 {
+			for _, cgi := range device.CGI {
+				port := defaultPort(cgi.Port, DefaultCGITLSPort)
+				if cgi.Scheme == "https" && !slices.ContainsFunc(cfgs, func(t TLSConfig) bool { return t.Port == port }) {
+					cfgs = append(cfgs, TLSConfig{Port: port})
+				}
+			}
+		}
+		if len(cfgs) > 0 && !device.ipAddr.IsValid() && len(device.hostname) == 0 {
+			return nil, fmt.Errorf("device %q: tls probes require an ip address", device.Name)
+		}
+		for _, cfg := range cfgs {
+			p := TLSProbe{
+				Name:       device.Name,
+				Port:       defaultPort(cfg.Port, DefaultCGITLSPort),
+				ServerName: cfg.ServerName,
+				IPAddr:     device.ipAddr,
+				addr:       device.addr,
+			}
+			if p.Port > 65535 {
+				return nil, fmt.Errorf("device %q: invalid tls port: %v", device.Name, p.Port)
+			}
+			days := cfg.WarnDays
+			if len(days) == 0 {
+				days = c.Options.TLS.WarnDays
+			}
+			if len(days) == 0 {
+				days = defaultTLSWarnDays
+			}
+			for _, d := range days {
+				if d <= 0 {
+					return nil, fmt.Errorf("device %q: invalid tls warn_days: %v", device.Name, d)
+				}
+				p.Thresholds = append(p.Thresholds, time.Duration(d)*24*time.Hour)
+			}
+			slices.Sort(p.Thresholds)
+			slices.Reverse(p.Thresholds)
+			p.Thresholds = slices.Compact(p.Thresholds)
+			p.Interval, p.Timeout = defaultIntervalTimeout(cfg.Interval, cfg.Timeout, c.Options.TLS.Interval, c.Options.TLS.Timeout)
+			p.Interval, p.Timeout = defaultIntervalTimeout(p.Interval, p.Timeout, DefaultTLSInterval, DefaultTLSTimeout)
+			probes = append(probes, p)
+		}
+	}
+	return probes, nil
+}
+
+type HostnameDevice struct {
+	Name     string
+	Hostname string
+	Interval time.Duration
+	ipAddr   netip.Addr
+	addr     *sharedAddr
+}
+
+// HostnameDevices returns the devices whose IP was specified as a
+// hostname and hence need to be periodically re-resolved.
+func (c Config) HostnameDevices() []HostnameDevice {
+	var devices []HostnameDevice
+	interval := DefaultDNSResolveInterval
+	if c.Options.DNS != nil {
+		interval = firstPositive(c.Options.DNS.ResolveInterval, interval)
+	}
+	for _, d := range c.Devices {
+		if d.Ignore || len(d.hostname) == 0 {
+			continue
+		}
+		devices = append(devices, HostnameDevice{
+			Name:     d.Name,
+			Hostname: d.hostname,
+			Interval: interval,
+			ipAddr:   d.ipAddr,
+			addr:     d.addr,
+		})
+	}
+	return devices
+}
+
 func (c Config) devicesFor(names []string) ([]Device, error) {
 	cfg := make([]Device, 0, len(names))
 	for _, name := range names {
@@ -355,3 +1289,209 @@ func (c Config) RoutingDevices() ([]Device, error) {
 	names := c.deviceNamesFor(c.Options.Routing.Devices)
 	return c.devicesFor(names)
 }
+
+// SyslogListeners returns the syslog listeners to be started, a single
+// udp listener on port 514 is returned if none are configured.
+func (c Config) SyslogListeners() ([]SyslogListenerConfig, error) {
+	if c.Options.Syslog == nil || len(c.Options.Syslog.Listeners) == 0 {
+		return []SyslogListenerConfig{{Network: "udp", Address: fmt.Sprintf(":%d", DefaultSyslogPort), Format: "auto"}}, nil
+	}
+	listeners := make([]SyslogListenerConfig, 0, len(c.Options.Syslog.Listeners))
+	for i, l := range c.Options.Syslog.Listeners {
+		if len(l.Network) == 0 {
+			l.Network = "udp"
+		}
+		if len(l.Format) == 0 {
+			l.Format = "auto"
+		}
+		port := DefaultSyslogPort
+		switch l.Network {
+		case "udp", "tcp":
+		case "tls":
+			if len(l.CertFile) == 0 || len(l.KeyFile) == 0 {
+				return nil, fmt.Errorf("syslog listener %d: tls requires both cert_file and key_file", i)
+			}
+			port = DefaultSyslogTLSPort
+		default:
+			return nil, fmt.Errorf("syslog listener %d: unsupported network %q", i, l.Network)
+		}
+		switch l.Format {
+		case "rfc3164", "rfc5424", "rfc6587", "auto":
+		default:
+			return nil, fmt.Errorf("syslog listener %d: unsupported format %q", i, l.Format)
+		}
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			l.Address = net.JoinHostPort(l.Address, strconv.Itoa(port))
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+type SyslogAction string
+
+const (
+	SyslogKeep     SyslogAction = "keep"
+	SyslogDrop     SyslogAction = "drop"
+	SyslogEscalate SyslogAction = "escalate"
+)
+
+type SyslogRule struct {
+	Action     SyslogAction
+	Facilities map[int]bool
+	Severity   int // -1 for any severity.
+	Match      *regexp.Regexp
+}
+
+type SyslogDevice struct {
+	Name      string
+	IP        string
+	Hostnames []string
+	Rules     []SyslogRule
+	addr      *sharedAddr
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var syslogFacilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+
+// parseSyslogCode parses a syslog severity or facility specified either
+// by name or number.
+func parseSyslogCode(val string, names []string, aliases map[string]string) (int, error) {
+	val = strings.ToLower(val)
+	if alias, ok := aliases[val]; ok {
+		val = alias
+	}
+	for i, n := range names {
+		if n == val {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(val); err == nil && n >= 0 && n < len(names) {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown value %q", val)
+}
+
+func parseSyslogRule(r SyslogRuleConfig) (SyslogRule, error) {
+	rule := SyslogRule{Action: SyslogAction(r.Action), Severity: -1}
+	switch rule.Action {
+	case SyslogKeep, SyslogDrop, SyslogEscalate:
+	default:
+		return rule, fmt.Errorf("unsupported action %q", r.Action)
+	}
+	if len(r.Facilities) > 0 {
+		rule.Facilities = map[int]bool{}
+		for _, f := range r.Facilities {
+			n, err := parseSyslogCode(f, syslogFacilities, nil)
+			if err != nil {
+				return rule, fmt.Errorf("facility: %v", err)
+			}
+			rule.Facilities[n] = true
+		}
+	}
+	if len(r.Severity) > 0 {
+		n, err := parseSyslogCode(r.Severity, syslogSeverities, map[string]string{"emergency": "emerg", "critical": "crit", "error": "err", "warn": "warning"})
+		if err != nil {
+			return rule, fmt.Errorf("severity: %v", err)
+		}
+		rule.Severity = n
+	}
+	if len(r.Match) > 0 {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return rule, fmt.Errorf("match: %v", err)
+		}
+		rule.Match = re
+	}
+	return rule, nil
+}
+
+// SyslogDevices returns all of the devices that syslog messages may be
+// attributed to along with their filtering rules.
+func (c Config) SyslogDevices() ([]SyslogDevice, error) {
+	devices := make([]SyslogDevice, 0, len(c.Devices))
+	for _, d := range c.Devices {
+		if d.Ignore {
+			continue
+		}
+		sd := SyslogDevice{Name: d.Name, IP: d.IP, addr: d.addr}
+		if d.ipAddr.IsValid() {
+			sd.IP = d.ipAddr.String()
+		}
+		if d.Syslog != nil {
+			sd.Hostnames = d.Syslog.Hostnames
+			for i, r := range d.Syslog.Rules {
+				rule, err := parseSyslogRule(r)
+				if err != nil {
+					return nil, fmt.Errorf("device %q: syslog rule %d: %v", d.Name, i, err)
+				}
+				sd.Rules = append(sd.Rules, rule)
+			}
+		}
+		devices = append(devices, sd)
+	}
+	return devices, nil
+}
+
+type AlertRule struct {
+	Name         string
+	Devices      map[string]bool
+	Module       string
+	Match        map[string]bool
+	Resolve      map[string]bool
+	Count        int
+	Window       time.Duration
+	ResolveAfter time.Duration
+	Severity     string
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func (c Config) AlertRules() ([]AlertRule, error) {
+	if c.Alerts == nil {
+		return nil, nil
+	}
+	rules := make([]AlertRule, 0, len(c.Alerts.Rules))
+	for i, r := range c.Alerts.Rules {
+		if len(r.Name) == 0 {
+			return nil, fmt.Errorf("alert rule %d: missing name", i)
+		}
+		if len(r.Module) == 0 || len(r.Match) == 0 {
+			return nil, fmt.Errorf("alert rule %q: module and match must be specified", r.Name)
+		}
+		for _, name := range r.Devices {
+			if _, ok := c.devices[name]; !ok {
+				return nil, fmt.Errorf("alert rule %q: device %q not found", r.Name, name)
+			}
+		}
+		v := AlertRule{
+			Name:         r.Name,
+			Devices:      stringSet(r.Devices),
+			Module:       r.Module,
+			Match:        stringSet(r.Match),
+			Resolve:      stringSet(r.Resolve),
+			Count:        r.Count,
+			Window:       r.Window,
+			ResolveAfter: r.ResolveAfter,
+			Severity:     r.Severity,
+		}
+		if v.Count == 0 {
+			v.Count = 1
+		}
+		if v.ResolveAfter == 0 && len(v.Resolve) == 0 && v.Window == 0 {
+			v.ResolveAfter = DefaultAlertResolveAfter
+		}
+		if len(v.Severity) == 0 {
+			v.Severity = "warning"
+		}
+		rules = append(rules, v)
+	}
+	return rules, nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSyslogLines is the number of recent syslog lines retained per device.
+const maxSyslogLines = 20
+
+// ProbeStatus is the most recent result of a probe of a device.
+type ProbeStatus struct {
+	Up        bool      `json:"up"`
+	Message   string    `json:"msg"`
+	LatencyMS float64   `json:"latency_ms,omitempty"`
+	Err       string    `json:"err,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// ARPStatus is the most recently observed ARP table entry for a device.
+type ARPStatus struct {
+	MAC     string    `json:"mac"`
+	State   string    `json:"state"`
+	Iface   string    `json:"iface"`
+	Updated time.Time `json:"updated"`
+}
+
+// SyslogLine is a syslog message received from a device.
+type SyslogLine struct {
+	When     time.Time `json:"when"`
+	Severity string    `json:"severity,omitempty"`
+	Content  string    `json:"content"`
+}
+
+// DeviceStatus summarizes the current state of a device as observed by
+// all of the monitors.
+type DeviceStatus struct {
+	Name   string                  `json:"name"`
+	IP     string                  `json:"ip"`
+	Ping   *ProbeStatus            `json:"ping,omitempty"`
+	RTSP   *ProbeStatus            `json:"rtsp,omitempty"`
+	CGI    *ProbeStatus            `json:"cgi,omitempty"`
+	TCP    map[string]*ProbeStatus `json:"tcp,omitempty"`
+	ARP    *ARPStatus              `json:"arp,omitempty"`
+	Syslog []SyslogLine            `json:"syslog,omitempty"`
+}
+
+// StatusModel is an EventHandler that maintains an in-memory model of
+// the status of every configured device and relays events to any
+// connected dashboard clients.
+type StatusModel struct {
+	mu          sync.Mutex
+	devices     map[string]*DeviceStatus
+	byIP        map[string]string
+	subscribers map[chan Event]struct{}
+}
+
+func NewStatusModel(devices []Device) *StatusModel {
+	s := &StatusModel{
+		devices:     map[string]*DeviceStatus{},
+		byIP:        map[string]string{},
+		subscribers: map[chan Event]struct{}{},
+	}
+	for _, d := range devices {
+		if d.Ignore {
+			continue
+		}
+		s.devices[d.Name] = &DeviceStatus{Name: d.Name, IP: d.IP}
+		s.byIP[d.IP] = d.Name
+	}
+	return s
+}
+
+func probeStatus(ev Event, up bool, detail string) *ProbeStatus {
+	ps := &ProbeStatus{
+		Up:        up,
+		Message:   ev.Message,
+		LatencyMS: float64(ev.Latency) / float64(time.Millisecond),
+		Detail:    detail,
+		Updated:   ev.When,
+	}
+	if ev.Err != nil {
+		ps.Err = ev.Err.Error()
+	}
+	return ps
+}
+
+// syslogDevice returns the name of the device that sent a syslog
+// message based on its client address or hostname.
+func (s *StatusModel) syslogDevice(ev Event) string {
+	if len(ev.Device) > 0 {
+		return ev.Device
+	}
+	client := attrString(ev, "client")
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if name, ok := s.byIP[client]; ok {
+		return name
+	}
+	hostname := attrString(ev, "hostname")
+	if _, ok := s.devices[hostname]; ok {
+		return hostname
+	}
+	return s.byIP[hostname]
+}
+
+// HandleEvent implements EventHandler.
+func (s *StatusModel) HandleEvent(ctx context.Context, ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(ev)
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (s *StatusModel) update(ev Event) {
+	device := ev.Device
+	if ev.Module == "syslog" {
+		device = s.syslogDevice(ev)
+	}
+	ds, ok := s.devices[device]
+	if !ok {
+		return
+	}
+	switch ev.Module {
+	case "ping":
+		switch ev.Kind {
+		case EventProbeOK:
+			ds.Ping = probeStatus(ev, true, "")
+		case EventTimeout, EventProbeFailed:
+			ds.Ping = probeStatus(ev, false, "")
+		}
+	case "rtsp":
+		switch {
+		case ev.Kind == EventProbeOK:
+			ds.RTSP = probeStatus(ev, true, "pts "+attrString(ev, "pts"))
+		case ev.Message == "connected":
+			ds.RTSP = probeStatus(ev, true, "")
+		case ev.Message == "failed to connect" || ev.Message == "playback ended":
+			ds.RTSP = probeStatus(ev, false, "")
+		}
+	case "cgi":
+		switch ev.Kind {
+		case EventProbeOK:
+			ds.CGI = probeStatus(ev, true, attrString(ev, "url")+" "+attrString(ev, "status"))
+		case EventTimeout, EventProbeFailed:
+			ds.CGI = probeStatus(ev, false, attrString(ev, "url"))
+		}
+	case "tcp":
+		var status *ProbeStatus
+		switch ev.Kind {
+		case EventProbeOK:
+			status = probeStatus(ev, true, attrString(ev, "banner"))
+		case EventTimeout, EventProbeFailed:
+			status = probeStatus(ev, false, "")
+		default:
+			return
+		}
+		if ds.TCP == nil {
+			ds.TCP = map[string]*ProbeStatus{}
+		}
+		ds.TCP[attrString(ev, "port")] = status
+	case "dns":
+		if ev.Message != "changed address" {
+			return
+		}
+		delete(s.byIP, ds.IP)
+		ds.IP = attrString(ev, "ip")
+		s.byIP[ds.IP] = ds.Name
+	case "arp":
+		if ev.Kind != EventStateChange {
+			return
+		}
+		if changeLabel(ev.Message) == "removed" {
+			ds.ARP = nil
+			return
+		}
+		ds.ARP = &ARPStatus{
+			MAC:     attrString(ev, "mac"),
+			State:   attrString(ev, "state"),
+			Iface:   attrString(ev, "iface"),
+			Updated: ev.When,
+		}
+	case "syslog":
+		content := attrString(ev, "content")
+		if len(content) == 0 {
+			content = attrString(ev, "message")
+		}
+		ds.Syslog = append(ds.Syslog, SyslogLine{
+			When:     ev.When,
+			Severity: attrString(ev, "severity"),
+			Content:  content,
+		})
+		if len(ds.Syslog) > maxSyslogLines {
+			ds.Syslog = ds.Syslog[len(ds.Syslog)-maxSyslogLines:]
+		}
+	}
+}
+
+func copyStatus(ds *DeviceStatus) DeviceStatus {
+	c := *ds
+	c.Syslog = append([]SyslogLine(nil), ds.Syslog...)
+	c.TCP = maps.Clone(ds.TCP)
+	return c
+}
+
+// Devices returns the status of all devices sorted by name.
+func (s *StatusModel) Devices() []DeviceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]DeviceStatus, 0, len(s.devices))
+	for _, ds := range s.devices {
+		res = append(res, copyStatus(ds))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Device returns the status of the named device.
+func (s *StatusModel) Device(name string) (DeviceStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ds, ok := s.devices[name]
+	if !ok {
+		return DeviceStatus{}, false
+	}
+	return copyStatus(ds), true
+}
+
+func (s *StatusModel) subscribe() chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan Event, 100)
+	s.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (s *StatusModel) unsubscribe(ch chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, ch)
+}
+
+// Dashboard serves an HTML dashboard, a JSON API and a Server-Sent
+// Events stream for a StatusModel:
+//
+//	/                    the HTML dashboard
+//	/api/devices         the status of all devices
+//	/api/devices/{name}  the status of the named device
+//	/api/events          a stream of all events
+type Dashboard struct {
+	status *StatusModel
+	mux    *http.ServeMux
+}
+
+func NewDashboard(status *StatusModel) *Dashboard {
+	d := &Dashboard{status: status, mux: http.NewServeMux()}
+	d.mux.HandleFunc("GET /{$}", d.index)
+	d.mux.HandleFunc("GET /api/devices", d.devices)
+	d.mux.HandleFunc("GET /api/devices/{name}", d.device)
+	d.mux.HandleFunc("GET /api/events", d.events)
+	return d
+}
+
+// ServeHTTP implements http.Handler.
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (d *Dashboard) devices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, d.status.Devices())
+}
+
+func (d *Dashboard) device(w http.ResponseWriter, r *http.Request) {
+	ds, ok := d.status.Device(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, ds)
+}
+
+func (d *Dashboard) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := d.status.subscribe()
+	defer d.status.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			buf, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Module, buf)
+			flusher.Flush()
+		}
+	}
+}
+
+func (d *Dashboard) index(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, dashboardHTML)
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>netmon</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; font-size: 90%; }
+th { background: #eee; }
+.up { background: #d4f7d4; }
+.down { background: #f7d4d4; }
+.none { color: #999; }
+pre { margin: 0; max-height: 8em; overflow: auto; font-size: 85%; }
+#log { height: 12em; overflow: auto; border: 1px solid #ccc; font-family: monospace; font-size: 85%; }
+</style>
+</head>
+<body>
+<h1>netmon</h1>
+<table>
+<thead><tr><th>Device</th><th>IP</th><th>Ping</th><th>RTSP</th><th>CGI</th><th>TCP</th><th>ARP</th><th>Syslog</th></tr></thead>
+<tbody id="devices"></tbody>
+</table>
+<h2>Events</h2>
+<div id="log"></div>
+<script>
+function esc(s) {
+  return String(s === undefined ? "" : s).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"})[c]);
+}
+function probe(p) {
+  if (!p) { return '<td class="none">-</td>'; }
+  let txt = esc(p.msg);
+  if (p.latency_ms) { txt += " " + p.latency_ms.toFixed(1) + "ms"; }
+  if (p.detail) { txt += "<br>" + esc(p.detail); }
+  if (p.err) { txt += "<br>" + esc(p.err); }
+  txt += "<br><small>" + esc(new Date(p.updated).toLocaleTimeString()) + "</small>";
+  return '<td class="' + (p.up ? "up" : "down") + '">' + txt + "</td>";
+}
+function tcp(ports) {
+  if (!ports) { return '<td class="none">-</td>'; }
+  const keys = Object.keys(ports).sort((a, b) => a - b);
+  const up = keys.every(k => ports[k].up);
+  return '<td class="' + (up ? "up" : "down") + '">' + keys.map(k => {
+    const p = ports[k];
+    let txt = esc(k) + ": " + esc(p.msg);
+    if (p.latency_ms) { txt += " " + p.latency_ms.toFixed(1) + "ms"; }
+    return txt;
+  }).join("<br>") + "</td>";
+}
+function arp(a) {
+  if (!a) { return '<td class="none">-</td>'; }
+  return "<td>" + esc(a.mac) + " " + esc(a.state) + "<br>" + esc(a.iface) + "</td>";
+}
+function syslog(lines) {
+  if (!lines) { return '<td class="none">-</td>'; }
+  return "<td><pre>" + lines.map(l => esc(l.content)).join("\n") + "</pre></td>";
+}
+function refresh() {
+  fetch("api/devices").then(r => r.json()).then(devices => {
+    document.getElementById("devices").innerHTML = devices.map(d =>
+      "<tr><td>" + esc(d.name) + "</td><td>" + esc(d.ip) + "</td>" +
+      probe(d.ping) + probe(d.rtsp) + probe(d.cgi) + tcp(d.tcp) + arp(d.arp) + syslog(d.syslog) + "</tr>").join("");
+  });
+}
+let pending = false;
+function schedule() {
+  if (pending) { return; }
+  pending = true;
+  setTimeout(() => { pending = false; refresh(); }, 500);
+}
+const log = document.getElementById("log");
+const source = new EventSource("api/events");
+["ping", "rtsp", "cgi", "tcp", "dns", "tls", "arp", "route", "syslog", "alert"].forEach(mod =>
+  source.addEventListener(mod, e => {
+    const ev = JSON.parse(e.data);
+    const line = document.createElement("div");
+    line.textContent = ev.when + " " + ev.level + " " + ev.mod + " " + (ev.device || "") + " " + ev.msg + (ev.err ? ": " + ev.err : "");
+    log.prepend(line);
+    while (log.childNodes.length > 200) { log.removeChild(log.lastChild); }
+    schedule();
+  }));
+refresh();
+setInterval(refresh, 30000);
+</script>
+</body>
+</html>
+`
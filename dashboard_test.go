@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	ctx := context.Background()
+	status := NewStatusModel([]Device{{Name: "cam1", IP: "10.0.0.1"}, {Name: "cam2", IP: "10.0.0.2"}})
+	bus := NewEventBus()
+	bus.Subscribe(status.HandleEvent)
+	srv := httptest.NewServer(NewDashboard(status))
+	defer srv.Close()
+
+	bus.Publish(ctx, Event{Device: "cam1", Module: "ping", Kind: EventProbeOK, Message: "ok", Latency: 2 * time.Millisecond})
+	bus.Publish(ctx, Event{Device: "cam2", Module: "rtsp", Kind: EventProbeFailed, Message: "failed to connect", Err: errors.New("refused")})
+	bus.Publish(ctx, Event{Module: "syslog", Message: "received syslog", Attrs: attrs("client", "10.0.0.2:514", "content", "hello")})
+
+	get := func(path string, v any) int {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if v != nil && res.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.StatusCode
+	}
+
+	var devices []DeviceStatus
+	get("/api/devices", &devices)
+	if got, want := len(devices), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if ping := devices[0].Ping; ping == nil || !ping.Up || ping.LatencyMS != 2 {
+		t.Errorf("unexpected ping status: %+v", ping)
+	}
+
+	var device DeviceStatus
+	get("/api/devices/cam2", &device)
+	if rtsp := device.RTSP; rtsp == nil || rtsp.Up || rtsp.Err != "refused" {
+		t.Errorf("unexpected rtsp status: %+v", rtsp)
+	}
+	if got, want := len(device.Syslog), 1; got != want || device.Syslog[0].Content != "hello" {
+		t.Errorf("unexpected syslog: %+v", device.Syslog)
+	}
+	if got, want := get("/api/devices/unknown", nil), http.StatusNotFound; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	res, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := res.Header.Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	res, err = http.Get(srv.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	// Wait for the subscription to be established.
+	for {
+		status.mu.Lock()
+		n := len(status.subscribers)
+		status.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	bus.Publish(ctx, Event{Device: "cam1", Module: "ping", Kind: EventTimeout, Message: "timeout"})
+	sc := bufio.NewScanner(res.Body)
+	var lines []string
+	for sc.Scan() && len(lines) < 2 {
+		lines = append(lines, sc.Text())
+	}
+	if got, want := lines[0], "event: ping"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.HasPrefix(lines[1], "data: ") || !strings.Contains(lines[1], `"msg":"timeout"`) {
+		t.Errorf("unexpected data: %v", lines[1])
+	}
+}
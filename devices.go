@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"cloudeng.io/sync/errgroup"
 )
@@ -13,12 +16,45 @@ type DeviceMonitorFlags struct {
 	ConfigFlags
 	LogFile string `subcmd:"log-file,netmon.slog,the file to write structured logs to"`
 	Ping    bool   `subcmd:"ping,false,enable pinging of devices"`
+	Path    bool   `subcmd:"path,false,enable tracing of the network path to devices"`
 	ARP     bool   `subcmd:"arp,false,enable arp monitoring"`
 	RTSP    bool   `subcmd:"rtsp,false,enable rtsp monitoring"`
 	Routing bool   `subcmd:"routing,false,enable routing monitoring"`
 	Syslog  bool   `subcmd:"syslog,false,enable syslog server"`
 	CGI     bool   `subcmd:"cgi,false,enable cgi invocations"`
+	Actions bool   `subcmd:"cgi-actions,false,run the cgi actions that specify an interval on that schedule"`
+	TCP     bool   `subcmd:"tcp,false,enable tcp connect probes"`
+	DNS     bool   `subcmd:"dns,false,enable dns queries and re-resolution of device hostnames"`
+	TLS     bool   `subcmd:"tls,false,enable tls certificate monitoring"`
 	DryRun  bool   `subcmd:"dry-run,false,show only configuration information"`
+
+	LogLevel   string `subcmd:"log-level,,minimum level to log and optional per module overrides, eg. warn or info,rtsp=debug,ping=warn, overrides the logging config"`
+	LogFormat  string `subcmd:"log-format,,format of the log file, json or text, overrides the logging config"`
+	LogConsole bool   `subcmd:"log-console,false,also log to stdout in text format"`
+
+	LogMaxSize  int           `subcmd:"log-max-size,0,rotate the log file when it would exceed this many megabytes, 0 to disable"`
+	LogDaily    bool          `subcmd:"log-daily,false,rotate the log file daily"`
+	LogCompress bool          `subcmd:"log-compress,false,gzip compress rotated log files"`
+	LogMaxAge   time.Duration `subcmd:"log-max-age,0,delete rotated log files older than this, 0 to disable"`
+	LogMaxTotal int           `subcmd:"log-max-total,0,delete the oldest rotated log files when their total size exceeds this many megabytes, 0 to disable"`
+
+	MetricsAddr string `subcmd:"metrics-addr,,address to serve prometheus metrics on, eg. :9100"`
+	HTTPAddr    string `subcmd:"http,,address to serve the status dashboard and api on, eg. :8080"`
+
+	HistoryDir             string        `subcmd:"history-dir,,directory to record probe history in, history is not recorded if not specified"`
+	HistoryRawRetention    time.Duration `subcmd:"history-raw-retention,24h,how long to retain raw probe history for"`
+	HistoryRollupRetention time.Duration `subcmd:"history-rollup-retention,720h,how long to retain one minute rollups of probe history for"`
+}
+
+func (fv *DeviceMonitorFlags) logRotation() LogRotation {
+	const mb = 1024 * 1024
+	return LogRotation{
+		MaxSize:  int64(fv.LogMaxSize) * mb,
+		Daily:    fv.LogDaily,
+		Compress: fv.LogCompress,
+		MaxAge:   fv.LogMaxAge,
+		MaxTotal: int64(fv.LogMaxTotal) * mb,
+	}
 }
 
 type Devices struct {
@@ -31,50 +67,95 @@ func (d *Devices) Monitor(ctx context.Context, flags any, args []string) error {
 	if err != nil {
 		return err
 	}
-	var l *Logger
-	if !fv.DryRun {
-		lf, err := newLogfile(fv.LogFile)
+	l, closeLogs, err := d.logger(ctx, fv, config)
+	if err != nil {
+		return err
+	}
+	defer closeLogs()
+	events := NewEventBus()
+	events.Subscribe(l.HandleEvent)
+
+	monitors := []func() error{}
+	if len(fv.HistoryDir) > 0 && !fv.DryRun {
+		store, err := OpenHistoryStore(fv.HistoryDir, fv.HistoryRawRetention, fv.HistoryRollupRetention)
 		if err != nil {
 			return err
 		}
-		defer lf.Close()
-		l, err = NewLogger(lf, nil)
+		events.Subscribe(store.HandleEvent)
+		monitors = append(monitors, func() error {
+			return store.Run(ctx)
+		})
+	}
+	for addr, mux := range d.httpServers(fv, config, events) {
+		monitors = append(monitors, func() error {
+			return runHTTPServer(ctx, addr, mux)
+		})
+	}
+	if config.Alerts != nil {
+		engine, err := d.alertEngine(fv.DryRun, config, events)
 		if err != nil {
 			return err
 		}
-	} else {
-		l, _ = NewLogger(os.Stdout, nil)
+		if engine != nil {
+			events.Subscribe(engine.HandleEvent)
+			monitors = append(monitors, func() error {
+				return engine.Run(ctx)
+			})
+		}
 	}
-
-	monitors := []func() error{}
+	// Hostnames are always re-resolved since all of the monitors use
+	// the current address of a device.
+	monitors = append(monitors, func() error {
+		return d.hostnameResolver(ctx, fv.DryRun, config, events)
+	})
 	if fv.Ping {
 		monitors = append(monitors, func() error {
-			return d.pingMonitor(ctx, fv.DryRun, config, l)
+			return d.pingMonitor(ctx, fv.DryRun, config, events)
+		})
+	}
+	if fv.Path {
+		monitors = append(monitors, func() error {
+			return d.pathMonitor(ctx, fv.DryRun, config, events)
 		})
 	}
 	if fv.ARP {
 		monitors = append(monitors, func() error {
-			return d.arpMonitor(ctx, fv.DryRun, config, l)
+			return d.arpMonitor(ctx, fv.DryRun, config, events)
 		})
 	}
 	if fv.RTSP {
 		monitors = append(monitors, func() error {
-			return d.rtspMonitor(ctx, fv.DryRun, config, l)
+			return d.rtspMonitor(ctx, fv.DryRun, config, events)
 		})
 	}
 	if fv.Routing {
 		monitors = append(monitors, func() error {
-			return d.routeMonitor(ctx, fv.DryRun, config, l)
+			return d.routeMonitor(ctx, fv.DryRun, config, events)
 		})
 	}
 	if fv.Syslog {
 		monitors = append(monitors, func() error {
-			return d.syslogMonitor(ctx, fv.DryRun, config, l)
+			return d.syslogMonitor(ctx, fv.DryRun, config, events)
 		})
 	}
-	if fv.CGI {
+	if fv.CGI || fv.Actions {
 		monitors = append(monitors, func() error {
-			return d.cgiMonitor(ctx, fv.DryRun, config, l)
+			return d.cgiMonitor(ctx, fv, config, events)
+		})
+	}
+	if fv.TCP {
+		monitors = append(monitors, func() error {
+			return d.tcpMonitor(ctx, fv.DryRun, config, events)
+		})
+	}
+	if fv.DNS {
+		monitors = append(monitors, func() error {
+			return d.dnsMonitor(ctx, fv.DryRun, config, events)
+		})
+	}
+	if fv.TLS {
+		monitors = append(monitors, func() error {
+			return d.tlsMonitor(ctx, fv.DryRun, config, events)
 		})
 	}
 	var g errgroup.T
@@ -84,7 +165,124 @@ func (d *Devices) Monitor(ctx context.Context, flags any, args []string) error {
 	return g.Wait()
 }
 
-func (d *Devices) pingMonitor(ctx context.Context, dryRun bool, config *Config, l *Logger) error {
+// logger creates a Logger for the log file, the console and any sinks
+// specified in the logging config. The returned function closes all
+// of the files and connections opened for the sinks.
+func (d *Devices) logger(ctx context.Context, fv *DeviceMonitorFlags, config *Config) (*Logger, func(), error) {
+	var opts LoggingOption
+	if config.Logging != nil {
+		opts = *config.Logging
+	}
+	if len(fv.LogLevel) > 0 {
+		opts.Level = fv.LogLevel
+	}
+	if len(fv.LogFormat) > 0 {
+		opts.Format = fv.LogFormat
+	}
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	levels, err := ParseLogLevels(opts.Level)
+	if err != nil {
+		return nil, closeAll, err
+	}
+	if fv.DryRun {
+		h, err := NewLogHandler(os.Stdout, opts.Format, levels)
+		if err != nil {
+			return nil, closeAll, err
+		}
+		for i, s := range opts.Sinks {
+			fmt.Printf("log sink %d: %s\n", i, s)
+		}
+		return NewLogger(LogSink{Handler: h, Levels: levels}), closeAll, nil
+	}
+	lf, err := newLogfile(fv.LogFile, fv.logRotation())
+	if err != nil {
+		return nil, closeAll, err
+	}
+	closers = append(closers, lf)
+	if rf, ok := lf.(*rotatingFile); ok {
+		go rf.reopenOnHangup(ctx)
+	}
+	h, err := NewLogHandler(lf, opts.Format, levels)
+	if err != nil {
+		return nil, closeAll, err
+	}
+	sinks := []LogSink{{Handler: h, Levels: levels}}
+	if fv.LogConsole {
+		h, _ := NewLogHandler(os.Stdout, "text", levels)
+		sinks = append(sinks, LogSink{Handler: h, Levels: levels})
+	}
+	for i, cfg := range opts.Sinks {
+		sink, err := newLogSink(ctx, cfg, fv.logRotation(), &closers)
+		if err != nil {
+			return nil, closeAll, fmt.Errorf("log sink %d: %w", i, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return NewLogger(sinks...), closeAll, nil
+}
+
+// httpServers returns the handlers to be served for each of the
+// requested HTTP addresses, the metrics and dashboard may share
+// the same address.
+func (d *Devices) httpServers(fv *DeviceMonitorFlags, config *Config, events *EventBus) map[string]*http.ServeMux {
+	servers := map[string]*http.ServeMux{}
+	mux := func(addr string) *http.ServeMux {
+		if _, ok := servers[addr]; !ok {
+			servers[addr] = http.NewServeMux()
+		}
+		return servers[addr]
+	}
+	if len(fv.MetricsAddr) > 0 {
+		if fv.DryRun {
+			fmt.Printf("prometheus metrics on %s/metrics\n", fv.MetricsAddr)
+		} else {
+			metrics := NewMetrics(config.Devices)
+			events.Subscribe(metrics.HandleEvent)
+			mux(fv.MetricsAddr).Handle("/metrics", metrics)
+		}
+	}
+	if len(fv.HTTPAddr) > 0 {
+		if fv.DryRun {
+			fmt.Printf("status dashboard on %s/\n", fv.HTTPAddr)
+		} else {
+			status := NewStatusModel(config.Devices)
+			events.Subscribe(status.HandleEvent)
+			mux(fv.HTTPAddr).Handle("/", NewDashboard(status))
+		}
+	}
+	return servers
+}
+
+func (d *Devices) alertEngine(dryRun bool, config *Config, events *EventBus) (*AlertEngine, error) {
+	rules, err := config.AlertRules()
+	if err != nil {
+		return nil, err
+	}
+	notifiers, err := config.Notifiers()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		d.dryRunLock.Lock()
+		fmt.Printf("alerts: %d rules, %d notifiers\n", len(rules), len(notifiers))
+		for _, r := range rules {
+			fmt.Printf("alert %s: module %s, count %d, window %s\n", r.Name, r.Module, r.Count, r.Window)
+		}
+		for _, n := range notifiers {
+			fmt.Printf("notifier %s\n", n.Name())
+		}
+		d.dryRunLock.Unlock()
+		return nil, nil
+	}
+	return NewAlertEngine(events, rules, notifiers, config.Alerts.RepeatInterval, config.Alerts.MaxPerHour), nil
+}
+
+func (d *Devices) pingMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
 	devs, err := config.ICMPDevices()
 	if err != nil {
 		return err
@@ -96,16 +294,44 @@ func (d *Devices) pingMonitor(ctx context.Context, dryRun bool, config *Config,
 		d.dryRunLock.Lock()
 		fmt.Printf("ping %d devices with interval %s and timeout %s\n", len(devs), config.Options.ICMP.Interval, config.Options.ICMP.Timeout)
 		for _, dev := range devs {
-			fmt.Printf("ping %s\n", dev.ipAddr)
+			fmt.Printf("ping %s, stats over %d probes summarized every %s\n", dev.ipAddr, dev.StatsWindow, dev.SummaryInterval)
+			fmt.Printf("ping %s, %d request(s) per round spaced %s, payload %d bytes", dev.ipAddr, dev.Count, dev.Spacing, len(icmpPayload(dev.PayloadSize)))
+			if dev.TTL > 0 {
+				fmt.Printf(", ttl %d", dev.TTL)
+			}
+			if dev.DontFragment {
+				fmt.Printf(", don't fragment")
+			}
+			fmt.Println()
 		}
 		d.dryRunLock.Unlock()
 		return nil
 	}
-	monitor := NewICMPMonitor(l)
+	monitor := NewICMPMonitor(events)
 	return monitor.MonitorAll(ctx, devs)
 }
 
-func (d *Devices) arpMonitor(ctx context.Context, dryRun bool, config *Config, l *Logger) error {
+func (d *Devices) pathMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
+	devs, err := config.PathDevices()
+	if err != nil {
+		return err
+	}
+	if len(devs) == 0 {
+		return nil
+	}
+	if dryRun {
+		d.dryRunLock.Lock()
+		for _, dev := range devs {
+			fmt.Printf("trace path to %s every %s, %d probes per hop up to %d hops, timeout %s, latency step %s\n", dev.ipAddr, dev.Interval, dev.Probes, dev.MaxHops, dev.Timeout, dev.LatencyStep)
+		}
+		d.dryRunLock.Unlock()
+		return nil
+	}
+	monitor := NewPathMonitor(events)
+	return monitor.MonitorAll(ctx, devs)
+}
+
+func (d *Devices) arpMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
 	devs, err := config.ARPDevices()
 	if err != nil {
 		return err
@@ -122,11 +348,11 @@ func (d *Devices) arpMonitor(ctx context.Context, dryRun bool, config *Config, l
 		d.dryRunLock.Unlock()
 		return nil
 	}
-	monitor := NewARPMonitor(l, config.Options.ARP.Interval)
+	monitor := NewARPMonitor(events, config.Options.ARP.Interval)
 	return monitor.MonitorAll(ctx, devs)
 }
 
-func (d *Devices) rtspMonitor(ctx context.Context, dryRun bool, config *Config, l *Logger) error {
+func (d *Devices) rtspMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
 	devs, err := config.RTSPDevices()
 	if err != nil {
 		return err
@@ -138,16 +364,23 @@ func (d *Devices) rtspMonitor(ctx context.Context, dryRun bool, config *Config,
 		d.dryRunLock.Lock()
 		fmt.Printf("rtsp %d devices with interval %s\n", len(devs), config.Options.RTSP.Interval)
 		for _, dev := range devs {
-			fmt.Printf("rtsp %s\n", dev.ipAddr)
+			switch {
+			case dev.AllTracks && len(dev.Media) > 0:
+				fmt.Printf("rtsp %s all tracks, requires %s\n", dev.ipAddr, dev.Media)
+			case dev.AllTracks:
+				fmt.Printf("rtsp %s all tracks\n", dev.ipAddr)
+			default:
+				fmt.Printf("rtsp %s %s\n", dev.ipAddr, dev.Media)
+			}
 		}
 		d.dryRunLock.Unlock()
 		return nil
 	}
-	monitor := NewRTSPMonitor(l)
+	monitor := NewRTSPMonitor(events)
 	return monitor.MonitorAll(ctx, devs)
 }
 
-func (d *Devices) routeMonitor(ctx context.Context, dryRun bool, config *Config, l *Logger) error {
+func (d *Devices) routeMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
 	devs, err := config.RoutingDevices()
 	if err != nil {
 		return err
@@ -164,37 +397,187 @@ func (d *Devices) routeMonitor(ctx context.Context, dryRun bool, config *Config,
 		d.dryRunLock.Unlock()
 		return nil
 	}
-	monitor := NewRouteMonitor(l, config.Options.Routing.Interval)
+	monitor := NewRouteMonitor(events, config.Options.Routing.Interval)
 	return monitor.MonitorAll(ctx, devs)
 }
 
-func (d *Devices) syslogMonitor(ctx context.Context, dryRun bool, config *Config, l *Logger) error {
+func (d *Devices) syslogMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
+	listeners, err := config.SyslogListeners()
+	if err != nil {
+		return err
+	}
+	devices, err := config.SyslogDevices()
+	if err != nil {
+		return err
+	}
 	if dryRun {
 		d.dryRunLock.Lock()
-		fmt.Printf("syslog server\n")
+		fmt.Printf("syslog server %d listeners\n", len(listeners))
+		for _, l := range listeners {
+			fmt.Printf("%s %s, format %s\n", l.Network, l.Address, l.Format)
+		}
+		if opts := config.Options.Syslog; opts != nil {
+			if len(opts.ArchiveDir) > 0 {
+				fmt.Printf("archive: %s\n", opts.ArchiveDir)
+			}
+			for _, r := range opts.Relays {
+				fmt.Printf("relay: %s %s\n", r.Network, r.Address)
+			}
+		}
+		for _, dev := range devices {
+			if len(dev.Hostnames) > 0 || len(dev.Rules) > 0 {
+				fmt.Printf("name: %s (%s), hostnames: %v, %d rules\n", dev.Name, dev.IP, dev.Hostnames, len(dev.Rules))
+			}
+		}
 		d.dryRunLock.Unlock()
 		return nil
 	}
-	s := newSyslogServer(l)
-	return s.run(ctx)
+	s := newSyslogServer(events, devices)
+	if opts := config.Options.Syslog; opts != nil {
+		if err := s.forwardTo(opts.ArchiveDir, opts.Relays); err != nil {
+			return err
+		}
+	}
+	return s.run(ctx, listeners)
 }
 
-func (d *Devices) cgiMonitor(ctx context.Context, dryRun bool, config *Config, l *Logger) error {
-	cgiInvocations, err := config.CGIInvocations()
-	if err != nil {
-		return err
+func (d *Devices) cgiMonitor(ctx context.Context, fv *DeviceMonitorFlags, config *Config, events *EventBus) error {
+	var cgiInvocations []CGIInvocation
+	if fv.CGI {
+		invocations, err := config.CGIInvocations()
+		if err != nil {
+			return err
+		}
+		cgiInvocations = invocations
+	}
+	if fv.Actions {
+		actions, err := config.CGIActions()
+		if err != nil {
+			return err
+		}
+		for _, a := range actions {
+			if a.Interval > 0 {
+				cgiInvocations = append(cgiInvocations, a)
+			}
+		}
 	}
 	if len(cgiInvocations) == 0 {
 		return nil
 	}
-	if dryRun {
+	if fv.DryRun {
 		d.dryRunLock.Lock()
 		fmt.Printf("cgi %d devices \n", len(cgiInvocations))
 		for _, inv := range cgiInvocations {
-			fmt.Printf("name: %s (%s), interval %s, timeout %s: %s\n", inv.Name, inv.IPAddr, inv.Interval, inv.Timeout, inv.Path)
+			req, err := inv.request(time.Now())
+			if err != nil {
+				d.dryRunLock.Unlock()
+				return fmt.Errorf("device %q: %v", inv.Name, err)
+			}
+			if len(inv.Action) > 0 {
+				fmt.Printf("action %s: ", inv.Action)
+			}
+			fmt.Printf("name: %s (%s), interval %s, timeout %s, auth %s, redirects %s: %s %s\n", inv.Name, inv.IPAddr, inv.Interval, inv.Timeout, inv.AuthScheme, inv.Redirects, inv.Method, req.safeURL)
+		}
+		d.dryRunLock.Unlock()
+		return nil
+	}
+	return NewCGIMonitor(events).MonitorAll(ctx, cgiInvocations)
+}
+
+func (d *Devices) tcpMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
+	probes, err := config.TCPProbes()
+	if err != nil {
+		return err
+	}
+	if len(probes) == 0 {
+		return nil
+	}
+	if dryRun {
+		d.dryRunLock.Lock()
+		fmt.Printf("tcp %d ports\n", len(probes))
+		for _, p := range probes {
+			fmt.Printf("name: %s (%s), interval %s, timeout %s", p.Name, p, p.Interval, p.Timeout)
+			if p.Banner != nil {
+				fmt.Printf(", banner %q", p.Banner)
+			}
+			fmt.Println()
+		}
+		d.dryRunLock.Unlock()
+		return nil
+	}
+	return NewTCPMonitor(events).MonitorAll(ctx, probes)
+}
+
+func (d *Devices) dnsMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
+	queries, err := config.DNSQueries()
+	if err != nil {
+		return err
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+	if dryRun {
+		d.dryRunLock.Lock()
+		fmt.Printf("dns %d queries\n", len(queries))
+		for _, q := range queries {
+			fmt.Printf("name: %s, %s %s via %s/%s, interval %s, timeout %s", q.Device, q.Name, dnsTypeName(q.Type), q.Server, q.Transport, q.Interval, q.Timeout)
+			if len(q.Expect) > 0 {
+				fmt.Printf(", expect %v", q.Expect)
+			}
+			if len(q.CNAME) > 0 {
+				fmt.Printf(", cname %s", q.CNAME)
+			}
+			if q.MinTTL > 0 {
+				fmt.Printf(", min ttl %s", q.MinTTL)
+			}
+			fmt.Println()
+		}
+		d.dryRunLock.Unlock()
+		return nil
+	}
+	return NewDNSMonitor(events).MonitorAll(ctx, queries)
+}
+
+func (d *Devices) hostnameResolver(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
+	hostnames := config.HostnameDevices()
+	if len(hostnames) == 0 {
+		return nil
+	}
+	if dryRun {
+		d.dryRunLock.Lock()
+		for _, h := range hostnames {
+			addr := "unresolved"
+			if h.ipAddr.IsValid() {
+				addr = h.ipAddr.String()
+			}
+			fmt.Printf("name: %s, hostname %s (%s), resolve interval %s\n", h.Name, h.Hostname, addr, h.Interval)
+		}
+		d.dryRunLock.Unlock()
+		return nil
+	}
+	return NewDNSMonitor(events).ResolveAll(ctx, hostnames)
+}
+
+func (d *Devices) tlsMonitor(ctx context.Context, dryRun bool, config *Config, events *EventBus) error {
+	probes, err := config.TLSProbes()
+	if err != nil {
+		return err
+	}
+	if len(probes) == 0 {
+		return nil
+	}
+	if dryRun {
+		d.dryRunLock.Lock()
+		fmt.Printf("tls %d ports\n", len(probes))
+		for _, p := range probes {
+			fmt.Printf("name: %s (%s:%d), interval %s, timeout %s, warn %v", p.Name, p.IPAddr, p.Port, p.Interval, p.Timeout, p.Thresholds)
+			if len(p.ServerName) > 0 {
+				fmt.Printf(", server name %s", p.ServerName)
+			}
+			fmt.Println()
 		}
 		d.dryRunLock.Unlock()
 		return nil
 	}
-	return NewCGIMonitor(l).MonitorAll(ctx, cgiInvocations)
+	return NewTLSMonitor(events).MonitorAll(ctx, probes)
 }
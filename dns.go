@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"cloudeng.io/sync/errgroup"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxDNSMessage is the size of the buffer used to read UDP responses.
+const maxDNSMessage = 65535
+
+type DNSMonitor struct {
+	events *EventBus
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+func NewDNSMonitor(events *EventBus) *DNSMonitor {
+	return &DNSMonitor{
+		events: events,
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+	}
+}
+
+func (m *DNSMonitor) publish(ctx context.Context, q DNSQuery, ev Event) {
+	ev.Module = "dns"
+	ev.Device = q.Device
+	ev.Attrs = append([]slog.Attr{
+		slog.String("server", q.Server.String()),
+		slog.String("transport", q.Transport),
+		slog.String("name", q.Name),
+		slog.String("type", dnsTypeName(q.Type))}, ev.Attrs...)
+	m.events.Publish(ctx, ev)
+}
+
+func (m *DNSMonitor) MonitorAll(ctx context.Context, queries []DNSQuery) error {
+	var g errgroup.T
+	for _, q := range queries {
+		g.Go(func() error {
+			for {
+				m.query(ctx, q)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(q.Interval):
+				}
+			}
+		})
+	}
+	return g.Wait()
+}
+
+func (m *DNSMonitor) query(ctx context.Context, q DNSQuery) {
+	ctx, cancel := context.WithTimeout(ctx, q.Timeout)
+	defer cancel()
+	start := time.Now()
+	ans, err := exchangeDNS(ctx, q)
+	latency := time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		var nerr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &nerr) && nerr.Timeout() {
+			m.publish(ctx, q, Event{Level: slog.LevelWarn, Kind: EventTimeout, Message: "timeout", Latency: latency, Err: err, Attrs: attrs(slog.Duration("timeout", q.Timeout))})
+			return
+		}
+		m.publish(ctx, q, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: "failed", Latency: latency, Err: err})
+		return
+	}
+	answers := strings.Join(ans.records, ", ")
+	if ans.rcode != dnsmessage.RCodeSuccess {
+		m.publish(ctx, q, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: rcodeName(ans.rcode), Latency: latency})
+		return
+	}
+	if msg, detail := q.check(ans); len(msg) > 0 {
+		m.publish(ctx, q, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: msg, Latency: latency, Attrs: attrs("answers", answers, "expected", detail)})
+		return
+	}
+	m.publish(ctx, q, Event{Level: slog.LevelInfo, Kind: EventProbeOK, Message: "ok", Latency: latency, Attrs: attrs("answers", answers, slog.Duration("ttl", ans.minTTL))})
+}
+
+// dnsUnresolvedInterval is the maximum interval between attempts to
+// resolve a hostname that has yet to be resolved.
+const dnsUnresolvedInterval = time.Minute
+
+// ResolveAll periodically re-resolves the hostnames of the specified
+// devices and reports any change in their address. The address is
+// considered unchanged for as long as it is still one of those returned
+// for the hostname. Hostnames that could not be resolved at startup are
+// resolved immediately and then retried more frequently until they are.
+func (m *DNSMonitor) ResolveAll(ctx context.Context, devs []HostnameDevice) error {
+	var g errgroup.T
+	for _, dev := range devs {
+		g.Go(func() error {
+			addr := dev.ipAddr
+			if !addr.IsValid() {
+				addr = m.resolve(ctx, dev, addr)
+			}
+			for {
+				interval := dev.Interval
+				if !addr.IsValid() {
+					interval = min(interval, dnsUnresolvedInterval)
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(interval):
+				}
+				addr = m.resolve(ctx, dev, addr)
+			}
+		})
+	}
+	return g.Wait()
+}
+
+func (m *DNSMonitor) resolve(ctx context.Context, dev HostnameDevice, addr netip.Addr) netip.Addr {
+	addrs, err := m.lookup(ctx, dev.Hostname)
+	if err != nil || len(addrs) == 0 {
+		if ctx.Err() == nil {
+			m.events.Publish(ctx, Event{Level: slog.LevelWarn, Module: "dns", Device: dev.Name, Kind: EventInfo, Message: "resolve failed", Err: err, Attrs: attrs("hostname", dev.Hostname, "ip", addr)})
+		}
+		return addr
+	}
+	for _, a := range addrs {
+		if a.Unmap() == addr {
+			return addr
+		}
+	}
+	next := preferredAddr(addrs)
+	dev.addr.store(next)
+	details := attrs("hostname", dev.Hostname, "ip", next)
+	if addr.IsValid() {
+		details = append(details, slog.Any("previous", addr))
+	}
+	m.events.Publish(ctx, Event{Level: slog.LevelWarn, Module: "dns", Device: dev.Name, Kind: EventStateChange, Message: "changed address", Attrs: details})
+	return next
+}
+
+// dnsAnswer is the subset of a DNS response that is checked.
+type dnsAnswer struct {
+	rcode   dnsmessage.RCode
+	addrs   []netip.Addr
+	cnames  []string
+	records []string
+	minTTL  time.Duration
+}
+
+// check returns a non-empty message and the expected value if the
+// answer does not meet the query's expectations.
+func (q DNSQuery) check(ans dnsAnswer) (string, string) {
+	if len(ans.records) == 0 {
+		return "no answer", ""
+	}
+	if len(q.Expect) > 0 {
+		got := slices.Clone(ans.addrs)
+		want := slices.Clone(q.Expect)
+		slices.SortFunc(got, netip.Addr.Compare)
+		slices.SortFunc(want, netip.Addr.Compare)
+		if !slices.Equal(slices.Compact(got), slices.Compact(want)) {
+			return "unexpected answer", fmt.Sprintf("%v", want)
+		}
+	}
+	if len(q.CNAME) > 0 && !slices.ContainsFunc(ans.cnames, func(n string) bool {
+		return strings.EqualFold(strings.TrimSuffix(n, "."), strings.TrimSuffix(q.CNAME, "."))
+	}) {
+		return "unexpected cname", q.CNAME
+	}
+	if q.MinTTL > 0 && ans.minTTL < q.MinTTL {
+		return "ttl below minimum", q.MinTTL.String()
+	}
+	return "", ""
+}
+
+// exchangeDNS sends the query to its server and parses the response.
+// UDP queries whose responses are truncated are retried over TCP.
+func exchangeDNS(ctx context.Context, q DNSQuery) (dnsAnswer, error) {
+	id := uint16(rand.IntN(0x10000))
+	msg, err := dnsQueryMessage(id, q.Name, q.Type)
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+	var resp dnsmessage.Message
+	switch q.Transport {
+	case "udp":
+		resp, err = exchangeUDP(ctx, q.Server, id, msg)
+		if err == nil && resp.Truncated {
+			resp, err = exchangeStream(ctx, q, id, msg)
+		}
+	default:
+		resp, err = exchangeStream(ctx, q, id, msg)
+	}
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+	return parseDNSAnswer(resp), nil
+}
+
+func dnsQueryMessage(id uint16, name string, typ dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+func exchangeUDP(ctx context.Context, server netip.AddrPort, id uint16, msg []byte) (dnsmessage.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server.String())
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return dnsmessage.Message{}, err
+		}
+		var resp dnsmessage.Message
+		// Ignore malformed responses and those to other queries.
+		if resp.Unpack(buf[:n]) == nil && resp.ID == id && resp.Response {
+			return resp, nil
+		}
+	}
+}
+
+// exchangeStream sends the query over TCP, or TLS, with the two byte
+// length prefix used for DNS over stream transports.
+func exchangeStream(ctx context.Context, q DNSQuery, id uint16, msg []byte) (dnsmessage.Message, error) {
+	var conn net.Conn
+	var err error
+	if q.Transport == "tls" {
+		d := tls.Dialer{Config: &tls.Config{ServerName: q.TLSName}}
+		conn, err = d.DialContext(ctx, "tcp", q.Server.String())
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", q.Server.String())
+	}
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf); err != nil {
+		return resp, err
+	}
+	if resp.ID != id {
+		return resp, fmt.Errorf("response id %v does not match query id %v", resp.ID, id)
+	}
+	return resp, nil
+}
+
+func parseDNSAnswer(resp dnsmessage.Message) dnsAnswer {
+	ans := dnsAnswer{rcode: resp.RCode}
+	for i, rr := range resp.Answers {
+		ttl := time.Duration(rr.Header.TTL) * time.Second
+		if i == 0 || ttl < ans.minTTL {
+			ans.minTTL = ttl
+		}
+		var rec string
+		switch b := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addr := netip.AddrFrom4(b.A)
+			ans.addrs = append(ans.addrs, addr)
+			rec = addr.String()
+		case *dnsmessage.AAAAResource:
+			addr := netip.AddrFrom16(b.AAAA)
+			ans.addrs = append(ans.addrs, addr)
+			rec = addr.String()
+		case *dnsmessage.CNAMEResource:
+			ans.cnames = append(ans.cnames, b.CNAME.String())
+			rec = "CNAME " + b.CNAME.String()
+		case *dnsmessage.MXResource:
+			rec = fmt.Sprintf("MX %v %v", b.Pref, b.MX)
+		case *dnsmessage.NSResource:
+			rec = "NS " + b.NS.String()
+		case *dnsmessage.PTRResource:
+			rec = "PTR " + b.PTR.String()
+		case *dnsmessage.SRVResource:
+			rec = fmt.Sprintf("SRV %v %v %v %v", b.Priority, b.Weight, b.Port, b.Target)
+		case *dnsmessage.TXTResource:
+			rec = "TXT " + strings.Join(b.TXT, "")
+		case *dnsmessage.SOAResource:
+			rec = fmt.Sprintf("SOA %v %v %v", b.NS, b.MBox, b.Serial)
+		default:
+			rec = rr.Header.Type.String()
+		}
+		ans.records = append(ans.records, rec)
+	}
+	return ans
+}
+
+func rcodeName(rc dnsmessage.RCode) string {
+	switch rc {
+	case dnsmessage.RCodeNameError:
+		return "nxdomain"
+	case dnsmessage.RCodeServerFailure:
+		return "servfail"
+	case dnsmessage.RCodeRefused:
+		return "refused"
+	case dnsmessage.RCodeFormatError:
+		return "formerr"
+	case dnsmessage.RCodeNotImplemented:
+		return "notimp"
+	}
+	return fmt.Sprintf("rcode %d", rc)
+}
+
+func dnsTypeName(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
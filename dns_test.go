@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTestResponse returns the response to a query for the test server,
+// or nil if the query should not be answered.
+func dnsTestResponse(t *testing.T, query []byte, tcp bool) []byte {
+	var req dnsmessage.Message
+	if err := req.Unpack(query); err != nil {
+		t.Errorf("failed to unpack query: %v", err)
+		return nil
+	}
+	q := req.Questions[0]
+	hdr := dnsmessage.Header{ID: req.ID, Response: true, RecursionAvailable: true}
+	a := func(ttl uint32, ip string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()},
+		}
+	}
+	var answers []dnsmessage.Resource
+	switch q.Name.String() {
+	case "ok.test.":
+		answers = append(answers, a(300, "10.0.0.1"), a(300, "10.0.0.2"))
+	case "alias.test.":
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("target.test.")},
+		}, a(30, "10.0.0.3"))
+	case "missing.test.":
+		hdr.RCode = dnsmessage.RCodeNameError
+	case "broken.test.":
+		hdr.RCode = dnsmessage.RCodeServerFailure
+	case "big.test.":
+		if !tcp {
+			hdr.Truncated = true
+			break
+		}
+		answers = append(answers, a(60, "10.0.0.9"))
+	default:
+		return nil
+	}
+	msg := dnsmessage.Message{Header: hdr, Questions: req.Questions, Answers: answers}
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Errorf("failed to pack response: %v", err)
+	}
+	return buf
+}
+
+// dnsTestServer starts a DNS server listening on the same UDP and TCP
+// port on localhost.
+func dnsTestServer(t *testing.T) netip.AddrPort {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	addr := udp.LocalAddr().(*net.UDPAddr).AddrPort()
+	tcp, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, peer, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := dnsTestResponse(t, buf[:n], false); resp != nil {
+				udp.WriteTo(resp, peer)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var size [2]byte
+				if _, err := io.ReadFull(conn, size[:]); err != nil {
+					return
+				}
+				buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if resp := dnsTestResponse(t, buf, true); resp != nil {
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+	return addr
+}
+
+func TestDNSQuery(t *testing.T) {
+	ctx := context.Background()
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	m := NewDNSMonitor(bus)
+	server := dnsTestServer(t)
+
+	addrs := func(s ...string) []netip.Addr {
+		var r []netip.Addr
+		for _, a := range s {
+			r = append(r, netip.MustParseAddr(a))
+		}
+		return r
+	}
+	for i, tc := range []struct {
+		query   DNSQuery
+		kind    EventKind
+		msg     string
+		answers string
+	}{
+		{DNSQuery{Name: "ok.test", Expect: addrs("10.0.0.2", "10.0.0.1"), MinTTL: time.Minute}, EventProbeOK, "ok", "10.0.0.1, 10.0.0.2"},
+		{DNSQuery{Name: "ok.test", Transport: "tcp"}, EventProbeOK, "ok", "10.0.0.1, 10.0.0.2"},
+		{DNSQuery{Name: "ok.test", Expect: addrs("10.0.0.1")}, EventProbeFailed, "unexpected answer", "10.0.0.1, 10.0.0.2"},
+		{DNSQuery{Name: "alias.test", CNAME: "target.test"}, EventProbeOK, "ok", "CNAME target.test., 10.0.0.3"},
+		{DNSQuery{Name: "alias.test", CNAME: "other.test"}, EventProbeFailed, "unexpected cname", "CNAME target.test., 10.0.0.3"},
+		{DNSQuery{Name: "alias.test", MinTTL: time.Minute}, EventProbeFailed, "ttl below minimum", "CNAME target.test., 10.0.0.3"},
+		{DNSQuery{Name: "missing.test"}, EventProbeFailed, "nxdomain", ""},
+		{DNSQuery{Name: "broken.test"}, EventProbeFailed, "servfail", ""},
+		{DNSQuery{Name: "big.test"}, EventProbeOK, "ok", "10.0.0.9"},
+		{DNSQuery{Name: "slow.test"}, EventTimeout, "timeout", ""},
+	} {
+		q := tc.query
+		q.Device, q.Server, q.Type, q.Timeout = "resolver", server, dnsmessage.TypeA, 100*time.Millisecond
+		if len(q.Transport) == 0 {
+			q.Transport = "udp"
+		}
+		received = nil
+		m.query(ctx, q)
+		if len(received) != 1 {
+			t.Fatalf("%v: got %v events", i, len(received))
+		}
+		ev := received[0]
+		if got, want := ev.Kind, tc.kind; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := ev.Message, tc.msg; got != want {
+			t.Errorf("%v: got %v, want %v: %v", i, got, want, ev.Err)
+		}
+		if got, want := attrString(ev, "answers"), tc.answers; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestDNSResolve(t *testing.T) {
+	ctx := context.Background()
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	m := NewDNSMonitor(bus)
+	var results []netip.Addr
+	m.lookup = func(context.Context, string) ([]netip.Addr, error) {
+		return results, nil
+	}
+	initial := netip.MustParseAddr("10.0.0.1")
+	dev := HostnameDevice{Name: "nas", Hostname: "nas.lan", ipAddr: initial, addr: newSharedAddr(initial)}
+	tcp := TCPProbe{Name: "nas", Port: 445, IPAddr: initial, addr: dev.addr}
+	rtsp := RTSPDevice{Name: "nas", IP: initial.String(), Port: 554, ipAddr: initial, addr: dev.addr, path: "live"}
+	rtsp.setURLs()
+
+	addr := dev.ipAddr
+	var msgs []string
+	for _, r := range [][]string{
+		{"10.0.0.2", "10.0.0.1"}, // still one of the addresses.
+		{"::1", "10.0.0.3"},      // ipv4 is preferred.
+		{"10.0.0.3"},
+		{},
+	} {
+		results = nil
+		for _, a := range r {
+			results = append(results, netip.MustParseAddr(a))
+		}
+		received = nil
+		addr = m.resolve(ctx, dev, addr)
+		for _, ev := range received {
+			msgs = append(msgs, ev.Message+" "+attrString(ev, "ip")+" "+attrString(ev, "previous"))
+		}
+	}
+	if want := []string{"changed address 10.0.0.3 10.0.0.1", "resolve failed 10.0.0.3 "}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %v, want %v", msgs, want)
+	}
+
+	// The device's other monitors use the new address.
+	if got, want := tcp.current().String(), "10.0.0.3:445"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := rtsp.current().SafeURL, "rtsp://:****@10.0.0.3:554/live"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	tcp.addr = nil
+	if got, want := tcp.current().String(), "10.0.0.1:445"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDNSResolveAtStartup(t *testing.T) {
+	// A hostname that cannot be resolved at startup is not an error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := Device{Name: "nas", IP: "nas.lan"}
+	if err := d.resolve(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d.ipAddr.IsValid() || d.hostname != "nas.lan" || d.addr == nil {
+		t.Fatalf("unexpected device: %+v", d)
+	}
+	tcp := TCPProbe{Name: "nas", Port: 445, addr: d.addr}
+	if tcp.current().IPAddr.IsValid() {
+		t.Errorf("unexpected address")
+	}
+
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	m := NewDNSMonitor(bus)
+	m.lookup = func(context.Context, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("10.0.0.1")}, nil
+	}
+	dev := HostnameDevice{Name: d.Name, Hostname: d.hostname, addr: d.addr}
+	if got, want := m.resolve(context.Background(), dev, netip.Addr{}).String(), "10.0.0.1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(received) != 1 || received[0].Message != "changed address" || attrString(received[0], "previous") != "" {
+		t.Errorf("unexpected events: %v", received)
+	}
+	if got, want := tcp.current().String(), "10.0.0.1:445"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestIsHostname(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"nas", true},
+		{"nas.lan.", true},
+		{"camera-1.example.com", true},
+		{"-bad.lan", false},
+		{"bad..lan", false},
+		{"10.0.0.1:80", false},
+		{"", false},
+	} {
+		if got, want := isHostname(tc.name), tc.ok; got != want {
+			t.Errorf("%q: got %v, want %v", tc.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// EventKind classifies the events published by the monitors.
+type EventKind string
+
+const (
+	EventInfo        EventKind = "info"
+	EventProbeOK     EventKind = "ok"
+	EventProbeFailed EventKind = "failed"
+	EventTimeout     EventKind = "timeout"
+	EventStateChange EventKind = "state_change"
+)
+
+// Event represents a single observation made by a monitor. Message is
+// the human readable description used as the log message, Latency is
+// the duration of the probe, if any, and Attrs contains any additional,
+// monitor specific, information.
+type Event struct {
+	When    time.Time
+	Level   slog.Level
+	Device  string
+	Module  logMod
+	Kind    EventKind
+	Message string
+	Latency time.Duration
+	Err     error
+	Attrs   []slog.Attr
+}
+
+// Attr returns the value of the named attribute.
+func (ev Event) Attr(key string) (slog.Value, bool) {
+	for _, a := range ev.Attrs {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	return slog.Value{}, false
+}
+
+// AttrMap returns the event's attributes, latency and error formatted
+// as strings.
+func (ev Event) AttrMap() map[string]string {
+	m := make(map[string]string, len(ev.Attrs)+2)
+	for _, a := range ev.Attrs {
+		m[a.Key] = a.Value.String()
+	}
+	if ev.Latency > 0 {
+		m["took"] = ev.Latency.String()
+	}
+	if ev.Err != nil {
+		m["err"] = ev.Err.Error()
+	}
+	return m
+}
+
+// MarshalJSON implements json.Marshaler, the latency is represented
+// in milliseconds and all attributes as strings.
+func (ev Event) MarshalJSON() ([]byte, error) {
+	v := struct {
+		When      time.Time         `json:"when"`
+		Level     string            `json:"level"`
+		Device    string            `json:"device,omitempty"`
+		Module    logMod            `json:"mod"`
+		Kind      EventKind         `json:"kind"`
+		Message   string            `json:"msg"`
+		LatencyMS float64           `json:"latency_ms,omitempty"`
+		Err       string            `json:"err,omitempty"`
+		Attrs     map[string]string `json:"attrs,omitempty"`
+	}{
+		When:      ev.When,
+		Level:     ev.Level.String(),
+		Device:    ev.Device,
+		Module:    ev.Module,
+		Kind:      ev.Kind,
+		Message:   ev.Message,
+		LatencyMS: float64(ev.Latency) / float64(time.Millisecond),
+	}
+	if ev.Err != nil {
+		v.Err = ev.Err.Error()
+	}
+	if len(ev.Attrs) > 0 {
+		v.Attrs = make(map[string]string, len(ev.Attrs))
+		for _, a := range ev.Attrs {
+			v.Attrs[a.Key] = a.Value.String()
+		}
+	}
+	return json.Marshal(v)
+}
+
+// attrs converts alternating key, value pairs, or slog.Attr values,
+// to a slice of slog.Attr in the same manner as slog.Logger.Log.
+func attrs(args ...any) []slog.Attr {
+	res := make([]slog.Attr, 0, len(args)/2)
+	for len(args) > 0 {
+		switch k := args[0].(type) {
+		case slog.Attr:
+			res = append(res, k)
+			args = args[1:]
+		case string:
+			if len(args) == 1 {
+				res = append(res, slog.String("!BADKEY", k))
+				return res
+			}
+			res = append(res, slog.Any(k, args[1]))
+			args = args[2:]
+		default:
+			res = append(res, slog.Any("!BADKEY", fmt.Sprint(k)))
+			args = args[1:]
+		}
+	}
+	return res
+}
+
+// EventHandler is called for every event published on an EventBus,
+// handlers must not block.
+type EventHandler func(ctx context.Context, ev Event)
+
+// EventBus distributes events from the monitors to all of its
+// subscribers, such as the Logger and the AlertEngine.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers []EventHandler
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+func (b *EventBus) Subscribe(h EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, h)
+}
+
+func (b *EventBus) Publish(ctx context.Context, ev Event) {
+	if ev.When.IsZero() {
+		ev.When = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, h := range b.subscribers {
+		h(ctx, ev)
+	}
+}
+
+// Debug publishes a debugging event.
+func (b *EventBus) Debug(ctx context.Context, module logMod, device, msg string, args ...any) {
+	b.Publish(ctx, Event{Level: slog.LevelDebug, Module: module, Kind: EventInfo, Device: device, Message: msg, Attrs: attrs(args...)})
+}
+
+// Info publishes an informational event.
+func (b *EventBus) Info(ctx context.Context, module logMod, device, msg string, args ...any) {
+	b.Publish(ctx, Event{Level: slog.LevelInfo, Module: module, Kind: EventInfo, Device: device, Message: msg, Attrs: attrs(args...)})
+}
+
+// Warn publishes a warning event.
+func (b *EventBus) Warn(ctx context.Context, module logMod, device, msg string, args ...any) {
+	b.Publish(ctx, Event{Level: slog.LevelWarn, Module: module, Kind: EventInfo, Device: device, Message: msg, Attrs: attrs(args...)})
+}
+
+// Error publishes an error event.
+func (b *EventBus) Error(ctx context.Context, module logMod, device, msg string, args ...any) {
+	b.Publish(ctx, Event{Level: slog.LevelError, Module: module, Kind: EventInfo, Device: device, Message: msg, Attrs: attrs(args...)})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestEventLogging(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	h, _ := NewLogHandler(&out, "json", LogLevels{})
+	l := NewLogger(LogSink{Handler: h})
+	bus := NewEventBus()
+	bus.Subscribe(l.HandleEvent)
+	var received []Event
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+
+	bus.Publish(ctx, Event{
+		Level:   slog.LevelWarn,
+		Device:  "cam1",
+		Module:  "ping",
+		Kind:    EventTimeout,
+		Message: "timeout",
+		Latency: 5 * time.Second,
+		Err:     errors.New("oops"),
+		Attrs:   attrs("seq", 3, slog.Duration("timeout", time.Second)),
+	})
+
+	if got, want := len(received), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if received[0].When.IsZero() {
+		t.Errorf("event time not set")
+	}
+	var rec map[string]any
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]any{
+		"level":   "WARN",
+		"msg":     "timeout",
+		"mod":     "ping",
+		"name":    "cam1",
+		"kind":    "timeout",
+		"seq":     float64(3),
+		"timeout": float64(time.Second),
+		"took":    float64(5 * time.Second),
+		"err":     "oops",
+	} {
+		if got, want := rec[k], v; got != want {
+			t.Errorf("%v: got %v (%T), want %v (%T)", k, got, got, want, want)
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHistoryRawRetention    = 24 * time.Hour
+	DefaultHistoryRollupRetention = 30 * 24 * time.Hour
+
+	historyRawLayout    = "2006-01-02T15"
+	historyRollupLayout = "2006-01-02"
+	historyRollupPeriod = time.Minute
+
+	// Latencies are recorded as counts in exponentially sized buckets,
+	// starting at historyLatencyBase and growing by historyLatencyGrowth,
+	// which allows percentiles to be calculated across raw samples and
+	// rollups to within ~5%.
+	historyLatencyBase   = 100 * time.Microsecond
+	historyLatencyGrowth = 1.05
+)
+
+// historySample is a single probe result as stored in the raw segments.
+type historySample struct {
+	Time    int64  `json:"t"`
+	Device  string `json:"d"`
+	Probe   string `json:"p"`
+	OK      bool   `json:"ok"`
+	Latency int64  `json:"l,omitempty"`
+	Status  int    `json:"s,omitempty"`
+}
+
+// historyRollup summarizes all of the samples for a device and probe
+// within a single rollup period.
+type historyRollup struct {
+	Time      int64       `json:"t"`
+	Device    string      `json:"d"`
+	Probe     string      `json:"p"`
+	Count     int         `json:"n"`
+	OK        int         `json:"ok"`
+	Min       int64       `json:"min,omitempty"`
+	Max       int64       `json:"max,omitempty"`
+	Latencies map[int]int `json:"h,omitempty"`
+}
+
+func latencyBucket(d time.Duration) int {
+	if d <= historyLatencyBase {
+		return 0
+	}
+	return int(math.Ceil(math.Log(float64(d)/float64(historyLatencyBase)) / math.Log(historyLatencyGrowth)))
+}
+
+func bucketLatency(b int) time.Duration {
+	return time.Duration(float64(historyLatencyBase) * math.Pow(historyLatencyGrowth, float64(b)))
+}
+
+// HistoryStore is an EventHandler that records probe results in
+// append-only, hourly, segment files. Segments older than the raw
+// retention period are compacted into daily files of one minute
+// rollups which are in turn deleted after the rollup retention period.
+//
+//	<dir>/raw/2006-01-02T15.jsonl
+//	<dir>/rollup/2006-01-02.jsonl
+type HistoryStore struct {
+	dir             string
+	rawRetention    time.Duration
+	rollupRetention time.Duration
+	samples         chan historySample
+	now             func() time.Time
+	mu              sync.Mutex
+}
+
+func OpenHistoryStore(dir string, rawRetention, rollupRetention time.Duration) (*HistoryStore, error) {
+	if rawRetention == 0 {
+		rawRetention = DefaultHistoryRawRetention
+	}
+	if rollupRetention == 0 {
+		rollupRetention = DefaultHistoryRollupRetention
+	}
+	for _, sub := range []string{"raw", "rollup"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &HistoryStore{
+		dir:             dir,
+		rawRetention:    rawRetention,
+		rollupRetention: rollupRetention,
+		samples:         make(chan historySample, 1000),
+		now:             time.Now,
+	}, nil
+}
+
+// sampleFromEvent converts ping, rtsp, cgi, tcp, tls and dns events into
+// samples, rtsp samples record whether the session is up or down and tcp,
+// tls and dns samples are recorded separately for each port or name, eg.
+// as tcp:22 or dns:example.com.
+func sampleFromEvent(ev Event) (historySample, bool) {
+	s := historySample{
+		Time:   ev.When.UnixNano(),
+		Device: ev.Device,
+		Probe:  string(ev.Module),
+	}
+	if len(ev.Device) == 0 {
+		return s, false
+	}
+	switch ev.Module {
+	case "ping":
+		switch ev.Kind {
+		case EventProbeOK:
+			s.OK, s.Latency = true, int64(ev.Latency)
+		case EventTimeout, EventProbeFailed:
+		default:
+			return s, false
+		}
+	case "rtsp":
+		switch {
+		case ev.Kind == EventProbeOK || ev.Message == "connected":
+			s.OK = true
+		case ev.Message == "failed to connect" || ev.Message == "playback ended":
+		default:
+			return s, false
+		}
+	case "tcp", "tls", "dns":
+		if ev.Module == "dns" {
+			s.Probe = "dns:" + attrString(ev, "name")
+		} else {
+			s.Probe = string(ev.Module) + ":" + attrString(ev, "port")
+		}
+		switch ev.Kind {
+		case EventProbeOK:
+			s.OK, s.Latency = true, int64(ev.Latency)
+		case EventTimeout, EventProbeFailed:
+		default:
+			return s, false
+		}
+	case "cgi":
+		switch ev.Kind {
+		case EventProbeOK:
+			s.Latency = int64(ev.Latency)
+			s.OK = true
+			if v, ok := ev.Attr("status"); ok {
+				s.Status = int(v.Int64())
+				s.OK = s.Status < 400
+			}
+		case EventTimeout, EventProbeFailed:
+		default:
+			return s, false
+		}
+	default:
+		return s, false
+	}
+	return s, true
+}
+
+// HandleEvent implements EventHandler.
+func (h *HistoryStore) HandleEvent(ctx context.Context, ev Event) {
+	s, ok := sampleFromEvent(ev)
+	if !ok {
+		return
+	}
+	select {
+	case h.samples <- s:
+	default:
+	}
+}
+
+// Run writes queued samples to the current segment every second and
+// compacts the store every hour.
+func (h *HistoryStore) Run(ctx context.Context) error {
+	if err := h.Compact(); err != nil {
+		return err
+	}
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	compact := time.NewTicker(time.Hour)
+	defer compact.Stop()
+	var pending []historySample
+	for {
+		select {
+		case <-ctx.Done():
+			if err := h.append(pending); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case s := <-h.samples:
+			pending = append(pending, s)
+		case <-flush.C:
+			if err := h.append(pending); err != nil {
+				return err
+			}
+			pending = pending[:0]
+		case <-compact.C:
+			if err := h.Compact(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func appendJSONLines[T any](filename string, values []T) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	wr := bufio.NewWriter(f)
+	enc := json.NewEncoder(wr)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := wr.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readJSONLines[T any](filename string, fn func(T)) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var v T
+		// Ignore partially written lines.
+		if err := json.Unmarshal(sc.Bytes(), &v); err != nil {
+			continue
+		}
+		fn(v)
+	}
+	return sc.Err()
+}
+
+func (h *HistoryStore) rawFilename(t time.Time) string {
+	return filepath.Join(h.dir, "raw", t.UTC().Format(historyRawLayout)+".jsonl")
+}
+
+func (h *HistoryStore) rollupFilename(t time.Time) string {
+	return filepath.Join(h.dir, "rollup", t.UTC().Format(historyRollupLayout)+".jsonl")
+}
+
+func (h *HistoryStore) append(samples []historySample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	segments := map[string][]historySample{}
+	for _, s := range samples {
+		name := h.rawFilename(time.Unix(0, s.Time))
+		segments[name] = append(segments[name], s)
+	}
+	for name, samples := range segments {
+		if err := appendJSONLines(name, samples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segment represents a segment file and the period it covers.
+type segment struct {
+	filename   string
+	start, end time.Time
+}
+
+func (h *HistoryStore) segments(sub, layout string, period time.Duration) ([]segment, error) {
+	entries, err := os.ReadDir(filepath.Join(h.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+		start, err := time.Parse(layout, name)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{
+			filename: filepath.Join(h.dir, sub, e.Name()),
+			start:    start,
+			end:      start.Add(period),
+		})
+	}
+	return segments, nil
+}
+
+type rollupKey struct {
+	time          int64
+	device, probe string
+}
+
+func rollupSamples(samples []historySample) []historyRollup {
+	rollups := map[rollupKey]*historyRollup{}
+	for _, s := range samples {
+		t := time.Unix(0, s.Time).Truncate(historyRollupPeriod).UnixNano()
+		k := rollupKey{time: t, device: s.Device, probe: s.Probe}
+		r, ok := rollups[k]
+		if !ok {
+			r = &historyRollup{Time: t, Device: s.Device, Probe: s.Probe}
+			rollups[k] = r
+		}
+		r.Count++
+		if !s.OK {
+			continue
+		}
+		r.OK++
+		if s.Latency == 0 {
+			continue
+		}
+		if r.Latencies == nil {
+			r.Latencies = map[int]int{}
+		}
+		r.Latencies[latencyBucket(time.Duration(s.Latency))]++
+		if r.Min == 0 || s.Latency < r.Min {
+			r.Min = s.Latency
+		}
+		r.Max = max(r.Max, s.Latency)
+	}
+	res := make([]historyRollup, 0, len(rollups))
+	for _, r := range rollups {
+		res = append(res, *r)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Time < res[j].Time })
+	return res
+}
+
+// Compact rolls up raw segments that are older than the raw retention
+// period and deletes rollups older than the rollup retention period.
+func (h *HistoryStore) Compact() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	raw, err := h.segments("raw", historyRawLayout, time.Hour)
+	if err != nil {
+		return err
+	}
+	for _, seg := range raw {
+		if seg.end.After(now.Add(-h.rawRetention)) {
+			continue
+		}
+		var samples []historySample
+		if err := readJSONLines(seg.filename, func(s historySample) {
+			samples = append(samples, s)
+		}); err != nil {
+			return err
+		}
+		if err := appendJSONLines(h.rollupFilename(seg.start), rollupSamples(samples)); err != nil {
+			return err
+		}
+		if err := os.Remove(seg.filename); err != nil {
+			return err
+		}
+	}
+	rollups, err := h.segments("rollup", historyRollupLayout, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	for _, seg := range rollups {
+		if seg.end.Before(now.Add(-h.rollupRetention)) {
+			if err := os.Remove(seg.filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type historyPoint struct {
+	time time.Time
+	ok   bool
+}
+
+// ProbeHistory summarizes the recorded history of a single probe of a
+// device.
+type ProbeHistory struct {
+	Probe     string
+	Samples   int
+	OK        int
+	Min, Max  time.Duration
+	latencies map[int]int
+	points    []historyPoint
+}
+
+// Interval represents a period of time during which a probe failed.
+type Interval struct {
+	From, To time.Time
+}
+
+func (p *ProbeHistory) addLatencies(lo, hi time.Duration, buckets map[int]int) {
+	if p.latencies == nil {
+		p.latencies = map[int]int{}
+	}
+	for b, n := range buckets {
+		p.latencies[b] += n
+	}
+	if lo > 0 && (p.Min == 0 || lo < p.Min) {
+		p.Min = lo
+	}
+	p.Max = max(p.Max, hi)
+}
+
+func (p *ProbeHistory) sort() {
+	sort.Slice(p.points, func(i, j int) bool { return p.points[i].time.Before(p.points[j].time) })
+}
+
+// Uptime returns the fraction of the time that the probe succeeded. For
+// rtsp, which records session state changes rather than regular probes,
+// each state is assumed to persist until the next sample, for all other
+// probes it is the fraction of successful samples.
+func (p *ProbeHistory) Uptime() float64 {
+	if p.Samples == 0 {
+		return 0
+	}
+	if p.Probe != "rtsp" || len(p.points) < 2 {
+		return float64(p.OK) / float64(p.Samples)
+	}
+	var up, total time.Duration
+	for i := 1; i < len(p.points); i++ {
+		d := p.points[i].time.Sub(p.points[i-1].time)
+		total += d
+		if p.points[i-1].ok {
+			up += d
+		}
+	}
+	if total == 0 {
+		return float64(p.OK) / float64(p.Samples)
+	}
+	return float64(up) / float64(total)
+}
+
+// Percentile returns the approximate latency at the specified
+// percentile (0-100).
+func (p *ProbeHistory) Percentile(pc float64) time.Duration {
+	buckets := make([]int, 0, len(p.latencies))
+	total := 0
+	for b, n := range p.latencies {
+		buckets = append(buckets, b)
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	sort.Ints(buckets)
+	rank := int(math.Ceil(pc / 100 * float64(total)))
+	seen := 0
+	for _, b := range buckets {
+		seen += p.latencies[b]
+		if seen >= rank {
+			return min(max(bucketLatency(b), p.Min), p.Max)
+		}
+	}
+	return p.Max
+}
+
+// Outages returns the intervals during which the probe was failing.
+func (p *ProbeHistory) Outages() []Interval {
+	var res []Interval
+	var down *Interval
+	for _, pt := range p.points {
+		switch {
+		case !pt.ok && down == nil:
+			down = &Interval{From: pt.time, To: pt.time}
+		case !pt.ok:
+			down.To = pt.time
+		case down != nil:
+			down.To = pt.time
+			res = append(res, *down)
+			down = nil
+		}
+	}
+	if down != nil {
+		res = append(res, *down)
+	}
+	return res
+}
+
+// Query returns the recorded history for device between from and to,
+// keyed by probe.
+func (h *HistoryStore) Query(device string, from, to time.Time) (map[string]*ProbeHistory, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := map[string]*ProbeHistory{}
+	probe := func(name string) *ProbeHistory {
+		p, ok := res[name]
+		if !ok {
+			p = &ProbeHistory{Probe: name}
+			res[name] = p
+		}
+		return p
+	}
+	inRange := func(t time.Time) bool {
+		return !t.Before(from) && t.Before(to)
+	}
+	rollups, err := h.segments("rollup", historyRollupLayout, 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range rollups {
+		if seg.end.Before(from) || !seg.start.Before(to) {
+			continue
+		}
+		err := readJSONLines(seg.filename, func(r historyRollup) {
+			t := time.Unix(0, r.Time)
+			if r.Device != device || !inRange(t) {
+				return
+			}
+			p := probe(r.Probe)
+			p.Samples += r.Count
+			p.OK += r.OK
+			p.addLatencies(time.Duration(r.Min), time.Duration(r.Max), r.Latencies)
+			p.points = append(p.points, historyPoint{time: t, ok: r.OK == r.Count})
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	raw, err := h.segments("raw", historyRawLayout, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range raw {
+		if seg.end.Before(from) || !seg.start.Before(to) {
+			continue
+		}
+		err := readJSONLines(seg.filename, func(s historySample) {
+			t := time.Unix(0, s.Time)
+			if s.Device != device || !inRange(t) {
+				return
+			}
+			p := probe(s.Probe)
+			p.Samples++
+			if s.OK {
+				p.OK++
+				if s.Latency > 0 {
+					l := time.Duration(s.Latency)
+					p.addLatencies(l, l, map[int]int{latencyBucket(l): 1})
+				}
+			}
+			p.points = append(p.points, historyPoint{time: t, ok: s.OK})
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	for _, p := range res {
+		p.sort()
+	}
+	return res, nil
+}
+
+type HistoryFlags struct {
+	Dir   string `subcmd:"history-dir,netmon-history,the directory containing the recorded history"`
+	Since string `subcmd:"since,24h,start of the time range as a duration before now or RFC3339 time"`
+	Until string `subcmd:"until,,end of the time range as a duration before now or RFC3339 time, defaults to now"`
+}
+
+type History struct{}
+
+// parseTimeFlag parses val as either an RFC3339 time or a duration
+// before now.
+func parseTimeFlag(val string, now time.Time) (time.Time, error) {
+	if len(val) == 0 {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time or duration: %q", val)
+	}
+	return now.Add(-d), nil
+}
+
+func (h *History) Summarize(ctx context.Context, flags any, args []string) error {
+	fv := flags.(*HistoryFlags)
+	now := time.Now()
+	from, err := parseTimeFlag(fv.Since, now)
+	if err != nil {
+		return err
+	}
+	to, err := parseTimeFlag(fv.Until, now)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(fv.Dir); err != nil {
+		return err
+	}
+	store := &HistoryStore{dir: fv.Dir}
+	history, err := store.Query(args[0], from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s - %s\n", args[0], from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if len(history) == 0 {
+		fmt.Printf("no history recorded\n")
+		return nil
+	}
+	probes := make([]string, 0, len(history))
+	for p := range history {
+		probes = append(probes, p)
+	}
+	sort.Strings(probes)
+	fmt.Printf("%-6s %8s %9s %10s %10s %10s %10s %10s\n", "probe", "samples", "uptime", "min", "p50", "p95", "p99", "max")
+	for _, name := range probes {
+		p := history[name]
+		fmt.Printf("%-6s %8d %8.3f%% %10s %10s %10s %10s %10s\n", name, p.Samples, p.Uptime()*100,
+			roundLatency(p.Min), roundLatency(p.Percentile(50)), roundLatency(p.Percentile(95)), roundLatency(p.Percentile(99)), roundLatency(p.Max))
+	}
+	for _, name := range probes {
+		outages := history[name].Outages()
+		if len(outages) == 0 {
+			continue
+		}
+		fmt.Printf("%s outages:\n", name)
+		for _, o := range outages {
+			fmt.Printf("  %s - %s (%s)\n", o.From.Format(time.RFC3339), o.To.Format(time.RFC3339), o.To.Sub(o.From).Round(time.Second))
+		}
+	}
+	return nil
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	switch {
+	case d > time.Second:
+		return d.Round(time.Millisecond)
+	case d > time.Millisecond:
+		return d.Round(time.Microsecond)
+	}
+	return d
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenHistoryStore(dir, 24*time.Hour, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 10, 1, 10, 0, 0, 0, time.UTC)
+	var samples []historySample
+	for i := 0; i < 100; i++ {
+		ev := Event{When: start.Add(time.Duration(i) * 5 * time.Second), Device: "cam1", Module: "ping", Kind: EventProbeOK, Latency: time.Duration(i+1) * time.Millisecond}
+		if i >= 90 {
+			ev.Kind = EventTimeout
+		}
+		s, ok := sampleFromEvent(ev)
+		if !ok {
+			t.Fatalf("%v: no sample", i)
+		}
+		samples = append(samples, s)
+	}
+	if err := store.append(samples); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(from, to time.Time, rolledUp bool) {
+		history, err := store.Query("cam1", from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := history["ping"]
+		if p == nil {
+			t.Fatalf("no ping history")
+		}
+		if got, want := p.Samples, 100; got != want {
+			t.Errorf("samples: got %v, want %v", got, want)
+		}
+		if got, want := p.Uptime(), 0.9; got != want {
+			t.Errorf("uptime: got %v, want %v", got, want)
+		}
+		if got, want := p.Min, time.Millisecond; got != want {
+			t.Errorf("min: got %v, want %v", got, want)
+		}
+		if got, want := p.Max, 90*time.Millisecond; got != want {
+			t.Errorf("max: got %v, want %v", got, want)
+		}
+		p50 := p.Percentile(50)
+		if p50 < 43*time.Millisecond || p50 > 48*time.Millisecond {
+			t.Errorf("p50: got %v", p50)
+		}
+		outages := p.Outages()
+		if got, want := len(outages), 1; got != want {
+			t.Fatalf("outages: got %v, want %v", got, want)
+		}
+		outage := start.Add(90 * 5 * time.Second)
+		if rolledUp {
+			outage = outage.Truncate(time.Minute)
+		}
+		if got, want := outages[0].From, outage; !got.Equal(want) {
+			t.Errorf("outage: got %v, want %v", got, want)
+		}
+	}
+	check(start, start.Add(time.Hour), false)
+
+	store.now = func() time.Time { return start.Add(26 * time.Hour) }
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.rawFilename(start)); !os.IsNotExist(err) {
+		t.Errorf("raw segment was not compacted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rollup", "2024-10-01.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	check(start, start.Add(time.Hour), true)
+
+	store.now = func() time.Time { return start.Add(32 * 24 * time.Hour) }
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	history, err := store.Query("cam1", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(history), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -2,9 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"net"
+	"net/netip"
+	"sort"
 	"sync"
+	"syscall"
 	"time"
 
 	"cloudeng.io/sync/errgroup"
@@ -14,196 +21,847 @@ import (
 )
 
 type ICMPMonitor struct {
-	l     *Logger
-	icmp4 *icmp.PacketConn
-	icmp6 *icmp.PacketConn
-	rx4   *icmpConn
-	rx6   *icmpConn
+	events *EventBus
+	rx4    *icmpConn
+	rx6    *icmpConn // nil if IPv6 is unavailable.
+
+	mu    sync.Mutex
+	stats map[string]*icmpStatsWindow
+}
+
+func NewICMPMonitor(events *EventBus) *ICMPMonitor {
+	return &ICMPMonitor{events: events, stats: map[string]*icmpStatsWindow{}}
+}
+
+func (m *ICMPMonitor) statsWindow(dev ICMPDevice) *icmpStatsWindow {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.stats[dev.Name]
+	if !ok {
+		w = newICMPStatsWindow(dev.Name, dev.StatsWindow)
+		m.stats[dev.Name] = w
+	}
+	return w
+}
+
+// Stats returns the statistics for the most recent probes sent to the
+// named device.
+func (m *ICMPMonitor) Stats(device string) (ICMPStats, bool) {
+	m.mu.Lock()
+	w, ok := m.stats[device]
+	m.mu.Unlock()
+	if !ok {
+		return ICMPStats{}, false
+	}
+	return w.stats(), true
+}
+
+// AllStats returns the statistics for all monitored devices sorted by
+// device name.
+func (m *ICMPMonitor) AllStats() []ICMPStats {
+	m.mu.Lock()
+	windows := make([]*icmpStatsWindow, 0, len(m.stats))
+	for _, w := range m.stats {
+		windows = append(windows, w)
+	}
+	m.mu.Unlock()
+	res := make([]ICMPStats, 0, len(windows))
+	for _, w := range windows {
+		res = append(res, w.stats())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Device < res[j].Device })
+	return res
+}
+
+func (m *ICMPMonitor) publish(ctx context.Context, ev Event) {
+	ev.Module = "ping"
+	m.events.Publish(ctx, ev)
 }
 
-func NewICMPMonitor(l *Logger) *ICMPMonitor {
-	return &ICMPMonitor{l: l}
+// icmpError is an ICMP error, or redirect, message received in response
+// to an echo request.
+type icmpError struct {
+	typ     icmp.Type
+	code    int
+	mtu     int        // next hop MTU for packet too big errors.
+	gateway netip.Addr // the gateway to use for redirects.
+}
+
+// reason returns a description of the error that is distinct for each
+// cause of failure that is of interest.
+func (e *icmpError) reason() string {
+	switch e.typ {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		switch e.code {
+		case 0:
+			return "net unreachable"
+		case 1:
+			return "host unreachable"
+		case 2:
+			return "protocol unreachable"
+		case 3:
+			return "port unreachable"
+		case 4:
+			return "packet too big"
+		case 9, 10, 13:
+			return "admin prohibited"
+		}
+		return "unreachable"
+	case ipv6.ICMPTypeDestinationUnreachable:
+		switch e.code {
+		case 0:
+			return "net unreachable"
+		case 1, 5, 6:
+			return "admin prohibited"
+		case 3:
+			return "host unreachable"
+		case 4:
+			return "port unreachable"
+		}
+		return "unreachable"
+	case ipv6.ICMPTypePacketTooBig:
+		return "packet too big"
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		if e.code == 0 {
+			return "ttl exceeded"
+		}
+		return "reassembly time exceeded"
+	case ipv4.ICMPTypeRedirect, ipv6.ICMPTypeRedirect:
+		return "redirect"
+	}
+	return fmt.Sprintf("%v", e.typ)
 }
 
-func (m *ICMPMonitor) log(ctx context.Context, format string, args ...any) {
-	m.l.Log(ctx, "ping", format, args...)
+// redirect returns true if the message is a redirect rather than an
+// error, ie. the request was forwarded.
+func (e *icmpError) redirect() bool {
+	return e.typ == ipv4.ICMPTypeRedirect || e.typ == ipv6.ICMPTypeRedirect
 }
 
-func (m *ICMPMonitor) warn(ctx context.Context, format string, args ...any) {
-	m.l.Warn(ctx, "ping", format, args...)
+func (e *icmpError) Error() string {
+	switch {
+	case e.mtu > 0:
+		return fmt.Sprintf("%v, mtu %v", e.reason(), e.mtu)
+	case e.redirect():
+		return fmt.Sprintf("%v to %v", e.reason(), e.gateway)
+	}
+	return e.reason()
 }
 
+// icmpEcho is either an echo reply or, if err is set, the echo request
+// quoted in an ICMP error message along with its destination.
 type icmpEcho struct {
 	reply *icmp.Echo
 	peer  net.Addr
+	dst   netip.Addr
+	err   *icmpError
+	when  time.Time
 }
 
+// rtt returns the round trip time for a request sent at start.
+func (e icmpEcho) rtt(start time.Time) time.Duration {
+	if e.when.IsZero() {
+		return time.Since(start)
+	}
+	return e.when.Sub(start)
+}
+
+// icmpMode is the type of socket used to send and receive ICMP messages.
+type icmpMode int
+
+const (
+	// icmpDatagram sockets are unprivileged, but on linux the kernel
+	// replaces the echo identifier with one of its own choosing.
+	icmpDatagram icmpMode = iota
+	// icmpRaw sockets require CAP_NET_RAW, or root, and receive all ICMP
+	// messages sent to the host.
+	icmpRaw
+)
+
+func (m icmpMode) String() string {
+	if m == icmpRaw {
+		return "raw"
+	}
+	return "datagram"
+}
+
+// icmpSocket is an ICMP socket and the mode it was opened in.
+type icmpSocket struct {
+	conn net.PacketConn
+	mode icmpMode
+}
+
+// openICMP opens an IPv4, or IPv6, ICMP socket preferring unprivileged
+// datagram sockets and falling back to raw sockets if the former are not
+// permitted, eg. because net.ipv4.ping_group_range excludes the user.
+func openICMP(v6 bool, ttl int, dontFragment bool) (icmpSocket, error) {
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+	conn, err := listenICMP(network, ttl, dontFragment)
+	if err == nil {
+		return icmpSocket{conn: conn, mode: icmpDatagram}, nil
+	}
+	conn, rerr := listenRawICMP(v6, ttl, dontFragment)
+	if rerr == nil {
+		return icmpSocket{conn: conn, mode: icmpRaw}, nil
+	}
+	return icmpSocket{}, fmt.Errorf("datagram icmp socket: %w, raw icmp socket (requires CAP_NET_RAW): %v", err, rerr)
+}
+
+var (
+	errICMPNoListener = errors.New("no listener")
+	errICMPUnexpected = errors.New("unexpected message type")
+)
+
 type icmpConn struct {
 	sync.Mutex
 	id       int
-	conn     *icmp.PacketConn
+	conn     net.PacketConn
+	mode     icmpMode
 	echoType icmp.Type
+	events   *EventBus
 	waiters  map[int]chan icmpEcho
+	byAddr   map[netip.Addr]int
 }
 
-func newICMPConn(conn *icmp.PacketConn, echoType icmp.Type) *icmpConn {
+func newICMPConn(sock icmpSocket, echoType icmp.Type, events *EventBus) *icmpConn {
 	return &icmpConn{
-		conn:     conn,
+		// Raw sockets see the replies to all requests sent by the
+		// host so start from a random identifier to avoid those of
+		// other processes.
+		id:       rand.IntN(0xffff),
+		conn:     sock.conn,
+		mode:     sock.mode,
 		echoType: echoType,
+		events:   events,
 		waiters:  map[int]chan icmpEcho{},
+		byAddr:   map[netip.Addr]int{},
 	}
 }
 
-func (c *icmpConn) register(ch chan icmpEcho) int {
+// register registers ch for the returned echo identifier and, for
+// datagram sockets where the kernel replaces the identifier with one of
+// its own choosing, for messages to or from addr. Since only one prober
+// can be found by its address it returns false, without registering ch,
+// if addr is already registered with a datagram socket.
+func (c *icmpConn) register(ch chan icmpEcho, addr netip.Addr) (int, bool) {
 	c.Lock()
 	defer c.Unlock()
-	c.id++
+	if _, ok := c.byAddr[addr]; ok && c.mode == icmpDatagram {
+		return 0, false
+	}
+	c.id = (c.id + 1) & 0xffff
 	c.waiters[c.id] = ch
-	return c.id
+	if c.mode == icmpDatagram {
+		c.byAddr[addr] = c.id
+	}
+	return c.id, true
+}
+
+// registerID registers ch for the specified echo identifier, as required
+// for sockets where the kernel chooses the identifier.
+func (c *icmpConn) registerID(id int, ch chan icmpEcho) {
+	c.Lock()
+	defer c.Unlock()
+	c.waiters[id] = ch
 }
 
 func (c *icmpConn) deregister(id int) {
 	c.Lock()
 	defer c.Unlock()
+	for addr, aid := range c.byAddr {
+		if aid == id {
+			delete(c.byAddr, addr)
+		}
+	}
 	delete(c.waiters, id)
 }
 
-func (c *icmpConn) forwardEcho(ctx context.Context, peer net.Addr, m *icmp.Echo) error {
+func peerAddr(peer net.Addr) netip.Addr {
+	var ip net.IP
+	switch a := peer.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr.Unmap()
+}
+
+// forwardEcho forwards echo to the prober that sent the request, which
+// is found by its echo identifier or, failing that for datagram sockets,
+// by its destination.
+// The echo is dropped rather than blocking the listener if the prober
+// is not keeping up.
+func (c *icmpConn) forwardEcho(echo icmpEcho) error {
 	c.Lock()
 	defer c.Unlock()
-	ch, ok := c.waiters[m.ID]
-	if ok {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case ch <- icmpEcho{reply: m, peer: peer}:
+	ch, ok := c.waiters[echo.reply.ID]
+	if !ok && c.mode == icmpDatagram {
+		addr := echo.dst
+		if echo.err == nil {
+			addr = peerAddr(echo.peer)
+		}
+		var id int
+		if id, ok = c.byAddr[addr]; ok {
+			ch = c.waiters[id]
 		}
+	}
+	if !ok {
+		return fmt.Errorf("%w for id: %v", errICMPNoListener, echo.reply.ID)
+	}
+	select {
+	case ch <- echo:
 		return nil
+	default:
+		return fmt.Errorf("listener for id %v is not keeping up", echo.reply.ID)
+	}
+}
+
+// quotedEcho returns the echo request, and its destination, quoted
+// following the original IP header in the data of an ICMP error message.
+func quotedEcho(proto int, data []byte) (*icmp.Echo, netip.Addr, bool) {
+	var echoType byte
+	var dst netip.Addr
+	switch proto {
+	case ipv4.ICMPTypeEcho.Protocol():
+		if len(data) < ipv4.HeaderLen || len(data) < int(data[0]&0x0f)*4 {
+			return nil, dst, false
+		}
+		dst = netip.AddrFrom4([4]byte(data[16:20]))
+		data = data[int(data[0]&0x0f)*4:]
+		echoType = byte(ipv4.ICMPTypeEcho)
+	default:
+		if len(data) < ipv6.HeaderLen {
+			return nil, dst, false
+		}
+		dst = netip.AddrFrom16([16]byte(data[24:40]))
+		data = data[ipv6.HeaderLen:]
+		echoType = byte(ipv6.ICMPTypeEchoRequest)
+	}
+	if len(data) < 8 || data[0] != echoType {
+		return nil, dst, false
+	}
+	return &icmp.Echo{
+		ID:  int(binary.BigEndian.Uint16(data[4:6])),
+		Seq: int(binary.BigEndian.Uint16(data[6:8])),
+	}, dst, true
+}
+
+// redirectedHeader returns the contents of the redirected header option
+// of an ICMPv6 redirect message.
+func redirectedHeader(opts []byte) []byte {
+	for len(opts) >= 8 {
+		l := int(opts[1]) * 8
+		if l == 0 || l > len(opts) {
+			return nil
+		}
+		if opts[0] == 4 {
+			return opts[8:l]
+		}
+		opts = opts[l:]
+	}
+	return nil
+}
+
+// errorEcho returns the echo request quoted in an ICMP error or redirect
+// message, rb is the raw message since the next hop MTU and the gateway
+// address are not otherwise available.
+func (c *icmpConn) errorEcho(rm *icmp.Message, rb []byte) (icmpEcho, bool) {
+	var data []byte
+	ierr := &icmpError{typ: rm.Type, code: rm.Code}
+	switch body := rm.Body.(type) {
+	case *icmp.DstUnreach:
+		data = body.Data
+		if rm.Type == ipv4.ICMPTypeDestinationUnreachable && rm.Code == 4 {
+			ierr.mtu = int(binary.BigEndian.Uint16(rb[6:8]))
+		}
+	case *icmp.PacketTooBig:
+		data, ierr.mtu = body.Data, body.MTU
+	case *icmp.TimeExceeded:
+		data = body.Data
+	case *icmp.RawBody:
+		switch {
+		case rm.Type == ipv4.ICMPTypeRedirect && len(rb) >= 8:
+			ierr.gateway = netip.AddrFrom4([4]byte(rb[4:8]))
+			data = rb[8:]
+		case rm.Type == ipv6.ICMPTypeRedirect && len(rb) >= 40:
+			ierr.gateway = netip.AddrFrom16([16]byte(rb[8:24]))
+			data = redirectedHeader(rb[40:])
+		}
 	}
-	return fmt.Errorf("no listener for id: %v", m.ID)
+	echo, dst, ok := quotedEcho(c.echoType.Protocol(), data)
+	return icmpEcho{reply: echo, dst: dst, err: ierr}, ok
 }
 
+// handle parses a received message and forwards echo replies, and error
+// messages that quote an echo request, to the prober that sent the
+// request.
+func (c *icmpConn) handle(peer net.Addr, rb []byte, when time.Time) error {
+	rm, err := icmp.ParseMessage(c.echoType.Protocol(), rb)
+	if err != nil {
+		return err
+	}
+	if rm.Type == c.echoType {
+		reply, ok := rm.Body.(*icmp.Echo)
+		if !ok {
+			return fmt.Errorf("malformed echo reply")
+		}
+		return c.forwardEcho(icmpEcho{reply: reply, peer: peer, when: when})
+	}
+	echo, ok := c.errorEcho(rm, rb)
+	if !ok {
+		return fmt.Errorf("%w: %v", errICMPUnexpected, rm.Type)
+	}
+	echo.peer, echo.when = peer, when
+	return c.forwardEcho(echo)
+}
+
+// listenLoop reads messages until the socket is closed, messages that
+// cannot be parsed or forwarded are discarded. Raw sockets receive all
+// of the ICMP messages sent to the host and hence those that are not
+// for this socket are discarded silently.
 func (c *icmpConn) listenLoop(ctx context.Context) error {
+	buf := make([]byte, 65536)
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
-		rb := make([]byte, 1500)
-		n, peer, err := c.conn.ReadFrom(rb)
+		n, peer, err := c.conn.ReadFrom(buf)
 		if err != nil {
 			return err
 		}
-		rm, err := icmp.ParseMessage(c.echoType.Protocol(), rb[:n])
-		if err != nil {
-			return err
+		// The parsed message refers to rb and is passed to the prober.
+		rb := make([]byte, n)
+		copy(rb, buf)
+		err = c.handle(peer, rb, time.Now())
+		if err == nil || c.events == nil {
+			continue
 		}
-		switch rm.Type {
-		case c.echoType:
-			err = c.forwardEcho(ctx, peer, rm.Body.(*icmp.Echo))
-		default:
-			err = fmt.Errorf("unexpected message type: %v", rm.Type)
+		if c.mode == icmpRaw && (errors.Is(err, errICMPNoListener) || errors.Is(err, errICMPUnexpected)) {
+			continue
 		}
+		c.events.Debug(ctx, "ping", "", "discarded", "peer", peer, "err", err)
 	}
 }
 
-func (m *ICMPMonitor) createListeners() error {
-	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+// createListeners opens the shared IPv4 and IPv6 sockets, monitoring
+// continues with IPv4 only if an IPv6 socket cannot be opened.
+func (m *ICMPMonitor) createListeners(ctx context.Context) error {
+	sock, err := openICMP(false, 0, false)
 	if err != nil {
 		return err
 	}
-	m.icmp4 = conn
-	m.rx4 = newICMPConn(conn, ipv4.ICMPTypeEchoReply)
-	conn, err = icmp.ListenPacket("udp6", "::")
+	m.rx4 = newICMPConn(sock, ipv4.ICMPTypeEchoReply, m.events)
+	sock, err = openICMP(true, 0, false)
 	if err != nil {
-		return err
+		m.events.Warn(ctx, "ping", "", "ipv6 unavailable, using ipv4 only", "ipv4", m.rx4.mode, "err", err)
+		return nil
 	}
-	m.icmp6 = conn
-	m.rx6 = newICMPConn(conn, ipv6.ICMPTypeEchoReply)
+	m.rx6 = newICMPConn(sock, ipv6.ICMPTypeEchoReply, m.events)
+	m.events.Info(ctx, "ping", "", "using icmp sockets", "ipv4", m.rx4.mode, "ipv6", m.rx6.mode)
 	return nil
 }
 
 func (m *ICMPMonitor) MonitorAll(ctx context.Context, devs []ICMPDevice) error {
-	if err := m.createListeners(); err != nil {
+	if err := m.createListeners(ctx); err != nil {
 		return err
 	}
 	var g errgroup.T
 	g.Go(func() error {
 		return m.rx4.listenLoop(ctx)
 	})
-	g.Go(func() error {
-		return m.rx6.listenLoop(ctx)
-	})
+	if m.rx6 != nil {
+		g.Go(func() error {
+			return m.rx6.listenLoop(ctx)
+		})
+	}
 	for _, dev := range devs {
+		if dev.ipAddr.Is6() && m.rx6 == nil {
+			m.publish(ctx, Event{
+				Level:   slog.LevelError,
+				Device:  dev.Name,
+				Kind:    EventProbeFailed,
+				Message: "ipv6 unavailable",
+				Attrs:   attrs("dst", dev.ipAddr),
+			})
+			continue
+		}
 		g.Go(func() error {
 			return m.MonitorDevice(ctx, dev)
 		})
 	}
 	select {
 	case <-ctx.Done():
-		m.icmp4.Close()
-		m.icmp6.Close()
+		m.rx4.conn.Close()
+		if m.rx6 != nil {
+			m.rx6.conn.Close()
+		}
 		break
 	}
 	return g.Wait()
 }
 
-func (m *ICMPMonitor) MonitorDevice(ctx context.Context, dev ICMPDevice) error {
-	var echoType icmp.Type
-	var id int
-	conn := m.icmp4
-	echoType = ipv4.ICMPTypeEcho
-	ch := make(chan icmpEcho, 1)
-	if dev.ipAddr.Is6() {
-		echoType = ipv6.ICMPTypeEchoRequest
-		conn = m.icmp6
-		id = m.rx6.register(ch)
+// icmpTarget is the socket, destination and echo identifier used to
+// ping a device.
+type icmpTarget struct {
+	conn     net.PacketConn
+	addr     netip.Addr
+	dst      net.Addr
+	echoType icmp.Type
+	id       int
+	ch       chan icmpEcho
+}
+
+func (t *icmpTarget) send(seq int, payload []byte) error {
+	wm := icmp.Message{
+		Type: t.echoType,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   t.id,
+			Seq:  seq,
+			Data: payload,
+		},
+	}
+	wb, err := wm.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteTo(wb, t.dst)
+	return err
+}
+
+// newICMPTarget returns a target for addr using sock, along with the
+// type of the echo replies it will receive.
+func newICMPTarget(sock icmpSocket, addr netip.Addr, buffer int) (*icmpTarget, icmp.Type) {
+	t := &icmpTarget{
+		conn:     sock.conn,
+		addr:     addr,
+		dst:      &net.UDPAddr{IP: addr.AsSlice()},
+		echoType: ipv4.ICMPTypeEcho,
+		ch:       make(chan icmpEcho, buffer),
+	}
+	if sock.mode == icmpRaw {
+		t.dst = &net.IPAddr{IP: addr.AsSlice()}
+	}
+	if addr.Is6() {
+		t.echoType = ipv6.ICMPTypeEchoRequest
+		return t, ipv6.ICMPTypeEchoReply
+	}
+	return t, ipv4.ICMPTypeEchoReply
+}
+
+// dedicatedICMPTarget returns a target for addr that uses a socket,
+// with the specified TTL and fragmentation setting, for its sole use.
+// The socket is listened to until ctx is canceled, failures to do so are
+// published for the device and module.
+func dedicatedICMPTarget(ctx context.Context, events *EventBus, module logMod, device string, addr netip.Addr, buffer, ttl int, dontFragment bool) (*icmpTarget, error) {
+	sock, err := openICMP(addr.Is6(), ttl, dontFragment)
+	if err != nil {
+		return nil, err
+	}
+	t, replyType := newICMPTarget(sock, addr, buffer)
+	rx := newICMPConn(sock, replyType, events)
+	// Unprivileged ICMP sockets on linux use the local port as the
+	// echo identifier.
+	if laddr, ok := sock.conn.LocalAddr().(*net.UDPAddr); ok && laddr.Port != 0 {
+		t.id = laddr.Port
+		rx.registerID(t.id, t.ch)
 	} else {
-		id = m.rx4.register(ch)
+		t.id, _ = rx.register(t.ch, addr)
+	}
+	events.Debug(ctx, module, device, "using icmp socket", "mode", sock.mode, "ttl", ttl, "dont_fragment", dontFragment)
+	go func() {
+		<-ctx.Done()
+		sock.conn.Close()
+	}()
+	go func() {
+		if err := rx.listenLoop(ctx); err != nil && ctx.Err() == nil {
+			events.Publish(ctx, Event{
+				Level:   slog.LevelError,
+				Module:  module,
+				Device:  device,
+				Kind:    EventProbeFailed,
+				Message: "listen failed",
+				Err:     err,
+			})
+		}
+	}()
+	return t, nil
+}
+
+// target returns the target for dev, using the shared sockets unless
+// the device requires a specific TTL or fragmentation setting, and a
+// function that releases the target once it is no longer needed.
+func (m *ICMPMonitor) target(ctx context.Context, dev ICMPDevice) (*icmpTarget, func(), error) {
+	buffer := max(8, dev.Count)
+	dedicated := func() (*icmpTarget, func(), error) {
+		ctx, cancel := context.WithCancel(ctx)
+		t, err := dedicatedICMPTarget(ctx, m.events, "ping", dev.Name, dev.ipAddr, buffer, dev.TTL, dev.DontFragment)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		return t, cancel, nil
+	}
+	if dev.TTL != 0 || dev.DontFragment {
+		return dedicated()
 	}
-	dst := &net.UDPAddr{IP: dev.ipAddr.AsSlice()}
+	rx := m.rx4
+	if dev.ipAddr.Is6() {
+		rx = m.rx6
+	}
+	if rx == nil {
+		return nil, nil, fmt.Errorf("ipv6 is unavailable")
+	}
+	t, _ := newICMPTarget(icmpSocket{conn: rx.conn, mode: rx.mode}, dev.ipAddr, buffer)
+	id, ok := rx.register(t.ch, dev.ipAddr)
+	if !ok {
+		// Another device with the same address is using the shared
+		// socket and replies to the two could not be told apart.
+		return dedicated()
+	}
+	t.id = id
+	return t, func() { rx.deregister(t.id) }, nil
+}
+
+// MonitorDevice pings the device until ctx is canceled, rounds are
+// skipped until a device whose IP is a hostname has an address.
+func (m *ICMPMonitor) MonitorDevice(ctx context.Context, dev ICMPDevice) error {
+	var t *icmpTarget
+	release := func() {}
+	if dev.ipAddr.IsValid() {
+		var err error
+		if t, release, err = m.target(ctx, dev); err != nil {
+			return fmt.Errorf("%v: %w", dev.Name, err)
+		}
+	}
+	defer func() { release() }()
+	stats := m.statsWindow(dev)
+	payload := icmpPayload(dev.PayloadSize)
+	lastSummary := time.Now()
 	seq := 0
 	for {
-		err := m.ping(ctx, dev, dst, echoType, id, seq, conn, ch, dev.Timeout)
-		if err != nil {
-			m.warn(ctx, "failed", "name", dev.Name, "dst", dst.IP, "error", err.Error())
+		// Switch to the device's new address if its hostname now
+		// resolves to a different one, or has been resolved.
+		if next := dev.current(); next.ipAddr.IsValid() && (t == nil || next.ipAddr != dev.ipAddr) {
+			nt, nrelease, err := m.target(ctx, next)
+			if err != nil {
+				m.publish(ctx, Event{Level: slog.LevelError, Device: dev.Name, Kind: EventProbeFailed, Message: "address change failed", Err: err, Attrs: attrs("dst", next.ipAddr)})
+			} else {
+				release()
+				dev, t, release = next, nt, nrelease
+			}
+		}
+		if t != nil {
+			m.round(ctx, dev, t, seq, payload, stats)
+		}
+		if t != nil && dev.SummaryInterval > 0 && time.Since(lastSummary) >= dev.SummaryInterval {
+			lastSummary = time.Now()
+			m.publish(ctx, Event{
+				Level:   slog.LevelInfo,
+				Device:  dev.Name,
+				Kind:    EventInfo,
+				Message: "summary",
+				Attrs:   stats.stats().Attrs(),
+			})
 		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-time.After(dev.Interval):
-			seq++
+			seq += dev.Count
 		}
 	}
 }
 
-func (m *ICMPMonitor) ping(ctx context.Context, dev ICMPDevice, dst *net.UDPAddr, echoType icmp.Type, id, seq int, conn *icmp.PacketConn, ch chan icmpEcho, timeout time.Duration) error {
-	wm := icmp.Message{
-		Type: echoType,
-		Code: 0,
-		Body: &icmp.Echo{
-			ID:   id,
-			Seq:  seq,
-			Data: []byte("HELLO-R-U-THERE"),
-		},
+// icmpPayload returns the echo payload of the specified size, or the
+// traditional payload if size is zero.
+func icmpPayload(size int) []byte {
+	const hello = "HELLO-R-U-THERE"
+	if size == 0 {
+		return []byte(hello)
 	}
-	wb, err := wm.Marshal(nil)
-	if err != nil {
-		return err
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = hello[i%len(hello)]
 	}
-	start := time.Now()
-	if _, err := conn.WriteTo(wb, dst); err != nil {
-		return err
+	return payload
+}
+
+type icmpPending struct {
+	seq   int
+	start time.Time
+}
+
+// round sends dev.Count echo requests, dev.Spacing apart, and waits for
+// their replies, or for each to time out. The outcome of each request is
+// published and recorded in stats, a summary of the round as a whole is
+// published when more than one request is sent per round.
+func (m *ICMPMonitor) round(ctx context.Context, dev ICMPDevice, t *icmpTarget, seq int, payload []byte, stats *icmpStatsWindow) {
+	round := newICMPStatsWindow(dev.Name, dev.Count)
+	record := func(seq int, rtt time.Duration, ok bool) {
+		now := time.Now()
+		stats.record(now, seq, rtt, ok)
+		round.record(now, seq, rtt, ok)
 	}
-	select {
-	case <-time.After(timeout):
-		m.warn(ctx, "timeout", "name", dev.Name, "dst", dst.IP, "id", id, "seq", seq, "timeout", timeout.String(), "took", time.Since(start).String())
-		break
-	case <-ctx.Done():
-		return err
-	case msg := <-ch:
-		m.log(ctx, "ok", "name", dev.Name, "peer", msg.peer, "id", msg.reply.ID, "seq", msg.reply.Seq, "took", time.Since(start).String())
+	var pending []icmpPending
+	sent := 0
+	nextSend := time.Now()
+	for {
+		now := time.Now()
+		if sent < dev.Count && !now.Before(nextSend) {
+			s := seq + sent
+			sent++
+			nextSend = now.Add(dev.Spacing)
+			if err := t.send(s, payload); err != nil {
+				record(s, 0, false)
+				m.sendFailed(ctx, dev, t, s, payload, err)
+				continue
+			}
+			pending = append(pending, icmpPending{seq: s, start: now})
+			continue
+		}
+		for len(pending) > 0 && now.Sub(pending[0].start) >= dev.Timeout {
+			p := pending[0]
+			pending = pending[1:]
+			record(p.seq, 0, false)
+			m.publish(ctx, Event{
+				Level:   slog.LevelWarn,
+				Device:  dev.Name,
+				Kind:    EventTimeout,
+				Message: "timeout",
+				Latency: now.Sub(p.start),
+				Attrs:   attrs("dst", t.addr, "id", t.id, "seq", p.seq, slog.Duration("timeout", dev.Timeout)),
+			})
+		}
+		if sent == dev.Count && len(pending) == 0 {
+			break
+		}
+		var wake time.Time
+		if sent < dev.Count {
+			wake = nextSend
+		}
+		if len(pending) > 0 {
+			if expires := pending[0].start.Add(dev.Timeout); wake.IsZero() || expires.Before(wake) {
+				wake = expires
+			}
+		}
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case msg := <-t.ch:
+			timer.Stop()
+			pending = m.reply(ctx, dev, msg, pending, stats, record)
+		}
 	}
-	return err
+	if dev.Count > 1 {
+		s := round.stats()
+		level := slog.LevelInfo
+		if s.Loss > 0 {
+			level = slog.LevelWarn
+		}
+		m.publish(ctx, Event{
+			Level:   level,
+			Device:  dev.Name,
+			Kind:    EventInfo,
+			Message: "round",
+			Attrs: attrs("dst", t.addr, "size", len(payload),
+				"sent", s.Sent, "received", s.Received, "loss", s.Loss,
+				slog.Duration("min", s.Min), slog.Duration("avg", s.Avg), slog.Duration("max", s.Max)),
+		})
+	}
+}
+
+// reply handles a reply, or an error, for one of the pending requests and
+// returns the requests that remain pending.
+func (m *ICMPMonitor) reply(ctx context.Context, dev ICMPDevice, msg icmpEcho, pending []icmpPending, stats *icmpStatsWindow, record func(int, time.Duration, bool)) []icmpPending {
+	idx := -1
+	for i, p := range pending {
+		if p.seq&0xffff == msg.reply.Seq {
+			idx = i
+			break
+		}
+	}
+	if msg.err != nil {
+		args := []any{"peer", msg.peer, "id", msg.reply.ID, "seq", msg.reply.Seq, "type", msg.err.typ, "code", msg.err.code}
+		if msg.err.redirect() {
+			// The request was forwarded so the probe remains pending.
+			m.publish(ctx, Event{
+				Level:   slog.LevelInfo,
+				Device:  dev.Name,
+				Kind:    EventInfo,
+				Message: "redirect",
+				Attrs:   attrs(append(args, "gateway", msg.err.gateway)...),
+			})
+			return pending
+		}
+		if idx < 0 {
+			return pending
+		}
+		if msg.err.mtu > 0 {
+			args = append(args, "mtu", msg.err.mtu)
+		}
+		record(pending[idx].seq, 0, false)
+		m.publish(ctx, Event{
+			Level:   slog.LevelWarn,
+			Device:  dev.Name,
+			Kind:    EventProbeFailed,
+			Message: msg.err.reason(),
+			Err:     msg.err,
+			Attrs:   attrs(args...),
+		})
+		return append(pending[:idx], pending[idx+1:]...)
+	}
+	if idx < 0 {
+		// Replies to earlier probes must not satisfy pending ones.
+		class := stats.unexpectedReply(msg.reply.Seq)
+		m.publish(ctx, Event{
+			Level:   slog.LevelInfo,
+			Device:  dev.Name,
+			Kind:    EventInfo,
+			Message: class.String() + " reply",
+			Attrs:   attrs("peer", msg.peer, "id", msg.reply.ID, "seq", msg.reply.Seq),
+		})
+		return pending
+	}
+	rtt := msg.rtt(pending[idx].start)
+	record(pending[idx].seq, rtt, true)
+	m.publish(ctx, Event{
+		Level:   slog.LevelInfo,
+		Device:  dev.Name,
+		Kind:    EventProbeOK,
+		Message: "ok",
+		Latency: rtt,
+		Attrs:   attrs("peer", msg.peer, "id", msg.reply.ID, "seq", msg.reply.Seq),
+	})
+	return append(pending[:idx], pending[idx+1:]...)
+}
+
+// sendFailed publishes the failure to send a request, a request that
+// exceeds the path MTU when fragmentation is disabled is reported as
+// being too big.
+func (m *ICMPMonitor) sendFailed(ctx context.Context, dev ICMPDevice, t *icmpTarget, seq int, payload []byte, err error) {
+	ev := Event{
+		Level:   slog.LevelError,
+		Device:  dev.Name,
+		Kind:    EventProbeFailed,
+		Message: "failed",
+		Err:     err,
+		Attrs:   attrs("dst", t.addr, "seq", seq),
+	}
+	if errors.Is(err, syscall.EMSGSIZE) {
+		ev.Level = slog.LevelWarn
+		ev.Message = "packet too big"
+		ev.Attrs = attrs("dst", t.addr, "seq", seq, "size", len(payload))
+	}
+	m.publish(ctx, ev)
 }
@@ -0,0 +1,254 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+type sockopt struct{ level, opt, value int }
+
+// icmpSockopts returns the socket options for the specified hop limit
+// and fragmentation setting.
+func icmpSockopts(v6 bool, ttl int, dontFragment bool) []sockopt {
+	var opts []sockopt
+	switch {
+	case !v6 && ttl > 0:
+		opts = append(opts, sockopt{unix.IPPROTO_IP, unix.IP_TTL, ttl})
+	case v6 && ttl > 0:
+		opts = append(opts, sockopt{unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl})
+	}
+	switch {
+	case !v6 && dontFragment:
+		opts = append(opts, sockopt{unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO})
+	case v6 && dontFragment:
+		opts = append(opts, sockopt{unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1})
+	}
+	return opts
+}
+
+func setsockopts(fd int, opts []sockopt) error {
+	for _, o := range opts {
+		if err := unix.SetsockoptInt(fd, o.level, o.opt, o.value); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
+
+// listenICMP creates an unprivileged ICMP socket with the specified hop
+// limit and with fragmentation disabled if dontFragment is set. These
+// are per-socket options and hence devices that require them are
+// pinged using their own socket. ICMP errors are only made available
+// for unprivileged sockets via the socket's error queue, the returned
+// connection reads them from there as if they had been received.
+func listenICMP(network string, ttl int, dontFragment bool) (net.PacketConn, error) {
+	v6 := network == "udp6"
+	family, proto := unix.AF_INET, unix.IPPROTO_ICMP
+	var sa unix.Sockaddr = &unix.SockaddrInet4{}
+	opts := []sockopt{{unix.IPPROTO_IP, unix.IP_RECVERR, 1}}
+	if v6 {
+		family, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+		sa = &unix.SockaddrInet6{}
+		opts = []sockopt{{unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1}}
+	}
+	s, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := setsockopts(s, append(opts, icmpSockopts(v6, ttl, dontFragment)...)); err != nil {
+		unix.Close(s)
+		return nil, err
+	}
+	if err := unix.Bind(s, sa); err != nil {
+		unix.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(s), "datagram-oriented icmp")
+	defer f.Close()
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return conn, nil
+	}
+	raw, err := udp.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &recvErrConn{UDPConn: udp, raw: raw, v6: v6}, nil
+}
+
+// listenRawICMP creates a raw ICMP socket, which requires CAP_NET_RAW,
+// with the specified hop limit and fragmentation setting. ICMP errors
+// are received by raw sockets as for any other ICMP message.
+func listenRawICMP(v6 bool, ttl int, dontFragment bool) (net.PacketConn, error) {
+	network, address := "ip4:icmp", "0.0.0.0"
+	if v6 {
+		network, address = "ip6:ipv6-icmp", "::"
+	}
+	lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = setsockopts(int(fd), icmpSockopts(v6, ttl, dontFragment))
+		})
+		if err == nil {
+			err = serr
+		}
+		return err
+	}}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+// setHopLimit sets the TTL, or hop limit, for subsequent requests sent
+// on a socket created by listenICMP or listenRawICMP.
+func setHopLimit(conn net.PacketConn, v6 bool, ttl int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("setting the hop limit is not supported for %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = setsockopts(int(fd), icmpSockopts(v6, ttl, false))
+	})
+	if err == nil {
+		err = serr
+	}
+	return err
+}
+
+const sizeofSockExtendedErr = int(unsafe.Sizeof(unix.SockExtendedErr{}))
+
+// recvErrConn returns the ICMP errors queued for a socket, ahead of any
+// messages received by it, as ICMP error messages that quote the
+// original request.
+type recvErrConn struct {
+	*net.UDPConn
+	raw syscall.RawConn
+	v6  bool
+}
+
+func (c *recvErrConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var n int
+	var peer net.Addr
+	var rerr error
+	err := c.raw.Read(func(fd uintptr) bool {
+		for {
+			n, peer, rerr = c.readErrQueue(int(fd), b)
+			if rerr != unix.EAGAIN {
+				return true
+			}
+			var from unix.Sockaddr
+			n, from, rerr = unix.Recvfrom(int(fd), b, unix.MSG_DONTWAIT)
+			switch rerr {
+			case nil:
+				peer = sockaddrUDP(from)
+				return true
+			case unix.EAGAIN:
+				return false
+			}
+			// Any other error is that of the message at the head of
+			// the error queue, which will be read on the next iteration.
+		}
+	})
+	if err == nil {
+		err = rerr
+	}
+	return n, peer, err
+}
+
+func sockaddrUDP(sa unix.Sockaddr) *net.UDPAddr {
+	switch a := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.UDPAddr{IP: net.IP(a.Addr[:]), Port: a.Port}
+	case *unix.SockaddrInet6:
+		return &net.UDPAddr{IP: net.IP(a.Addr[:]), Port: a.Port}
+	}
+	return &net.UDPAddr{}
+}
+
+// offender returns the address, following the sock_extended_err
+// structure, of the host that sent the ICMP error.
+func offender(data []byte) *net.UDPAddr {
+	if len(data) < 4 {
+		return &net.UDPAddr{}
+	}
+	switch binary.NativeEndian.Uint16(data) {
+	case unix.AF_INET:
+		if len(data) >= 8 {
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), data[4:8]...))}
+		}
+	case unix.AF_INET6:
+		if len(data) >= 24 {
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), data[8:24]...))}
+		}
+	}
+	return &net.UDPAddr{}
+}
+
+// readErrQueue reads the next ICMP error from the error queue and writes
+// it to b as the equivalent ICMP message, quoting a minimal IP header
+// with the original destination followed by the original request. It
+// returns unix.EAGAIN if there are no ICMP errors queued.
+func (c *recvErrConn) readErrQueue(fd int, b []byte) (int, net.Addr, error) {
+	var orig [576]byte
+	oob := make([]byte, unix.CmsgSpace(sizeofSockExtendedErr+unix.SizeofSockaddrInet6))
+	for {
+		n, oobn, _, to, err := unix.Recvmsg(fd, orig[:], oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if err != nil {
+			return 0, nil, err
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if (m.Header.Level != unix.IPPROTO_IP || m.Header.Type != unix.IP_RECVERR) &&
+				(m.Header.Level != unix.IPPROTO_IPV6 || m.Header.Type != unix.IPV6_RECVERR) {
+				continue
+			}
+			if len(m.Data) < sizeofSockExtendedErr {
+				continue
+			}
+			ee := (*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if ee.Origin != unix.SO_EE_ORIGIN_ICMP && ee.Origin != unix.SO_EE_ORIGIN_ICMP6 {
+				continue
+			}
+			msg := c.errorMessage(ee, sockaddrUDP(to).IP, orig[:n])
+			return copy(b, msg), offender(m.Data[sizeofSockExtendedErr:]), nil
+		}
+	}
+}
+
+func (c *recvErrConn) errorMessage(ee *unix.SockExtendedErr, dst net.IP, orig []byte) []byte {
+	msg := []byte{ee.Type, ee.Code, 0, 0, 0, 0, 0, 0}
+	if c.v6 {
+		binary.BigEndian.PutUint32(msg[4:8], ee.Info)
+		hdr := make([]byte, ipv6.HeaderLen)
+		hdr[0] = ipv6.Version << 4
+		copy(hdr[24:40], dst.To16())
+		return append(append(msg, hdr...), orig...)
+	}
+	binary.BigEndian.PutUint16(msg[6:8], uint16(ee.Info))
+	hdr := make([]byte, ipv4.HeaderLen)
+	hdr[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	copy(hdr[16:20], dst.To4())
+	return append(append(msg, hdr...), orig...)
+}
@@ -0,0 +1,61 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+
+	"golang.org/x/net/icmp"
+)
+
+// listenICMP creates an unprivileged ICMP socket with the specified hop
+// limit, disabling fragmentation is not supported on this platform.
+func listenICMP(network string, ttl int, dontFragment bool) (net.PacketConn, error) {
+	address := "0.0.0.0"
+	if network == "udp6" {
+		address = "::"
+	}
+	return listenICMPWith(network, address, ttl, dontFragment)
+}
+
+// listenRawICMP creates a raw ICMP socket, which requires root, with
+// the specified hop limit.
+func listenRawICMP(v6 bool, ttl int, dontFragment bool) (net.PacketConn, error) {
+	if v6 {
+		return listenICMPWith("ip6:ipv6-icmp", "::", ttl, dontFragment)
+	}
+	return listenICMPWith("ip4:icmp", "0.0.0.0", ttl, dontFragment)
+}
+
+func listenICMPWith(network, address string, ttl int, dontFragment bool) (net.PacketConn, error) {
+	if dontFragment {
+		return nil, fmt.Errorf("dont_fragment is not supported on %v", runtime.GOOS)
+	}
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		err = setHopLimit(conn, conn.IPv6PacketConn() != nil, ttl)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setHopLimit sets the TTL, or hop limit, for subsequent requests sent
+// on a socket created by listenICMP or listenRawICMP.
+func setHopLimit(conn net.PacketConn, v6 bool, ttl int) error {
+	c, ok := conn.(*icmp.PacketConn)
+	if !ok {
+		return fmt.Errorf("setting the hop limit is not supported for %T", conn)
+	}
+	if v6 {
+		return c.IPv6PacketConn().SetHopLimit(ttl)
+	}
+	return c.IPv4PacketConn().SetTTL(ttl)
+}
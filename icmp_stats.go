@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// ICMPStats summarizes the most recent probes sent to a device. Loss is
+// the ratio of probes that were not answered before their timeout, Jitter
+// is the mean absolute difference between consecutive round trip times.
+// Late and Duplicate count the replies, since monitoring started, that
+// arrived after their probe timed out or for a probe that had already
+// been answered respectively.
+type ICMPStats struct {
+	Device    string        `json:"device"`
+	Sent      int           `json:"sent"`
+	Received  int           `json:"received"`
+	Loss      float64       `json:"loss"`
+	Min       time.Duration `json:"min"`
+	Avg       time.Duration `json:"avg"`
+	Max       time.Duration `json:"max"`
+	MDev      time.Duration `json:"mdev"`
+	Jitter    time.Duration `json:"jitter"`
+	Late      int           `json:"late"`
+	Duplicate int           `json:"duplicate"`
+	Updated   time.Time     `json:"updated"`
+}
+
+// Attrs returns the statistics as attributes for a summary event.
+func (s ICMPStats) Attrs() []slog.Attr {
+	return []slog.Attr{
+		slog.Int("sent", s.Sent),
+		slog.Int("received", s.Received),
+		slog.Float64("loss", s.Loss),
+		slog.Duration("min", s.Min),
+		slog.Duration("avg", s.Avg),
+		slog.Duration("max", s.Max),
+		slog.Duration("mdev", s.MDev),
+		slog.Duration("jitter", s.Jitter),
+		slog.Int("late", s.Late),
+		slog.Int("duplicate", s.Duplicate),
+	}
+}
+
+type icmpProbe struct {
+	seq int // 16 bit sequence number as sent on the wire.
+	rtt time.Duration
+	ok  bool
+}
+
+// icmpStatsWindow maintains a rolling window of the most recent probes
+// sent to a single device.
+type icmpStatsWindow struct {
+	mu        sync.Mutex
+	device    string
+	size      int
+	probes    []icmpProbe
+	late      int
+	duplicate int
+	updated   time.Time
+}
+
+func newICMPStatsWindow(device string, size int) *icmpStatsWindow {
+	return &icmpStatsWindow{device: device, size: size, probes: make([]icmpProbe, 0, size)}
+}
+
+// record adds the outcome of a probe to the window.
+func (w *icmpStatsWindow) record(when time.Time, seq int, rtt time.Duration, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.probes) == w.size {
+		copy(w.probes, w.probes[1:])
+		w.probes = w.probes[:w.size-1]
+	}
+	w.probes = append(w.probes, icmpProbe{seq: seq & 0xffff, rtt: rtt, ok: ok})
+	w.updated = when
+}
+
+type icmpReplyClass int
+
+const (
+	icmpReplyUnknown icmpReplyClass = iota
+	icmpReplyLate
+	icmpReplyDuplicate
+)
+
+func (c icmpReplyClass) String() string {
+	switch c {
+	case icmpReplyLate:
+		return "late"
+	case icmpReplyDuplicate:
+		return "duplicate"
+	}
+	return "unknown"
+}
+
+// unexpectedReply classifies, and counts, a reply whose sequence number
+// does not match that of the outstanding probe. A reply for a probe that
+// timed out is late, one for a probe that has already been answered is
+// a duplicate; replies for probes that are no longer in the window are
+// unknown and are not counted.
+func (w *icmpStatsWindow) unexpectedReply(seq int) icmpReplyClass {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	seq &= 0xffff
+	for i := len(w.probes) - 1; i >= 0; i-- {
+		if w.probes[i].seq != seq {
+			continue
+		}
+		if w.probes[i].ok {
+			w.duplicate++
+			return icmpReplyDuplicate
+		}
+		w.late++
+		return icmpReplyLate
+	}
+	return icmpReplyUnknown
+}
+
+// stats returns the statistics for the probes currently in the window.
+func (w *icmpStatsWindow) stats() ICMPStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := ICMPStats{
+		Device:    w.device,
+		Sent:      len(w.probes),
+		Late:      w.late,
+		Duplicate: w.duplicate,
+		Updated:   w.updated,
+	}
+	var sum, sumSq, jitter float64
+	var prev time.Duration
+	var intervals int
+	for _, p := range w.probes {
+		if !p.ok {
+			continue
+		}
+		if s.Received == 0 || p.rtt < s.Min {
+			s.Min = p.rtt
+		}
+		if p.rtt > s.Max {
+			s.Max = p.rtt
+		}
+		if s.Received > 0 {
+			jitter += math.Abs(float64(p.rtt - prev))
+			intervals++
+		}
+		prev = p.rtt
+		s.Received++
+		sum += float64(p.rtt)
+		sumSq += float64(p.rtt) * float64(p.rtt)
+	}
+	if s.Sent > 0 {
+		s.Loss = float64(s.Sent-s.Received) / float64(s.Sent)
+	}
+	if s.Received > 0 {
+		avg := sum / float64(s.Received)
+		s.Avg = time.Duration(avg)
+		s.MDev = time.Duration(math.Sqrt(math.Max(sumSq/float64(s.Received)-avg*avg, 0)))
+	}
+	if intervals > 0 {
+		s.Jitter = time.Duration(jitter / float64(intervals))
+	}
+	return s
+}
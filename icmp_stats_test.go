@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestICMPStatsWindow(t *testing.T) {
+	now := time.Now()
+	w := newICMPStatsWindow("cam1", 5)
+	ms := time.Millisecond
+	// The first probe falls out of the window.
+	for i, rtt := range []time.Duration{100 * ms, 10 * ms, 20 * ms, 0, 30 * ms, 10 * ms} {
+		w.record(now, i, rtt, rtt > 0)
+	}
+	s := w.stats()
+	if got, want := s.Sent, 5; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := s.Received, 4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := s.Loss, 0.2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if s.Min != 10*ms || s.Max != 30*ms || s.Avg != 17500*time.Microsecond {
+		t.Errorf("unexpected min/avg/max: %v/%v/%v", s.Min, s.Avg, s.Max)
+	}
+	// sqrt(mean(rtt^2) - mean(rtt)^2) = sqrt(375 - 306.25)ms.
+	if got, want := s.MDev.Round(time.Microsecond), 8292*time.Microsecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// (10 + 10 + 20) / 3
+	if got, want := s.Jitter.Round(time.Microsecond), 13333*time.Microsecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		seq  int
+		want icmpReplyClass
+	}{
+		{3, icmpReplyLate},
+		{4, icmpReplyDuplicate},
+		{0x10000 + 5, icmpReplyDuplicate},
+		{0, icmpReplyUnknown},
+		{99, icmpReplyUnknown},
+	} {
+		if got := w.unexpectedReply(tc.seq); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.seq, got, tc.want)
+		}
+	}
+	s = w.stats()
+	if s.Late != 1 || s.Duplicate != 2 {
+		t.Errorf("unexpected late/duplicate: %v/%v", s.Late, s.Duplicate)
+	}
+	// Late and duplicate replies do not affect the loss.
+	if got, want := s.Loss, 0.2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
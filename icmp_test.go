@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// icmpTestConn replies to echo requests by delivering them directly to
+// the prober's channel, dropping those whose sequence number is in drop,
+// answering with an error those in reject and failing those whose
+// payload exceeds mtu.
+type icmpTestConn struct {
+	net.PacketConn
+	ch     chan icmpEcho
+	drop   map[int]bool
+	reject map[int]*icmpError
+	mtu    int
+}
+
+func (c *icmpTestConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	if c.mtu > 0 && len(b) > c.mtu {
+		return 0, &net.OpError{Op: "write", Err: syscall.EMSGSIZE}
+	}
+	rm, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), b)
+	if err != nil {
+		return 0, err
+	}
+	echo := rm.Body.(*icmp.Echo)
+	if ierr, ok := c.reject[echo.Seq]; ok {
+		c.ch <- icmpEcho{reply: echo, peer: dst, err: ierr}
+		return len(b), nil
+	}
+	if !c.drop[echo.Seq] {
+		c.ch <- icmpEcho{reply: echo, peer: dst}
+	}
+	return len(b), nil
+}
+
+func TestICMPRound(t *testing.T) {
+	ctx := context.Background()
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	m := NewICMPMonitor(bus)
+	dev := ICMPDevice{Name: "cam1", Count: 4, Spacing: time.Millisecond, Timeout: 50 * time.Millisecond, StatsWindow: 10}
+	ch := make(chan icmpEcho, 8)
+	conn := &icmpTestConn{ch: ch, drop: map[int]bool{11: true}, reject: map[int]*icmpError{
+		12: {typ: ipv4.ICMPTypeRedirect, gateway: netip.MustParseAddr("10.0.0.254")},
+		13: {typ: ipv4.ICMPTypeDestinationUnreachable, code: 10},
+	}}
+	target := &icmpTarget{conn: conn, addr: netip.MustParseAddr("10.0.0.1"), dst: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}, echoType: ipv4.ICMPTypeEcho, id: 1, ch: ch}
+	stats := m.statsWindow(dev)
+
+	m.round(ctx, dev, target, 10, icmpPayload(100), stats)
+	var msgs []string
+	for _, ev := range received {
+		msgs = append(msgs, ev.Message)
+	}
+	if got, want := len(msgs), 6; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, msgs)
+	}
+	last := received[len(received)-1]
+	if got, want := strings.Join(msgs, ","), "ok,redirect,admin prohibited"; !strings.Contains(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if last.Message != "round" || attrString(last, "sent") != "4" || attrString(last, "received") != "1" || attrString(last, "loss") != "0.75" {
+		t.Errorf("unexpected round event: %v", last)
+	}
+	if got, want := attrString(last, "size"), "100"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if s := stats.stats(); s.Sent != 4 || s.Received != 1 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+
+	// Requests that exceed the MTU are reported as being too big.
+	received = nil
+	conn.mtu = 100
+	dev.Count = 1
+	m.round(ctx, dev, target, 20, icmpPayload(1000), stats)
+	if len(received) != 1 || received[0].Message != "packet too big" || received[0].Kind != EventProbeFailed {
+		t.Errorf("unexpected events: %v", received)
+	}
+}
+
+func icmpTestEcho(typ byte, id, seq int) []byte {
+	b := make([]byte, 8)
+	b[0] = typ
+	binary.BigEndian.PutUint16(b[4:6], uint16(id))
+	binary.BigEndian.PutUint16(b[6:8], uint16(seq))
+	return b
+}
+
+func icmpTestIPv4Header(dst net.IP) []byte {
+	h := make([]byte, ipv4.HeaderLen)
+	h[0] = 0x45
+	copy(h[16:20], dst.To4())
+	return h
+}
+
+func TestICMPErrors(t *testing.T) {
+	dst := net.IPv4(10, 0, 0, 1)
+	quoted := append(icmpTestIPv4Header(dst), icmpTestEcho(byte(ipv4.ICMPTypeEcho), 7, 42)...)
+	message := func(typ ipv4.ICMPType, code byte, rest ...byte) []byte {
+		rb := append([]byte{byte(typ), code, 0, 0}, rest...)
+		return append(rb, quoted...)
+	}
+	c4 := newICMPConn(icmpSocket{}, ipv4.ICMPTypeEchoReply, nil)
+	for _, tc := range []struct {
+		rb      []byte
+		reason  string
+		mtu     int
+		gateway string
+	}{
+		{message(ipv4.ICMPTypeDestinationUnreachable, 1, 0, 0, 0, 0), "host unreachable", 0, "invalid IP"},
+		{message(ipv4.ICMPTypeDestinationUnreachable, 13, 0, 0, 0, 0), "admin prohibited", 0, "invalid IP"},
+		{message(ipv4.ICMPTypeDestinationUnreachable, 4, 0, 0, 0x05, 0x78), "packet too big", 1400, "invalid IP"},
+		{message(ipv4.ICMPTypeTimeExceeded, 0, 0, 0, 0, 0), "ttl exceeded", 0, "invalid IP"},
+		{message(ipv4.ICMPTypeRedirect, 1, 10, 0, 0, 254), "redirect", 0, "10.0.0.254"},
+	} {
+		rm, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), tc.rb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := c4.errorEcho(rm, tc.rb)
+		if !ok || got.reply.ID != 7 || got.reply.Seq != 42 || got.dst.String() != "10.0.0.1" {
+			t.Errorf("%v: unexpected result: %v %+v %v", tc.reason, ok, got.reply, got.dst)
+			continue
+		}
+		if got.err.reason() != tc.reason || got.err.mtu != tc.mtu || got.err.gateway.String() != tc.gateway {
+			t.Errorf("%v: unexpected error: %+v", tc.reason, got.err)
+		}
+	}
+
+	c6 := newICMPConn(icmpSocket{}, ipv6.ICMPTypeEchoReply, nil)
+	ip6 := make([]byte, ipv6.HeaderLen)
+	rm := &icmp.Message{Type: ipv6.ICMPTypePacketTooBig, Body: &icmp.PacketTooBig{
+		MTU:  1280,
+		Data: append(ip6, icmpTestEcho(byte(ipv6.ICMPTypeEchoRequest), 8, 43)...),
+	}}
+	got, ok := c6.errorEcho(rm, nil)
+	if !ok || got.reply.ID != 8 || got.reply.Seq != 43 || got.err.mtu != 1280 || got.err.reason() != "packet too big" {
+		t.Errorf("unexpected result: %v %+v %+v", ok, got.reply, got.err)
+	}
+}
+
+func TestICMPListenerRouting(t *testing.T) {
+	c4 := newICMPConn(icmpSocket{}, ipv4.ICMPTypeEchoReply, nil)
+	ch := make(chan icmpEcho, 1)
+	c4.register(ch, netip.MustParseAddr("10.0.0.1"))
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}
+
+	// Malformed and unrelated messages are reported as errors, but
+	// must not otherwise affect the listener.
+	for _, rb := range [][]byte{
+		{},
+		{byte(ipv4.ICMPTypeEchoReply)},
+		{byte(ipv4.ICMPTypeDestinationUnreachable), 1, 0, 0, 0, 0, 0, 0, 0x45},
+		{byte(ipv4.ICMPTypeTimestamp), 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if err := c4.handle(peer, rb, time.Now()); err == nil {
+			t.Errorf("%v: expected an error", rb)
+		}
+	}
+
+	// A reply with an identifier chosen by the kernel is routed by
+	// the address of the peer.
+	reply, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 1234, Seq: 1}}).Marshal(nil)
+	if err := c4.handle(peer, reply, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ch; got.reply.ID != 1234 || got.reply.Seq != 1 {
+		t.Errorf("unexpected reply: %+v", got.reply)
+	}
+	// The listener does not block if the prober is not keeping up.
+	c4.handle(peer, reply, time.Now())
+	if err := c4.handle(peer, reply, time.Now()); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// Errors are routed by the destination of the quoted request.
+	rb := append([]byte{byte(ipv4.ICMPTypeDestinationUnreachable), 1, 0, 0, 0, 0, 0, 0}, icmpTestIPv4Header(peer.IP)...)
+	rb = append(rb, icmpTestEcho(byte(ipv4.ICMPTypeEcho), 99, 2)...)
+	<-ch
+	if err := c4.handle(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 254)}, rb, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ch; got.err == nil || got.err.reason() != "host unreachable" || got.reply.Seq != 2 {
+		t.Errorf("unexpected error: %+v", got)
+	}
+
+	// Raw sockets see the replies to the requests of all processes, the
+	// kernel does not rewrite identifiers so they alone are used.
+	raw := newICMPConn(icmpSocket{mode: icmpRaw}, ipv4.ICMPTypeEchoReply, nil)
+	id, _ := raw.register(ch, netip.MustParseAddr("10.0.0.1"))
+	other, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: id + 1, Seq: 1}}).Marshal(nil)
+	if err := raw.handle(peer, other, time.Now()); !errors.Is(err, errICMPNoListener) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	ours, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: id, Seq: 3}}).Marshal(nil)
+	if err := raw.handle(peer, ours, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ch; got.reply.ID != id || got.reply.Seq != 3 {
+		t.Errorf("unexpected reply: %+v", got.reply)
+	}
+	if _, ok := raw.register(ch, netip.MustParseAddr("10.0.0.1")); !ok {
+		t.Errorf("raw sockets do not route by address")
+	}
+}
+
+func TestICMPListenerSameAddress(t *testing.T) {
+	c4 := newICMPConn(icmpSocket{}, ipv4.ICMPTypeEchoReply, nil)
+	addr := netip.MustParseAddr("10.0.0.1")
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}
+	ch1, ch2, ch3 := make(chan icmpEcho, 1), make(chan icmpEcho, 1), make(chan icmpEcho, 1)
+	id1, ok := c4.register(ch1, addr)
+	if !ok {
+		t.Fatal("failed to register")
+	}
+	// A second prober for the same address cannot be told apart from
+	// the first and so is not registered.
+	if _, ok := c4.register(ch2, addr); ok {
+		t.Fatal("registered the same address twice")
+	}
+	id3, _ := c4.register(ch3, netip.MustParseAddr("10.0.0.3"))
+
+	reply, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 1234, Seq: 1}}).Marshal(nil)
+	if err := c4.handle(peer, reply, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-ch1; got.reply.Seq != 1 {
+		t.Errorf("unexpected reply: %+v", got.reply)
+	}
+
+	// Deregistering one prober leaves the others in place.
+	c4.deregister(id3)
+	if err := c4.handle(peer, reply, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	<-ch1
+	c4.deregister(id1)
+	if err := c4.handle(peer, reply, time.Now()); !errors.Is(err, errICMPNoListener) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, ok := c4.register(ch2, addr); !ok {
+		t.Errorf("failed to register")
+	}
+}
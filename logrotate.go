@@ -0,0 +1,374 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LogRotation specifies when a log file is to be rotated and how many
+// of the rotated copies are to be retained.
+type LogRotation struct {
+	MaxSize  int64         // Rotate when the file would exceed this size, 0 to disable.
+	Daily    bool          // Rotate at the first write on a new day.
+	Compress bool          // Gzip rotated copies.
+	MaxAge   time.Duration // Delete rotated copies older than this, 0 to disable.
+	MaxTotal int64         // Delete the oldest rotated copies until their total size is below this, 0 to disable.
+}
+
+// rotatedLog is a rotated copy of a log file, named <name>.<RFC3339 time>
+// with a .gz suffix if compressed.
+type rotatedLog struct {
+	name string
+	when time.Time
+	size int64
+}
+
+// rotatedLogs returns the rotated copies of the named log file, ordered
+// from oldest to newest.
+func rotatedLogs(name string) ([]rotatedLog, error) {
+	matches, err := filepath.Glob(name + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var files []rotatedLog
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, name+"."), ".gz")
+		when, err := time.Parse(time.RFC3339, suffix)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedLog{name: m, when: when, size: fi.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].when.Before(files[j].when) })
+	return files, nil
+}
+
+// rotatedName returns an unused name for a copy of the named log file
+// rotated at the specified time.
+func rotatedName(name string, when time.Time) string {
+	for _, layout := range []string{time.RFC3339, time.RFC3339Nano} {
+		candidate := name + "." + when.Format(layout)
+		if !fileExists(candidate) && !fileExists(candidate+".gz") {
+			return candidate
+		}
+	}
+	return name + "." + when.Add(time.Nanosecond).Format(time.RFC3339Nano)
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// rotatingFile is an io.WriteCloser that rotates the underlying log file
+// according to its LogRotation options. Rotated copies are compressed
+// and expired in the background.
+type rotatingFile struct {
+	name string
+	opts LogRotation
+	now  func() time.Time
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	// rotateErr is the error from the most recent failed rotation,
+	// rotation is not retried until retryAt.
+	rotateErr error
+	retryAt   time.Time
+	status    io.Writer
+
+	// cleanupMu serializes the background compression and expiry.
+	cleanupMu sync.Mutex
+	wg        sync.WaitGroup
+}
+
+func newRotatingFile(name string, opts LogRotation) (*rotatingFile, error) {
+	rf := &rotatingFile{name: name, opts: opts, now: time.Now, status: os.Stderr}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	rf.cleanup()
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	os.MkdirAll(filepath.Dir(rf.name), 0700)
+	f, err := os.OpenFile(rf.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, fi.Size(), rf.now()
+	return nil
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+func (rf *rotatingFile) shouldRotate(n int) bool {
+	if rf.size == 0 || rf.now().Before(rf.retryAt) {
+		return false
+	}
+	if rf.opts.MaxSize > 0 && rf.size+int64(n) > rf.opts.MaxSize {
+		return true
+	}
+	return rf.opts.Daily && !sameDay(rf.opened, rf.now())
+}
+
+// Write implements io.Writer.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil && rf.rotateErr != nil {
+		// A failed rotation could not reopen the file, try again.
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.shouldRotate(len(p)) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotateRetryInterval is how long to wait before retrying a failed
+// rotation.
+const rotateRetryInterval = time.Minute
+
+// rotate renames the current file and opens a new one. If either step
+// fails, logging continues to the original file and the error is
+// reported once, rotation is retried after rotateRetryInterval.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+	current := rf.name
+	rotated := rotatedName(rf.name, rf.now())
+	err := os.Rename(rf.name, rotated)
+	if err == nil {
+		current = rotated
+		err = rf.open()
+	}
+	if err == nil {
+		rf.rotateErr, rf.retryAt = nil, time.Time{}
+		rf.cleanup()
+		return nil
+	}
+	if rf.rotateErr == nil {
+		fmt.Fprintf(rf.status, "failed to rotate log file %v, continuing to write to %v: %v\n", rf.name, current, err)
+	}
+	rf.rotateErr, rf.retryAt = err, rf.now().Add(rotateRetryInterval)
+	return rf.reopen(current)
+}
+
+// reopen opens the named file in append mode, it is used to continue
+// writing to the current file when rotation fails.
+func (rf *rotatingFile) reopen(name string) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// Reopen closes and reopens the log file, it is intended to be called
+// on SIGHUP after the file has been renamed by an external tool such
+// as logrotate.
+func (rf *rotatingFile) Reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f != nil {
+		rf.f.Close()
+		rf.f = nil
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.cleanup()
+	return nil
+}
+
+// reopenOnHangup reopens the log file whenever SIGHUP is received
+// until ctx is canceled.
+func (rf *rotatingFile) reopenOnHangup(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if err := rf.Reopen(); err != nil {
+				fmt.Fprintf(rf.status, "failed to reopen log file %v: %v\n", rf.name, err)
+			}
+		}
+	}
+}
+
+// Close implements io.Closer, it waits for any background compression
+// to complete.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	var err error
+	if rf.f != nil {
+		err = rf.f.Close()
+		rf.f = nil
+	}
+	rf.rotateErr = nil
+	rf.mu.Unlock()
+	rf.wg.Wait()
+	return err
+}
+
+func (rf *rotatingFile) cleanup() {
+	rf.wg.Add(1)
+	go func() {
+		defer rf.wg.Done()
+		rf.cleanupMu.Lock()
+		defer rf.cleanupMu.Unlock()
+		if err := rf.compressAndExpire(); err != nil {
+			fmt.Fprintf(rf.status, "failed to compress or expire rotated log files for %v: %v\n", rf.name, err)
+		}
+	}()
+}
+
+func (rf *rotatingFile) compressAndExpire() error {
+	files, err := rotatedLogs(rf.name)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if rf.opts.Compress {
+		for i, f := range files {
+			if strings.HasSuffix(f.name, ".gz") {
+				continue
+			}
+			if err := gzipFile(f.name); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			files[i].name = f.name + ".gz"
+			if fi, err := os.Stat(files[i].name); err == nil {
+				files[i].size = fi.Size()
+			}
+		}
+	}
+	if rf.opts.MaxAge > 0 {
+		cutoff := rf.now().Add(-rf.opts.MaxAge)
+		for len(files) > 0 && files[0].when.Before(cutoff) {
+			errs = append(errs, os.Remove(files[0].name))
+			files = files[1:]
+		}
+	}
+	if rf.opts.MaxTotal > 0 {
+		var total int64
+		for _, f := range files {
+			total += f.size
+		}
+		for len(files) > 0 && total > rf.opts.MaxTotal {
+			errs = append(errs, os.Remove(files[0].name))
+			total -= files[0].size
+			files = files[1:]
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// gzipFile replaces name with a gzip compressed copy named name.gz.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := name + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// openLogFile opens a log file for reading, decompressing it if its
+// name has a .gz suffix.
+func openLogFile(name string) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: zr, f: f}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "netmon.slog")
+	now := time.Date(2024, 10, 1, 23, 59, 0, 0, time.UTC)
+
+	rf, err := newRotatingFile(name, LogRotation{MaxSize: 100, Daily: true, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.now = func() time.Time { return now }
+	rf.opened = now
+
+	line := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"time":%q,"msg":"%02d"}`+"\n", now.Format(time.RFC3339), i))
+	}
+	// Each line is 45 bytes, so two lines fit in each file.
+	for i := 0; i < 4; i++ {
+		if _, err := rf.Write(line(i)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	// Daily rotation.
+	now = now.Add(time.Minute)
+	if _, err := rf.Write(line(4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := rotatedLogs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(rotated), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, r := range rotated {
+		if !strings.HasSuffix(r.name, ".gz") {
+			t.Errorf("%v: not compressed", r.name)
+		}
+	}
+
+	files, err := logFiles(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all bytes.Buffer
+	for _, f := range files {
+		rd, err := openLogFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(&all, rd)
+		rd.Close()
+	}
+	var want bytes.Buffer
+	now = now.Add(-time.Minute - 4*time.Second)
+	for i := 0; i < 5; i++ {
+		if i == 4 {
+			now = now.Add(time.Minute)
+		}
+		want.Write(line(i))
+		now = now.Add(time.Second)
+	}
+	if got, want := all.String(), want.String(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRotatedLogExpiry(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "netmon.slog")
+	now := time.Date(2024, 10, 10, 0, 0, 0, 0, time.UTC)
+	for day := 1; day <= 5; day++ {
+		when := now.Add(-time.Duration(day) * 24 * time.Hour)
+		if err := os.WriteFile(rotatedName(name, when), bytes.Repeat([]byte{'x'}, 100), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(name+".bak", nil, 0600)
+
+	rf := &rotatingFile{name: name, now: func() time.Time { return now }}
+	rf.opts = LogRotation{MaxAge: 4*24*time.Hour + time.Hour}
+	if err := rf.compressAndExpire(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := rotatedLogs(name)
+	if got, want := len(rotated), 4; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	rf.opts = LogRotation{MaxTotal: 250}
+	if err := rf.compressAndExpire(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ = rotatedLogs(name)
+	if got, want := len(rotated), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := rotated[0].when, now.Add(-2*24*time.Hour); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !fileExists(name + ".bak") {
+		t.Errorf("%v.bak was deleted", name)
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "netmon.slog")
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	rf, err := newRotatingFile(name, LogRotation{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := &strings.Builder{}
+	rf.now = func() time.Time { return now }
+	rf.status = status
+
+	// Renaming a file over a non-empty directory fails, even for root,
+	// so occupy every name that rotatedName may choose.
+	var blocked []string
+	for _, n := range []string{
+		name + "." + now.Format(time.RFC3339),
+		name + "." + now.Format(time.RFC3339Nano),
+		name + "." + now.Add(time.Nanosecond).Format(time.RFC3339Nano),
+	} {
+		if err := os.MkdirAll(filepath.Join(n, "x"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		blocked = append(blocked, n)
+	}
+
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 6; i++ {
+		if _, err := rf.Write(line); err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+	}
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(buf), 6*len(line); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := strings.Count(status.String(), "failed to rotate log file"); got != 1 {
+		t.Errorf("got %v, want 1: %s", got, status.String())
+	}
+
+	// Rotation is retried once the retry interval has passed.
+	for _, n := range blocked {
+		os.RemoveAll(n)
+	}
+	now = now.Add(rotateRetryInterval)
+	if _, err := rf.Write(line); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := rotatedLogs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(rotated), 1; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := rotated[0].size, int64(6*len(line)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if buf, _ := os.ReadFile(name); string(buf) != string(line) {
+		t.Errorf("got %q, want %q", buf, line)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+type LogsFlags struct {
+	LogFile string `subcmd:"log-file,netmon.slog,the log file to analyze, rotated copies of it are also read"`
+	Since   string `subcmd:"since,,start of the time range as a duration before now or RFC3339 time, defaults to the oldest record"`
+	Until   string `subcmd:"until,,end of the time range as a duration before now or RFC3339 time, defaults to now"`
+}
+
+type LogsOutagesFlags struct {
+	LogsFlags
+	MinTimeouts int `subcmd:"min-timeouts,2,minimum number of consecutive ping timeouts that constitute an outage"`
+}
+
+type LogsGrepFlags struct {
+	LogsFlags
+	Device string `subcmd:"device,,only show records for this device"`
+	Module string `subcmd:"mod,,only show records for this module"`
+}
+
+// Logs implements the logs command group for analyzing the records
+// written by the Logger.
+type Logs struct{}
+
+// logRecord is a single record written by Logger.HandleEvent.
+type logRecord struct {
+	Time  time.Time
+	Level string
+	Msg   string
+	Mod   string
+	Name  string
+	Kind  string
+	Took  time.Duration
+	line  []byte
+}
+
+func parseLogRecord(line []byte) (logRecord, bool) {
+	var raw struct {
+		Time  time.Time       `json:"time"`
+		Level string          `json:"level"`
+		Msg   string          `json:"msg"`
+		Mod   string          `json:"mod"`
+		Name  any             `json:"name"`
+		Kind  string          `json:"kind"`
+		Took  json.RawMessage `json:"took"`
+	}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return logRecord{}, false
+	}
+	rec := logRecord{
+		Time:  raw.Time,
+		Level: raw.Level,
+		Msg:   raw.Msg,
+		Mod:   raw.Mod,
+		Kind:  raw.Kind,
+		line:  line,
+	}
+	if name, ok := raw.Name.(string); ok {
+		rec.Name = name
+	}
+	// Older logs recorded durations as strings rather than nanoseconds.
+	if len(raw.Took) > 0 {
+		var ns int64
+		var str string
+		if err := json.Unmarshal(raw.Took, &ns); err == nil {
+			rec.Took = time.Duration(ns)
+		} else if err := json.Unmarshal(raw.Took, &str); err == nil {
+			rec.Took, _ = time.ParseDuration(str)
+		}
+	}
+	return rec, true
+}
+
+// logFiles returns the named log file and all of its rotated copies,
+// ordered from oldest to newest.
+func logFiles(name string) ([]string, error) {
+	rotated, err := rotatedLogs(name)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(rotated)+1)
+	for _, f := range rotated {
+		res = append(res, f.name)
+	}
+	if fileExists(name) {
+		res = append(res, name)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no log files found for %v", name)
+	}
+	return res, nil
+}
+
+// readLogs calls fn for every record in the log file and its rotated
+// copies that falls within the requested time range.
+func readLogs(fv LogsFlags, fn func(logRecord)) error {
+	now := time.Now()
+	var from, to time.Time
+	var err error
+	if len(fv.Since) > 0 {
+		if from, err = parseTimeFlag(fv.Since, now); err != nil {
+			return err
+		}
+	}
+	if to, err = parseTimeFlag(fv.Until, now); err != nil {
+		return err
+	}
+	files, err := logFiles(fv.LogFile)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		rd, err := openLogFile(name)
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(rd)
+		sc.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+		for sc.Scan() {
+			rec, ok := parseLogRecord(sc.Bytes())
+			if !ok || rec.Time.Before(from) || rec.Time.After(to) {
+				continue
+			}
+			rec.line = append([]byte(nil), rec.line...)
+			fn(rec)
+		}
+		err = sc.Err()
+		rd.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (r logRecord) success() bool {
+	return r.Msg == "ok" || r.Msg == "connected"
+}
+
+func (r logRecord) failure() bool {
+	if r.Kind == string(EventProbeFailed) || r.Kind == string(EventTimeout) {
+		return true
+	}
+	switch r.Msg {
+	case "timeout", "failed", "call failed", "failed to connect", "playback ended":
+		return true
+	}
+	return false
+}
+
+type logKey struct {
+	device, module string
+}
+
+// outageTracker reconstructs outages from the sequence of success and
+// failure records for a single device and module.
+type outageTracker struct {
+	minFailures int
+	failures    int
+	start       time.Time
+	last        time.Time
+	outages     []Interval
+}
+
+func (t *outageTracker) record(r logRecord) {
+	switch {
+	case r.failure():
+		if t.failures == 0 {
+			t.start = r.Time
+		}
+		t.failures++
+		t.last = r.Time
+	case r.success():
+		if t.failures >= t.minFailures {
+			t.outages = append(t.outages, Interval{From: t.start, To: r.Time})
+		}
+		t.failures = 0
+	}
+}
+
+func (t *outageTracker) finish() []Interval {
+	if t.failures >= t.minFailures && t.failures > 0 {
+		t.outages = append(t.outages, Interval{From: t.start, To: t.last})
+		t.failures = 0
+	}
+	return t.outages
+}
+
+func minFailures(module string, minTimeouts int) int {
+	if module == "ping" {
+		return max(minTimeouts, 1)
+	}
+	return 1
+}
+
+type logSummary struct {
+	ok, warn    int
+	first, last time.Time
+	latencies   []time.Duration
+	outages     *outageTracker
+}
+
+func percentile(sorted []time.Duration, pc float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * pc / 100)
+	return sorted[idx]
+}
+
+func sortedKeys(m map[logKey]*logSummary) []logKey {
+	keys := make([]logKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].device == keys[j].device {
+			return keys[i].module < keys[j].module
+		}
+		return keys[i].device < keys[j].device
+	})
+	return keys
+}
+
+func summarizeLogs(fv LogsFlags, minTimeouts int) (map[logKey]*logSummary, error) {
+	summaries := map[logKey]*logSummary{}
+	err := readLogs(fv, func(r logRecord) {
+		if len(r.Name) == 0 || len(r.Mod) == 0 {
+			return
+		}
+		k := logKey{device: r.Name, module: r.Mod}
+		s, ok := summaries[k]
+		if !ok {
+			s = &logSummary{first: r.Time, outages: &outageTracker{minFailures: minFailures(r.Mod, minTimeouts)}}
+			summaries[k] = s
+		}
+		s.last = r.Time
+		if r.Level == "WARN" || r.Level == "ERROR" {
+			s.warn++
+		}
+		if r.Msg == "ok" {
+			s.ok++
+			if r.Mod == "ping" && r.Took > 0 {
+				s.latencies = append(s.latencies, r.Took)
+			}
+		}
+		s.outages.record(r)
+	})
+	return summaries, err
+}
+
+func (s *logSummary) uptime(outages []Interval) float64 {
+	span := s.last.Sub(s.first)
+	if span <= 0 {
+		if len(outages) > 0 {
+			return 0
+		}
+		return 1
+	}
+	var down time.Duration
+	for _, o := range outages {
+		down += o.To.Sub(o.From)
+	}
+	return 1 - float64(down)/float64(span)
+}
+
+func (l *Logs) Summary(ctx context.Context, flags any, args []string) error {
+	fv := flags.(*LogsFlags)
+	summaries, err := summarizeLogs(*fv, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-20s %-6s %8s %8s %9s %10s %10s %10s\n", "device", "mod", "ok", "warn", "uptime", "p50", "p95", "p99")
+	for _, k := range sortedKeys(summaries) {
+		s := summaries[k]
+		outages := s.outages.finish()
+		fmt.Printf("%-20s %-6s %8d %8d %8.3f%%", k.device, k.module, s.ok, s.warn, s.uptime(outages)*100)
+		if len(s.latencies) > 0 {
+			sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+			fmt.Printf(" %10s %10s %10s", roundLatency(percentile(s.latencies, 50)), roundLatency(percentile(s.latencies, 95)), roundLatency(percentile(s.latencies, 99)))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func (l *Logs) Outages(ctx context.Context, flags any, args []string) error {
+	fv := flags.(*LogsOutagesFlags)
+	summaries, err := summarizeLogs(fv.LogsFlags, fv.MinTimeouts)
+	if err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(summaries) {
+		for _, o := range summaries[k].outages.finish() {
+			fmt.Printf("%-20s %-6s %s - %s (%s)\n", k.device, k.module, o.From.Format(time.RFC3339), o.To.Format(time.RFC3339), o.To.Sub(o.From).Round(time.Second))
+		}
+	}
+	return nil
+}
+
+func (l *Logs) Grep(ctx context.Context, flags any, args []string) error {
+	fv := flags.(*LogsGrepFlags)
+	wr := bufio.NewWriter(os.Stdout)
+	defer wr.Flush()
+	return readLogs(fv.LogsFlags, func(r logRecord) {
+		if len(fv.Device) > 0 && r.Name != fv.Device {
+			return
+		}
+		if len(fv.Module) > 0 && r.Mod != fv.Module {
+			return
+		}
+		wr.Write(r.line)
+		wr.WriteByte('\n')
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeLogLines(t *testing.T, name string, lines []string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	dir := t.TempDir()
+	logfile := filepath.Join(dir, "netmon.slog")
+	start := time.Date(2024, 10, 1, 10, 0, 0, 0, time.UTC)
+	at := func(s int) string {
+		return start.Add(time.Duration(s) * time.Second).Format(time.RFC3339Nano)
+	}
+
+	// The oldest rotated file uses the original format where durations
+	// are logged as strings.
+	writeLogLines(t, logfile+"."+start.Format(time.RFC3339), []string{
+		fmt.Sprintf(`{"time":%q,"level":"INFO","msg":"ok","mod":"ping","name":"cam1","took":"10ms"}`, at(0)),
+		fmt.Sprintf(`{"time":%q,"level":"WARN","msg":"timeout","mod":"ping","name":"cam1","took":"1s"}`, at(10)),
+		fmt.Sprintf(`{"time":%q,"level":"WARN","msg":"timeout","mod":"ping","name":"cam1","took":"1s"}`, at(20)),
+		fmt.Sprintf(`{"time":%q,"level":"INFO","msg":"ok","mod":"ping","name":"cam1","took":"20ms"}`, at(30)),
+		`not json`,
+	})
+	writeLogLines(t, logfile+"."+start.Add(time.Minute).Format(time.RFC3339), []string{
+		fmt.Sprintf(`{"time":%q,"level":"WARN","msg":"timeout","mod":"ping","name":"cam1","kind":"timeout"}`, at(40)),
+		fmt.Sprintf(`{"time":%q,"level":"INFO","msg":"ok","mod":"ping","name":"cam1","kind":"ok","took":30000000}`, at(50)),
+		fmt.Sprintf(`{"time":%q,"level":"INFO","msg":"connected","mod":"rtsp","name":"cam1","kind":"state_change"}`, at(50)),
+	})
+	writeLogLines(t, logfile, []string{
+		fmt.Sprintf(`{"time":%q,"level":"WARN","msg":"playback ended","mod":"rtsp","name":"cam1","kind":"state_change"}`, at(60)),
+		fmt.Sprintf(`{"time":%q,"level":"WARN","msg":"failed to connect","mod":"rtsp","name":"cam1","kind":"failed"}`, at(70)),
+		fmt.Sprintf(`{"time":%q,"level":"INFO","msg":"connected","mod":"rtsp","name":"cam1","kind":"state_change"}`, at(90)),
+		fmt.Sprintf(`{"time":%q,"level":"INFO","msg":"ok","mod":"ping","name":"cam2","kind":"ok","took":5000000}`, at(90)),
+	})
+	// Not a rotated copy.
+	writeLogLines(t, logfile+".bak", []string{
+		fmt.Sprintf(`{"time":%q,"level":"INFO","msg":"ok","mod":"ping","name":"cam3"}`, at(0)),
+	})
+
+	files, err := logFiles(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(files), 3; got != want || files[2] != logfile {
+		t.Fatalf("got %v, want %v files ending with %v", files, want, logfile)
+	}
+
+	fv := LogsFlags{LogFile: logfile, Until: start.Add(time.Hour).Format(time.RFC3339)}
+	summaries, err := summarizeLogs(fv, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(summaries), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	ping := summaries[logKey{"cam1", "ping"}]
+	if got, want := ping.ok, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ping.warn, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ping.latencies, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The single timeout at 40s is not an outage.
+	outages := ping.outages.finish()
+	if got, want := outages, []Interval{{From: start.Add(10 * time.Second), To: start.Add(30 * time.Second)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ping.uptime(outages), 0.6; got < want-0.001 || got > want+0.001 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	rtsp := summaries[logKey{"cam1", "rtsp"}]
+	if got, want := rtsp.outages.finish(), []Interval{{From: start.Add(60 * time.Second), To: start.Add(90 * time.Second)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	fv.Since = start.Add(45 * time.Second).Format(time.RFC3339)
+	var msgs []string
+	if err := readLogs(fv, func(r logRecord) {
+		if r.Name == "cam1" {
+			msgs = append(msgs, r.Mod+":"+r.Msg)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msgs, []string{"ping:ok", "rtsp:connected", "rtsp:playback ended", "rtsp:failed to connect", "rtsp:connected"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogFacilityLocal0 is the facility used for all records sent to
+// remote syslog servers.
+const syslogFacilityLocal0 = 16
+
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// formatSyslogMessage formats an RFC 5424 message, empty header fields
+// are replaced with the nil value "-".
+func formatSyslogMessage(pri int, when time.Time, hostname, app, procID, msgID, sd, msg string) []byte {
+	nilValue := func(v string) string {
+		if len(v) == 0 {
+			return "-"
+		}
+		return v
+	}
+	ts := "-"
+	if !when.IsZero() {
+		ts = when.Format(time.RFC3339Nano)
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %s %s %s %s", pri, ts, nilValue(hostname), nilValue(app), nilValue(procID), nilValue(msgID), nilValue(sd), strings.TrimSuffix(msg, "\n")))
+}
+
+// syslogWriter sends messages to a remote syslog server over udp, tcp
+// or tls, reconnecting as needed. Messages sent over tcp or tls are
+// framed using octet counting as per RFC 6587.
+type syslogWriter struct {
+	network, address string
+	tlsConfig        *tls.Config
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogWriter(network, address string, tlsConfig *tls.Config) (*syslogWriter, error) {
+	if len(network) == 0 {
+		network = "udp"
+	}
+	port := DefaultSyslogPort
+	switch network {
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+	case "tls":
+		port = DefaultSyslogTLSPort
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	if len(address) == 0 {
+		return nil, fmt.Errorf("missing syslog address")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(port))
+	}
+	if network == "tls" && tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return &syslogWriter{network: network, address: address, tlsConfig: tlsConfig}, nil
+}
+
+func (w *syslogWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if w.network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", w.address, w.tlsConfig)
+	}
+	return dialer.Dial(w.network, w.address)
+}
+
+func (w *syslogWriter) write(msg []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !strings.HasPrefix(w.network, "udp") {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			if w.conn, err = w.dial(); err != nil {
+				return err
+			}
+		}
+		if _, err = w.conn.Write(msg); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+func (w *syslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// syslogQueue sends messages to a remote syslog server from its own
+// goroutine so that logging is never delayed by a slow or unavailable
+// server, messages are dropped if the queue is full. Failures are
+// reported to stderr, once when sending first fails and once when it
+// recovers, since they cannot be logged via the sink itself.
+type syslogQueue struct {
+	w      *syslogWriter
+	ch     chan []byte
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	status io.Writer
+}
+
+func newSyslogQueue(w *syslogWriter) *syslogQueue {
+	q := &syslogQueue{
+		w:      w,
+		ch:     make(chan []byte, 1000),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		status: os.Stderr,
+	}
+	go q.run()
+	return q
+}
+
+func (q *syslogQueue) send(msg []byte) {
+	select {
+	case q.ch <- msg:
+	default:
+	}
+}
+
+func (q *syslogQueue) run() {
+	defer close(q.done)
+	failing := false
+	write := func(msg []byte) {
+		err := q.w.write(msg)
+		switch {
+		case err != nil && !failing:
+			fmt.Fprintf(q.status, "syslog log sink %v failed: %v\n", q.w.address, err)
+		case err == nil && failing:
+			fmt.Fprintf(q.status, "syslog log sink %v recovered\n", q.w.address)
+		}
+		failing = err != nil
+	}
+	for {
+		select {
+		case <-q.stop:
+			// Send any messages that are already queued.
+			for {
+				select {
+				case msg := <-q.ch:
+					write(msg)
+				default:
+					return
+				}
+			}
+		case msg := <-q.ch:
+			write(msg)
+		}
+	}
+}
+
+// Close sends any queued messages and closes the connection to the
+// server, messages logged after Close are discarded.
+func (q *syslogQueue) Close() error {
+	q.once.Do(func() { close(q.stop) })
+	<-q.done
+	return q.w.Close()
+}
+
+// syslogHandler is an slog.Handler that formats records using a json
+// or text handler and queues them to be sent to a remote syslog server
+// with a severity corresponding to the record's level.
+type syslogHandler struct {
+	q             *syslogQueue
+	hostname, tag string
+	mu            *sync.Mutex
+	buf           *bytes.Buffer
+	h             slog.Handler
+}
+
+func newSyslogHandler(q *syslogQueue, tag, format string, levels LogLevels) (*syslogHandler, error) {
+	buf := &bytes.Buffer{}
+	h, err := NewLogHandler(buf, format, levels)
+	if err != nil {
+		return nil, err
+	}
+	if len(tag) == 0 {
+		tag = "netmon"
+	}
+	hostname, _ := os.Hostname()
+	return &syslogHandler{q: q, hostname: hostname, tag: tag, mu: &sync.Mutex{}, buf: buf, h: h}, nil
+}
+
+func (s *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.h.Enabled(ctx, level)
+}
+
+func (s *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf.Reset()
+	if err := s.h.Handle(ctx, r); err != nil {
+		return err
+	}
+	pri := syslogFacilityLocal0*8 + syslogSeverity(r.Level)
+	s.q.send(formatSyslogMessage(pri, r.Time, s.hostname, s.tag, strconv.Itoa(os.Getpid()), "", "", s.buf.String()))
+	return nil
+}
+
+func (s *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *s
+	c.h = s.h.WithAttrs(attrs)
+	return &c
+}
+
+func (s *syslogHandler) WithGroup(name string) slog.Handler {
+	c := *s
+	c.h = s.h.WithGroup(name)
+	return &c
+}
+
+// String summarizes the sink, including its default format, level
+// and network.
+func (cfg LogSinkConfig) String() string {
+	format, level := cfg.Format, cfg.Level
+	if len(format) == 0 {
+		format = "json"
+		if cfg.Type == "stdout" || cfg.Type == "stderr" {
+			format = "text"
+		}
+	}
+	if len(level) == 0 {
+		level = "info"
+	}
+	switch cfg.Type {
+	case "file":
+		return fmt.Sprintf("file %s format %s level %s", cfg.Path, format, level)
+	case "syslog":
+		network := cfg.Network
+		if len(network) == 0 {
+			network = "udp"
+		}
+		return fmt.Sprintf("syslog %s://%s format %s level %s", network, cfg.Address, format, level)
+	}
+	return fmt.Sprintf("%s format %s level %s", cfg.Type, format, level)
+}
+
+// newLogSink creates the sink described by cfg, any files or network
+// connections it opens are appended to closers.
+func newLogSink(ctx context.Context, cfg LogSinkConfig, rotation LogRotation, closers *[]io.Closer) (LogSink, error) {
+	levels, err := ParseLogLevels(cfg.Level)
+	if err != nil {
+		return LogSink{}, err
+	}
+	var h slog.Handler
+	switch cfg.Type {
+	case "stdout", "stderr":
+		w := os.Stdout
+		if cfg.Type == "stderr" {
+			w = os.Stderr
+		}
+		format := cfg.Format
+		if len(format) == 0 {
+			format = "text"
+		}
+		h, err = NewLogHandler(w, format, levels)
+	case "file":
+		if len(cfg.Path) == 0 {
+			return LogSink{}, fmt.Errorf("file log sink: missing path")
+		}
+		var f io.WriteCloser
+		if f, err = newLogfile(cfg.Path, rotation); err != nil {
+			return LogSink{}, err
+		}
+		*closers = append(*closers, f)
+		if rf, ok := f.(*rotatingFile); ok {
+			go rf.reopenOnHangup(ctx)
+		}
+		h, err = NewLogHandler(f, cfg.Format, levels)
+	case "syslog":
+		var w *syslogWriter
+		if w, err = newSyslogWriter(cfg.Network, cfg.Address, nil); err != nil {
+			return LogSink{}, err
+		}
+		q := newSyslogQueue(w)
+		*closers = append(*closers, q)
+		h, err = newSyslogHandler(q, cfg.Tag, cfg.Format, levels)
+	default:
+		return LogSink{}, fmt.Errorf("unsupported log sink type %q", cfg.Type)
+	}
+	if err != nil {
+		return LogSink{}, err
+	}
+	return LogSink{Handler: h, Levels: levels}, nil
+}
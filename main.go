@@ -19,12 +19,37 @@ commands:
         summary: monitor devices according to the specified configuration files
         args:
           - <device>... - the devices to monitor, monitor all if none specified
+      - name: cgi
+        summary: run a cgi action defined for a device, eg. to reboot it or set its clock
+        args:
+          - <device> - the device to run the action on
+          - <action> - the name of the action to run
+  - name: history
+    summary: summarize the recorded uptime and latency history of a device
+    args:
+      - <device> - the device to summarize
+  - name: logs
+    summary: analyze the records in netmon log files and their rotated copies
+    commands:
+      - name: summary
+        summary: summarize probe results, uptime and ping latency per device and module
+      - name: outages
+        summary: list the outages reconstructed from ping timeouts and rtsp failures
+      - name: grep
+        summary: display the log records that match the specified device, module and time range
 `
 
 func cli() *subcmd.CommandSetYAML {
 	cmd := subcmd.MustFromYAML(cmdSpec)
 	dev := &Devices{}
 	cmd.Set("devices", "monitor").MustRunner(dev.Monitor, &DeviceMonitorFlags{})
+	cmd.Set("devices", "cgi").MustRunner(dev.CGI, &DeviceCGIFlags{})
+	hist := &History{}
+	cmd.Set("history").MustRunner(hist.Summarize, &HistoryFlags{})
+	logs := &Logs{}
+	cmd.Set("logs", "summary").MustRunner(logs.Summary, &LogsFlags{})
+	cmd.Set("logs", "outages").MustRunner(logs.Outages, &LogsOutagesFlags{})
+	cmd.Set("logs", "grep").MustRunner(logs.Grep, &LogsGrepFlags{})
 	return cmd
 }
 
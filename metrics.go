@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the histogram buckets, in seconds, used for
+// all latency metrics.
+var DefaultLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// lossWindow is the number of most recent pings used to calculate
+// the packet loss ratio.
+const lossWindow = 100
+
+type metricKind string
+
+const (
+	counterMetric   metricKind = "counter"
+	gaugeMetric     metricKind = "gauge"
+	histogramMetric metricKind = "histogram"
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type metricSeries struct {
+	labels string
+	value  float64
+	hist   *histogram
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   metricKind
+	series map[string]*metricSeries
+}
+
+// Metrics is an EventHandler that maintains per-device metrics derived
+// from the events published by the monitors and serves them in the
+// Prometheus text exposition format.
+type Metrics struct {
+	mu       sync.Mutex
+	devices  map[string]string
+	families map[string]*metricFamily
+	probes   map[string][]bool
+	lastPTS  map[string]time.Time
+	arpSize  map[string]int
+	routes   int
+	now      func() time.Time
+
+	rtspConnected map[string]bool
+}
+
+// NewMetrics creates a new Metrics instance for the supplied devices,
+// whose names and IP addresses are used as the device and ip labels.
+func NewMetrics(devices []Device) *Metrics {
+	m := &Metrics{
+		devices:  map[string]string{},
+		families: map[string]*metricFamily{},
+		probes:   map[string][]bool{},
+		lastPTS:  map[string]time.Time{},
+		arpSize:  map[string]int{},
+		now:      time.Now,
+
+		rtspConnected: map[string]bool{},
+	}
+	for _, d := range devices {
+		m.devices[d.Name] = d.IP
+	}
+	return m
+}
+
+func labelString(labels ...string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		out.WriteString(labels[i])
+		out.WriteString(`="`)
+		out.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		out.WriteByte('"')
+	}
+	out.WriteByte('}')
+	return out.String()
+}
+
+func (m *Metrics) deviceLabels(device string, labels ...string) []string {
+	return append([]string{"device", device, "ip", m.devices[device]}, labels...)
+}
+
+func (m *Metrics) series(name, help string, kind metricKind, labels []string) *metricSeries {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: kind, series: map[string]*metricSeries{}}
+		m.families[name] = f
+	}
+	ls := labelString(labels...)
+	s, ok := f.series[ls]
+	if !ok {
+		s = &metricSeries{labels: ls}
+		if kind == histogramMetric {
+			s.hist = &histogram{buckets: DefaultLatencyBuckets, counts: make([]uint64, len(DefaultLatencyBuckets))}
+		}
+		f.series[ls] = s
+	}
+	return s
+}
+
+func (m *Metrics) inc(name, help string, labels ...string) {
+	m.series(name, help, counterMetric, labels).value++
+}
+
+func (m *Metrics) set(name, help string, v float64, labels ...string) {
+	m.series(name, help, gaugeMetric, labels).value = v
+}
+
+func (m *Metrics) observe(name, help string, v float64, labels ...string) {
+	m.series(name, help, histogramMetric, labels).hist.observe(v)
+}
+
+func attrString(ev Event, key string) string {
+	v, ok := ev.Attr(key)
+	if !ok {
+		return ""
+	}
+	return v.String()
+}
+
+// HandleEvent implements EventHandler.
+func (m *Metrics) HandleEvent(ctx context.Context, ev Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch ev.Module {
+	case "ping":
+		m.handlePing(ev)
+	case "path":
+		m.handlePath(ev)
+	case "rtsp":
+		m.handleRTSP(ev)
+	case "cgi":
+		m.handleCGI(ev)
+	case "tcp":
+		m.handleTCP(ev)
+	case "dns":
+		m.handleDNS(ev)
+	case "tls":
+		m.handleTLS(ev)
+	case "arp":
+		m.handleARP(ev)
+	case "route":
+		m.handleRoute(ev)
+	case "syslog":
+		m.handleSyslog(ev)
+	}
+}
+
+func (m *Metrics) handlePing(ev Event) {
+	labels := m.deviceLabels(ev.Device)
+	var ok bool
+	switch ev.Kind {
+	case EventProbeOK:
+		ok = true
+		m.observe("netmon_ping_rtt_seconds", "ICMP echo round trip time.", ev.Latency.Seconds(), labels...)
+	case EventTimeout, EventProbeFailed:
+		m.inc("netmon_ping_lost_total", "ICMP echo requests that were not answered.", labels...)
+	default:
+		return
+	}
+	m.inc("netmon_ping_sent_total", "ICMP echo requests sent.", labels...)
+	probes := append(m.probes[ev.Device], ok)
+	if len(probes) > lossWindow {
+		probes = probes[len(probes)-lossWindow:]
+	}
+	m.probes[ev.Device] = probes
+	lost := 0
+	for _, p := range probes {
+		if !p {
+			lost++
+		}
+	}
+	m.set("netmon_ping_loss_ratio", fmt.Sprintf("ICMP packet loss ratio over the last %d pings.", lossWindow), float64(lost)/float64(len(probes)), labels...)
+}
+
+func (m *Metrics) handleRTSP(ev Event) {
+	labels := m.deviceLabels(ev.Device)
+	switch {
+	case ev.Kind == EventProbeOK:
+		m.lastPTS[ev.Device] = ev.When
+		if v, ok := ev.Attr("pts"); ok && v.Kind() == slog.KindDuration {
+			m.set("netmon_rtsp_pts_seconds", "Presentation timestamp of the most recently received RTSP packet.", v.Duration().Seconds(), labels...)
+		}
+	case ev.Message == "connected":
+		if m.rtspConnected[ev.Device] {
+			m.inc("netmon_rtsp_reconnects_total", "RTSP reconnections after the initial connection.", labels...)
+		}
+		m.rtspConnected[ev.Device] = true
+		m.set("netmon_rtsp_connected", "Whether the RTSP stream is connected.", 1, labels...)
+	case ev.Message == "playback ended" || ev.Message == "failed to connect":
+		m.inc("netmon_rtsp_failures_total", "RTSP connection failures and playback interruptions.", labels...)
+		m.set("netmon_rtsp_connected", "Whether the RTSP stream is connected.", 0, labels...)
+	case ev.Message == "track stopped":
+		m.inc("netmon_rtsp_track_stops_total", "RTSP tracks that stopped while others in the same session continued.", m.deviceLabels(ev.Device, "track", attrString(ev, "track"))...)
+	}
+}
+
+func (m *Metrics) handleCGI(ev Event) {
+	labels := m.deviceLabels(ev.Device, "url", attrString(ev, "url"))
+	switch ev.Kind {
+	case EventProbeOK:
+		m.observe("netmon_cgi_request_duration_seconds", "CGI request latency.", ev.Latency.Seconds(), labels...)
+		if v, ok := ev.Attr("status"); ok && v.Kind() == slog.KindInt64 {
+			m.set("netmon_cgi_http_status", "HTTP status code of the most recent CGI request.", float64(v.Int64()), labels...)
+		}
+	case EventTimeout, EventProbeFailed:
+		m.inc("netmon_cgi_failures_total", "CGI requests that failed or timed out.", labels...)
+	case EventStateChange:
+		m.inc("netmon_cgi_field_changes_total", "Changes in the fields parsed from CGI responses, including counter resets.", append(labels, "field", attrString(ev, "field"))...)
+	}
+}
+
+func (m *Metrics) handleTCP(ev Event) {
+	labels := m.deviceLabels(ev.Device, "port", attrString(ev, "port"))
+	switch ev.Kind {
+	case EventProbeOK:
+		m.observe("netmon_tcp_connect_duration_seconds", "TCP connect latency.", ev.Latency.Seconds(), labels...)
+	case EventTimeout, EventProbeFailed:
+		m.inc("netmon_tcp_failures_total", "TCP probes that were refused, reset, timed out or failed.", append(labels, "reason", ev.Message)...)
+	}
+}
+
+func (m *Metrics) handleDNS(ev Event) {
+	if ev.Kind == EventStateChange {
+		labels := m.deviceLabels(ev.Device)
+		m.inc("netmon_dns_address_changes_total", "Changes in the address that a device's hostname resolves to.", labels...)
+		m.devices[ev.Device] = attrString(ev, "ip")
+		return
+	}
+	labels := m.deviceLabels(ev.Device, "server", attrString(ev, "server"), "name", attrString(ev, "name"), "type", attrString(ev, "type"))
+	switch ev.Kind {
+	case EventProbeOK:
+		m.observe("netmon_dns_query_duration_seconds", "DNS query latency.", ev.Latency.Seconds(), labels...)
+	case EventTimeout, EventProbeFailed:
+		m.inc("netmon_dns_failures_total", "DNS queries that timed out, failed or returned unexpected answers.", append(labels, "reason", ev.Message)...)
+	}
+}
+
+func (m *Metrics) handleTLS(ev Event) {
+	labels := m.deviceLabels(ev.Device, "port", attrString(ev, "port"))
+	if v, ok := ev.Attr("remaining"); ok && v.Kind() == slog.KindDuration {
+		m.set("netmon_tls_certificate_expiry_seconds", "Time until the presented TLS certificate expires.", v.Duration().Seconds(), labels...)
+	}
+	switch ev.Kind {
+	case EventProbeOK:
+		m.observe("netmon_tls_handshake_duration_seconds", "TLS handshake latency.", ev.Latency.Seconds(), labels...)
+	case EventTimeout, EventProbeFailed:
+		m.inc("netmon_tls_failures_total", "TLS handshakes that failed or presented an expired certificate.", append(labels, "reason", ev.Message)...)
+	case EventStateChange:
+		m.inc("netmon_tls_certificate_changes_total", "Changes in the TLS certificate presented.", labels...)
+	}
+}
+
+func changeLabel(msg string) string {
+	switch {
+	case strings.HasPrefix(msg, "added"):
+		return "added"
+	case strings.HasPrefix(msg, "removed"):
+		return "removed"
+	case strings.HasPrefix(msg, "changed"):
+		return "changed"
+	}
+	return "state"
+}
+
+func (m *Metrics) handlePath(ev Event) {
+	if ev.Kind != EventStateChange {
+		return
+	}
+	m.inc("netmon_path_changes_total", "Changes to the network path to a device.", m.deviceLabels(ev.Device, "change", attrString(ev, "change"))...)
+}
+
+func (m *Metrics) handleARP(ev Event) {
+	if ev.Kind != EventStateChange {
+		return
+	}
+	change := changeLabel(ev.Message)
+	m.inc("netmon_arp_changes_total", "ARP table changes.", m.deviceLabels(ev.Device, "change", change)...)
+	iface := attrString(ev, "iface")
+	switch change {
+	case "added":
+		m.arpSize[iface]++
+	case "removed":
+		m.arpSize[iface]--
+	default:
+		return
+	}
+	m.set("netmon_arp_table_entries", "ARP table entries for monitored devices.", float64(m.arpSize[iface]), "iface", iface)
+}
+
+func (m *Metrics) handleRoute(ev Event) {
+	if ev.Kind != EventStateChange {
+		return
+	}
+	change := changeLabel(ev.Message)
+	m.inc("netmon_route_changes_total", "Routing table changes.", "change", change)
+	switch change {
+	case "added":
+		m.routes++
+	case "removed":
+		m.routes--
+	default:
+		return
+	}
+	m.set("netmon_route_table_entries", "Routing table entries for monitored devices.", float64(m.routes))
+}
+
+func (m *Metrics) handleSyslog(ev Event) {
+	if ev.Message != "received syslog" && ev.Message != "escalated syslog" {
+		return
+	}
+	if ev.Device == syslogUnknownDevice {
+		m.inc("netmon_syslog_unknown_messages_total", "Syslog messages received from senders that are not configured devices.", "sender", attrString(ev, "sender"))
+	}
+	host := attrString(ev, "hostname")
+	if len(host) == 0 {
+		host = attrString(ev, "client")
+	}
+	m.inc("netmon_syslog_messages_total", "Syslog messages received.", "host", host, "severity", attrString(ev, "severity"))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// withLabel adds a label to an existing, possibly empty, label string.
+func withLabel(labels, name, value string) string {
+	l := labelString(name, value)
+	if len(labels) == 0 {
+		return l
+	}
+	return labels[:len(labels)-1] + "," + l[1:]
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for device, last := range m.lastPTS {
+		m.set("netmon_rtsp_last_packet_age_seconds", "Time since an RTSP packet was last received.", now.Sub(last).Seconds(), m.deviceLabels(device)...)
+	}
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out strings.Builder
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(&out, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&out, "# TYPE %s %s\n", f.name, f.kind)
+		labels := make([]string, 0, len(f.series))
+		for l := range f.series {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			s := f.series[l]
+			if s.hist == nil {
+				fmt.Fprintf(&out, "%s%s %s\n", f.name, l, formatFloat(s.value))
+				continue
+			}
+			for i, b := range s.hist.buckets {
+				fmt.Fprintf(&out, "%s_bucket%s %d\n", f.name, withLabel(l, "le", formatFloat(b)), s.hist.counts[i])
+			}
+			fmt.Fprintf(&out, "%s_bucket%s %d\n", f.name, withLabel(l, "le", "+Inf"), s.hist.count)
+			fmt.Fprintf(&out, "%s_sum%s %s\n", f.name, l, formatFloat(s.hist.sum))
+			fmt.Fprintf(&out, "%s_count%s %d\n", f.name, l, s.hist.count)
+		}
+	}
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// runHTTPServer serves h on addr until ctx is canceled.
+func runHTTPServer(ctx context.Context, addr string, h http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:     h,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ctx.Err()
+}
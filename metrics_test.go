@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	m := NewMetrics([]Device{{Name: "cam1", IP: "10.0.0.1"}})
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	bus := NewEventBus()
+	bus.Subscribe(m.HandleEvent)
+
+	bus.Publish(ctx, Event{Device: "cam1", Module: "ping", Kind: EventProbeOK, Latency: 20 * time.Millisecond})
+	bus.Publish(ctx, Event{Device: "cam1", Module: "ping", Kind: EventTimeout})
+	bus.Publish(ctx, Event{Device: "cam1", Module: "rtsp", Kind: EventStateChange, Message: "connected"})
+	bus.Publish(ctx, Event{Device: "cam1", Module: "rtsp", Kind: EventStateChange, Message: "playback ended"})
+	bus.Publish(ctx, Event{Device: "cam1", Module: "rtsp", Kind: EventStateChange, Message: "connected"})
+	bus.Publish(ctx, Event{When: now.Add(-3 * time.Second), Device: "cam1", Module: "rtsp", Kind: EventProbeOK, Attrs: attrs(slog.Duration("pts", 10*time.Second))})
+	bus.Publish(ctx, Event{Device: "cam1", Module: "rtsp", Kind: EventStateChange, Message: "track stopped", Attrs: attrs("track", "audio/MPEG-4 Audio")})
+	bus.Publish(ctx, Event{Device: "cam1", Module: "arp", Kind: EventStateChange, Message: "added arp entry", Attrs: attrs("iface", "eth0")})
+	bus.Publish(ctx, Event{Module: "syslog", Message: "received syslog", Attrs: attrs("hostname", "cam1", "severity", 4)})
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, line := range []string{
+		`# TYPE netmon_ping_rtt_seconds histogram`,
+		`netmon_ping_rtt_seconds_bucket{device="cam1",ip="10.0.0.1",le="0.025"} 1`,
+		`netmon_ping_rtt_seconds_bucket{device="cam1",ip="10.0.0.1",le="+Inf"} 1`,
+		`netmon_ping_sent_total{device="cam1",ip="10.0.0.1"} 2`,
+		`netmon_ping_loss_ratio{device="cam1",ip="10.0.0.1"} 0.5`,
+		`netmon_rtsp_connected{device="cam1",ip="10.0.0.1"} 1`,
+		`netmon_rtsp_reconnects_total{device="cam1",ip="10.0.0.1"} 1`,
+		`netmon_rtsp_last_packet_age_seconds{device="cam1",ip="10.0.0.1"} 3`,
+		`netmon_rtsp_pts_seconds{device="cam1",ip="10.0.0.1"} 10`,
+		`netmon_rtsp_track_stops_total{device="cam1",ip="10.0.0.1",track="audio/MPEG-4 Audio"} 1`,
+		`netmon_arp_table_entries{iface="eth0"} 1`,
+		`netmon_syslog_messages_total{host="cam1",severity="4"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 func ParseIPAddr(s string) (netip.Addr, error) {
@@ -15,6 +17,66 @@ func ParseIPAddr(s string) (netip.Addr, error) {
 	return ip, nil
 }
 
+// isHostname returns true if s is syntactically a valid hostname.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// preferredAddr returns the first IPv4 address in addrs, or the first
+// address if there are no IPv4 addresses.
+func preferredAddr(addrs []netip.Addr) netip.Addr {
+	for _, a := range addrs {
+		if a.Unmap().Is4() {
+			return a.Unmap()
+		}
+	}
+	if len(addrs) == 0 {
+		return netip.Addr{}
+	}
+	return addrs[0]
+}
+
+// sharedAddr is the current address of a device whose IP is specified
+// as a hostname. It is shared by all of the device's monitors and updated
+// when the hostname is re-resolved, a nil sharedAddr never changes.
+type sharedAddr struct {
+	p atomic.Pointer[netip.Addr]
+}
+
+func newSharedAddr(addr netip.Addr) *sharedAddr {
+	s := &sharedAddr{}
+	s.store(addr)
+	return s
+}
+
+// load returns the current address, or addr if s is nil.
+func (s *sharedAddr) load(addr netip.Addr) netip.Addr {
+	if s == nil {
+		return addr
+	}
+	return *s.p.Load()
+}
+
+func (s *sharedAddr) store(addr netip.Addr) {
+	if s != nil {
+		s.p.Store(&addr)
+	}
+}
+
 var (
 	outboundOnce sync.Once
 	outboundV4   netip.Addr
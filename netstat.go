@@ -4,69 +4,92 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"log/slog"
 	"os/exec"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
+
+	"cloudeng.io/sync/errgroup"
 )
 
 type RouteMonitor struct {
-	l        *Logger
+	events   *EventBus
 	interval time.Duration
+	source   routeSource
 	devices  map[string]Device
 	mu       sync.Mutex
 	previous []routeEntry
 }
 
-func NewRouteMonitor(l *Logger, interval time.Duration) *RouteMonitor {
+func NewRouteMonitor(events *EventBus, interval time.Duration) *RouteMonitor {
+	if interval == 0 {
+		interval = DefaultRoutingInterval
+	}
 	return &RouteMonitor{
-		l:        l,
+		events:   events,
 		interval: interval,
 		devices:  make(map[string]Device),
 	}
 }
 
 func (m *RouteMonitor) log(ctx context.Context, format string, args ...any) {
-	m.l.Log(ctx, "route", format, args...)
+	m.events.Info(ctx, "route", "", format, args...)
 }
 
-func (m *RouteMonitor) warn(ctx context.Context, format string, args ...any) {
-	m.l.Warn(ctx, "route", format, args...)
+func (m *RouteMonitor) stateChange(ctx context.Context, level slog.Level, e routeEntry, format string, args ...any) {
+	m.events.Publish(ctx, Event{
+		Level:   level,
+		Module:  "route",
+		Kind:    EventStateChange,
+		Message: format,
+		Attrs:   attrs(append([]any{"dst", e.dst, "gw", e.gw, "flags", e.flags, "iface", e.iface, slog.Duration("exp", e.exp)}, args...)...),
+	})
 }
 
 func (m *RouteMonitor) MonitorAll(ctx context.Context, devs []Device) error {
 	for _, dev := range devs {
 		m.devices[dev.IP] = dev
 	}
-	for {
-		table, err := readRoutingTable(ctx, m.devices)
-		if err != nil {
-			return err
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(m.interval):
-		}
-		for _, e := range table {
-			if e.exp > 0 && e.exp < time.Second*30 {
-				m.log(ctx, "route expiring soon", "dst", e.dst, "gw", e.gw, "flags", e.flags, "iface", e.iface, "exp", e.exp.String())
-			}
-		}
-		added, removed, changed := compareRoutingTables(m.previous, table)
-		for _, e := range added {
-			m.log(ctx, "added route table entry", "dst", e.dst, "gw", e.gw, "flags", e.flags, "iface", e.iface, "exp", e.exp.String())
-		}
-		for _, e := range removed {
-			m.log(ctx, "removed route table entry", "dst", e.dst, "gw", e.gw, "flags", e.flags, "iface", e.iface, "exp", e.exp.String())
+	if m.source == nil {
+		m.source = newRouteSource(m.interval)
+	}
+	m.log(ctx, "using route source", "source", m.source.name())
+	ch := make(chan []routeEntry, 1)
+	var g errgroup.T
+	g.Go(func() error {
+		defer close(ch)
+		return m.source.run(ctx, m.devices, ch)
+	})
+	g.Go(func() error {
+		for table := range ch {
+			m.report(ctx, table)
 		}
-		for _, e := range changed {
-			m.warn(ctx, "changed route table entry", "dst", e.current.dst, "gw", e.current.gw, "flags", e.current.flags, "iface", "exp", e.current.exp.String(), e.current.iface, "previous_gw", e.previous.gw, "previous_flags", e.previous.flags, "previous_iface", e.previous.iface, "exp", e.previous.exp.String())
+		return nil
+	})
+	return g.Wait()
+}
+
+func (m *RouteMonitor) report(ctx context.Context, table []routeEntry) {
+	for _, e := range table {
+		if e.exp > 0 && e.exp < time.Second*30 {
+			m.log(ctx, "route expiring soon", "dst", e.dst, "gw", e.gw, "flags", e.flags, "iface", e.iface, slog.Duration("exp", e.exp))
 		}
-		m.mu.Lock()
-		m.previous = table
-		m.mu.Unlock()
+	}
+	m.mu.Lock()
+	previous := m.previous
+	m.previous = table
+	m.mu.Unlock()
+	added, removed, changed := compareRoutingTables(previous, table)
+	for _, e := range added {
+		m.stateChange(ctx, slog.LevelInfo, e, "added route table entry")
+	}
+	for _, e := range removed {
+		m.stateChange(ctx, slog.LevelInfo, e, "removed route table entry")
+	}
+	for _, e := range changed {
+		m.stateChange(ctx, slog.LevelWarn, e.current, "changed route table entry", "previous_gw", e.previous.gw, "previous_flags", e.previous.flags, "previous_iface", e.previous.iface, slog.Duration("previous_exp", e.previous.exp))
 	}
 }
 
@@ -115,6 +138,74 @@ type routeEntry struct {
 	exp   time.Duration
 }
 
+// routeSource is implemented by the various means of obtaining the
+// system's routing table. Polling sources send a snapshot of the table
+// every interval, event driven sources send a new snapshot as soon as
+// the table changes.
+type routeSource interface {
+	name() string
+	run(ctx context.Context, devices map[string]Device, ch chan<- []routeEntry) error
+}
+
+// platformRouteSource is a routeSource that may not be available on
+// all systems.
+type platformRouteSource interface {
+	routeSource
+	available() bool
+}
+
+// newRouteSource returns the first of the platform specific route
+// sources that is available at runtime, falling back to polling
+// 'netstat -rn'.
+func newRouteSource(interval time.Duration) routeSource {
+	for _, src := range platformRouteSources(interval) {
+		if src.available() {
+			return src
+		}
+	}
+	return routePoller{
+		label:    "netstat -rn",
+		interval: interval,
+		read:     readRoutingTable,
+	}
+}
+
+// routePoller is a routeSource that reads the routing table every
+// interval.
+type routePoller struct {
+	label    string
+	interval time.Duration
+	read     func(ctx context.Context, devices map[string]Device) ([]routeEntry, error)
+	check    func() bool
+}
+
+func (p routePoller) name() string {
+	return p.label
+}
+
+func (p routePoller) available() bool {
+	return p.check == nil || p.check()
+}
+
+func (p routePoller) run(ctx context.Context, devices map[string]Device, ch chan<- []routeEntry) error {
+	for {
+		table, err := p.read(ctx, devices)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch <- table:
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.interval):
+		}
+	}
+}
+
 var netstatRE = regexp.MustCompile(`(?P<dest>[0-9.]+|default)\s+(?P<gw>[0-9a-f:]+)\s+(?P<flags>\w+)\s+(?P<if>\w+)\s+(?P<exp>\d+)*`)
 
 func readRoutingTable(ctx context.Context, devices map[string]Device) (table []routeEntry, err error) {
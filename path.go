@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"cloudeng.io/sync/errgroup"
+)
+
+// pathProbeSpacing is the delay between successive requests sent when
+// tracing a path.
+const pathProbeSpacing = 10 * time.Millisecond
+
+// PathHop summarizes the responses received for the requests sent with
+// a single TTL. Addr is the address of the host that most frequently
+// responded and is invalid if there were no responses.
+type PathHop struct {
+	TTL      int           `json:"ttl"`
+	Addr     netip.Addr    `json:"addr"`
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	Loss     float64       `json:"loss"`
+	RTT      time.Duration `json:"rtt"`
+}
+
+func (h PathHop) String() string {
+	if !h.Addr.IsValid() {
+		return fmt.Sprintf("%d:*", h.TTL)
+	}
+	return fmt.Sprintf("%d:%v %v %.0f%%", h.TTL, h.Addr, h.RTT.Round(time.Microsecond), h.Loss*100)
+}
+
+// PathMonitor periodically traces the path to devices, in the manner of
+// traceroute/mtr, and publishes the changes in that path.
+type PathMonitor struct {
+	events *EventBus
+	mu     sync.Mutex
+	paths  map[string][]PathHop
+}
+
+func NewPathMonitor(events *EventBus) *PathMonitor {
+	return &PathMonitor{events: events, paths: map[string][]PathHop{}}
+}
+
+// Path returns the most recently traced path to the named device.
+func (m *PathMonitor) Path(device string) ([]PathHop, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hops, ok := m.paths[device]
+	return hops, ok
+}
+
+func (m *PathMonitor) publish(ctx context.Context, ev Event) {
+	ev.Module = "path"
+	m.events.Publish(ctx, ev)
+}
+
+func (m *PathMonitor) MonitorAll(ctx context.Context, devs []PathDevice) error {
+	var g errgroup.T
+	for _, dev := range devs {
+		g.Go(func() error {
+			return m.MonitorDevice(ctx, dev)
+		})
+	}
+	return g.Wait()
+}
+
+// target returns a target for dev and a function that releases it once
+// it is no longer needed.
+func (m *PathMonitor) target(ctx context.Context, dev PathDevice) (*icmpTarget, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	t, err := dedicatedICMPTarget(ctx, m.events, "path", dev.Name, dev.ipAddr, dev.MaxHops*dev.Probes, 0, false)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return t, cancel, nil
+}
+
+// MonitorDevice traces the path to the device until ctx is canceled,
+// traces are skipped until a device whose IP is a hostname has an
+// address.
+func (m *PathMonitor) MonitorDevice(ctx context.Context, dev PathDevice) error {
+	var t *icmpTarget
+	release := func() {}
+	if dev.ipAddr.IsValid() {
+		var err error
+		if t, release, err = m.target(ctx, dev); err != nil {
+			return fmt.Errorf("%v: %w", dev.Name, err)
+		}
+	}
+	defer func() { release() }()
+	seq := 0
+	for {
+		// Trace the path to the device's new address if its hostname
+		// now resolves to a different one, or has been resolved.
+		if next := dev.current(); next.ipAddr.IsValid() && (t == nil || next.ipAddr != dev.ipAddr) {
+			nt, nrelease, err := m.target(ctx, next)
+			if err != nil {
+				m.publish(ctx, Event{Level: slog.LevelError, Device: dev.Name, Kind: EventProbeFailed, Message: "address change failed", Err: err, Attrs: attrs("dst", next.ipAddr)})
+			} else {
+				release()
+				dev, t, release = next, nt, nrelease
+			}
+		}
+		if t == nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(dev.Interval):
+			}
+			continue
+		}
+		hops, reached, err := m.trace(ctx, dev, t, seq, setHopLimit)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		seq += dev.MaxHops * dev.Probes
+		// A failed trace says nothing about the path and so must not
+		// be reported as a change to it.
+		if err == nil {
+			m.update(ctx, dev, hops, reached)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dev.Interval):
+		}
+	}
+}
+
+type pathProbe struct {
+	ttl   int
+	start time.Time
+}
+
+type pathResponse struct {
+	addr netip.Addr
+	rtt  time.Duration
+}
+
+// trace sends dev.Probes requests with each TTL from 1 to dev.MaxHops and
+// collects the responses, either time exceeded errors from intermediate
+// hops or echo replies from the device itself, until dev.Timeout after
+// the last request is sent. It returns the hops up to the first that the
+// device replied from, or up to the last that responded if the device
+// did not reply. An error is returned if the trace could not be completed
+// because the TTL could not be set or ctx was canceled.
+func (m *PathMonitor) trace(ctx context.Context, dev PathDevice, t *icmpTarget, seq int, setTTL func(net.PacketConn, bool, int) error) ([]PathHop, bool, error) {
+	probes := map[int]pathProbe{}
+	responses := make([][]pathResponse, dev.MaxHops+1)
+	reachedAt := 0
+	handle := func(msg icmpEcho) {
+		p, ok := probes[msg.reply.Seq]
+		if !ok {
+			return
+		}
+		delete(probes, msg.reply.Seq)
+		if msg.err != nil && msg.err.redirect() {
+			return
+		}
+		responses[p.ttl] = append(responses[p.ttl], pathResponse{addr: peerAddr(msg.peer), rtt: msg.rtt(p.start)})
+		if msg.err == nil && (reachedAt == 0 || p.ttl < reachedAt) {
+			reachedAt = p.ttl
+		}
+	}
+	payload := icmpPayload(0)
+	// The timer is created stopped so that the first probe is also
+	// followed by pathProbeSpacing.
+	drain := time.NewTimer(pathProbeSpacing)
+	drain.Stop()
+	defer drain.Stop()
+	for ttl := 1; ttl <= dev.MaxHops && (reachedAt == 0 || ttl <= reachedAt); ttl++ {
+		if err := setTTL(t.conn, t.addr.Is6(), ttl); err != nil {
+			m.publish(ctx, Event{Level: slog.LevelError, Device: dev.Name, Kind: EventProbeFailed, Message: "failed", Err: err, Attrs: attrs("ttl", ttl)})
+			return nil, false, err
+		}
+		for i := 0; i < dev.Probes; i++ {
+			if err := t.send(seq, payload); err != nil {
+				m.publish(ctx, Event{Level: slog.LevelError, Device: dev.Name, Kind: EventProbeFailed, Message: "failed", Err: err, Attrs: attrs("dst", t.addr, "ttl", ttl)})
+			} else {
+				probes[seq&0xffff] = pathProbe{ttl: ttl, start: time.Now()}
+			}
+			seq++
+			drain.Reset(pathProbeSpacing)
+		wait:
+			for {
+				select {
+				case <-ctx.Done():
+					return nil, false, ctx.Err()
+				case msg := <-t.ch:
+					handle(msg)
+				case <-drain.C:
+					break wait
+				}
+			}
+		}
+	}
+	deadline := time.NewTimer(dev.Timeout)
+	defer deadline.Stop()
+	for len(probes) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case msg := <-t.ch:
+			handle(msg)
+		case <-deadline.C:
+			probes = nil
+		}
+	}
+	last := reachedAt
+	if last == 0 {
+		for ttl := dev.MaxHops; ttl > 0 && last == 0; ttl-- {
+			if len(responses[ttl]) > 0 {
+				last = ttl
+			}
+		}
+	}
+	hops := make([]PathHop, 0, last)
+	for ttl := 1; ttl <= last; ttl++ {
+		hops = append(hops, newPathHop(ttl, dev.Probes, responses[ttl]))
+	}
+	return hops, reachedAt > 0, nil
+}
+
+func newPathHop(ttl, sent int, responses []pathResponse) PathHop {
+	hop := PathHop{TTL: ttl, Sent: sent, Received: len(responses)}
+	counts := map[netip.Addr]int{}
+	var total time.Duration
+	for _, r := range responses {
+		counts[r.addr]++
+		if !hop.Addr.IsValid() || counts[r.addr] > counts[hop.Addr] {
+			hop.Addr = r.addr
+		}
+		total += r.rtt
+	}
+	if hop.Received > 0 {
+		hop.RTT = total / time.Duration(hop.Received)
+	}
+	if sent > 0 {
+		hop.Loss = float64(sent-min(hop.Received, sent)) / float64(sent)
+	}
+	return hop
+}
+
+// pathChange is a change to a single hop between successive traces.
+type pathChange struct {
+	msg       string
+	change    string
+	cur, prev PathHop
+}
+
+// pathChanges returns the hops that have been added, removed, changed
+// address or whose round trip time has changed by at least step.
+func pathChanges(prev, cur []PathHop, step time.Duration) []pathChange {
+	var changes []pathChange
+	for i := 0; i < max(len(prev), len(cur)); i++ {
+		var p, c PathHop
+		if i < len(prev) {
+			p = prev[i]
+		}
+		if i < len(cur) {
+			c = cur[i]
+		}
+		switch {
+		case p.Addr == c.Addr && !c.Addr.IsValid():
+		case !c.Addr.IsValid():
+			changes = append(changes, pathChange{msg: "removed hop", change: "removed", cur: c, prev: p})
+		case !p.Addr.IsValid():
+			changes = append(changes, pathChange{msg: "added hop", change: "added", cur: c, prev: p})
+		case p.Addr != c.Addr:
+			changes = append(changes, pathChange{msg: "changed hop", change: "changed", cur: c, prev: p})
+		case (c.RTT - p.RTT).Abs() >= step:
+			changes = append(changes, pathChange{msg: "changed latency", change: "latency", cur: c, prev: p})
+		}
+	}
+	return changes
+}
+
+func formatPath(hops []PathHop) string {
+	parts := make([]string, len(hops))
+	for i, h := range hops {
+		parts[i] = h.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// update records the latest trace and publishes it along with any
+// changes from the previous trace.
+func (m *PathMonitor) update(ctx context.Context, dev PathDevice, hops []PathHop, reached bool) {
+	m.mu.Lock()
+	prev, traced := m.paths[dev.Name]
+	m.paths[dev.Name] = hops
+	m.mu.Unlock()
+	level := slog.LevelInfo
+	if !reached {
+		level = slog.LevelWarn
+	}
+	m.publish(ctx, Event{
+		Level:   level,
+		Device:  dev.Name,
+		Kind:    EventInfo,
+		Message: "path",
+		Attrs:   attrs("dst", dev.ipAddr, "hops", len(hops), "reached", reached, "path", formatPath(hops)),
+	})
+	if !traced {
+		return
+	}
+	for _, c := range pathChanges(prev, hops, dev.LatencyStep) {
+		ttl := max(c.cur.TTL, c.prev.TTL)
+		m.publish(ctx, Event{
+			Level:   slog.LevelWarn,
+			Device:  dev.Name,
+			Kind:    EventStateChange,
+			Message: c.msg,
+			Attrs: attrs("change", c.change, "ttl", ttl,
+				"addr", c.cur.Addr, "prev_addr", c.prev.Addr,
+				slog.Duration("rtt", c.cur.RTT), slog.Duration("prev_rtt", c.prev.RTT)),
+		})
+	}
+}
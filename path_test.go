@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// pathTestConn simulates a path of routers, each of which responds to
+// requests whose TTL expires at it, ending at the device.
+type pathTestConn struct {
+	net.PacketConn
+	ch      chan icmpEcho
+	ttl     int
+	routers []string
+	drop    map[int]bool
+	sent    []time.Time
+	failTTL int
+}
+
+func (c *pathTestConn) setTTL(_ net.PacketConn, _ bool, ttl int) error {
+	if ttl == c.failTTL {
+		return errors.New("failed to set ttl")
+	}
+	c.ttl = ttl
+	return nil
+}
+
+func (c *pathTestConn) WriteTo(b []byte, dst net.Addr) (int, error) {
+	rm, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), b)
+	if err != nil {
+		return 0, err
+	}
+	echo := rm.Body.(*icmp.Echo)
+	c.sent = append(c.sent, time.Now())
+	if c.drop[echo.Seq] {
+		return len(b), nil
+	}
+	if c.ttl > len(c.routers) {
+		c.ch <- icmpEcho{reply: echo, peer: dst}
+		return len(b), nil
+	}
+	peer := &net.UDPAddr{IP: net.ParseIP(c.routers[c.ttl-1])}
+	c.ch <- icmpEcho{reply: echo, peer: peer, err: &icmpError{typ: ipv4.ICMPTypeTimeExceeded}}
+	return len(b), nil
+}
+
+func TestPathTrace(t *testing.T) {
+	ctx := context.Background()
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	m := NewPathMonitor(bus)
+	dev := PathDevice{Name: "cam1", MaxHops: 10, Probes: 2, Timeout: 20 * time.Millisecond, LatencyStep: time.Second, ipAddr: netip.MustParseAddr("10.0.0.1")}
+	ch := make(chan icmpEcho, dev.MaxHops*dev.Probes)
+	conn := &pathTestConn{ch: ch, routers: []string{"192.168.1.1", "100.64.0.1"}, drop: map[int]bool{2: true}}
+	target := &icmpTarget{conn: conn, addr: dev.ipAddr, dst: &net.UDPAddr{IP: dev.ipAddr.AsSlice()}, echoType: ipv4.ICMPTypeEcho, id: 1, ch: ch}
+
+	hops, reached, err := m.trace(ctx, dev, target, 0, conn.setTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reached {
+		t.Fatalf("device not reached")
+	}
+	var got []string
+	for _, h := range hops {
+		got = append(got, h.Addr.String())
+	}
+	if want := []string{"192.168.1.1", "100.64.0.1", "10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if hops[1].Loss != 0.5 || hops[0].Loss != 0 || hops[1].Received != 1 {
+		t.Errorf("unexpected hops: %v", hops)
+	}
+	m.update(ctx, dev, hops, reached)
+
+	// The second router is replaced and the device becomes unreachable.
+	conn.routers[1] = "100.64.0.2"
+	conn.drop = map[int]bool{}
+	for seq := 20; seq < 40; seq++ {
+		if seq >= 24 {
+			conn.drop[seq] = true
+		}
+	}
+	hops, reached, err = m.trace(ctx, dev, target, 20, conn.setTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reached || len(hops) != 2 {
+		t.Fatalf("unexpected result: %v %v", hops, reached)
+	}
+	received = nil
+	m.update(ctx, dev, hops, reached)
+	var msgs []string
+	for _, ev := range received {
+		msgs = append(msgs, ev.Message+" "+attrString(ev, "ttl"))
+	}
+	if want := []string{"path ", "changed hop 2", "removed hop 3"}; !reflect.DeepEqual(msgs, want) {
+		t.Errorf("got %v, want %v", msgs, want)
+	}
+	if path, _ := m.Path("cam1"); !reflect.DeepEqual(path, hops) {
+		t.Errorf("got %v, want %v", path, hops)
+	}
+
+	// Every request, including the first, is followed by the spacing.
+	for i := 1; i < len(conn.sent); i++ {
+		if gap := conn.sent[i].Sub(conn.sent[i-1]); gap < pathProbeSpacing {
+			t.Errorf("request %v: sent after %v, want at least %v", i, gap, pathProbeSpacing)
+		}
+	}
+
+	// A trace that fails is reported as an error rather than an empty
+	// path.
+	conn.failTTL = 2
+	received = nil
+	if _, _, err := m.trace(ctx, dev, target, 40, conn.setTTL); err == nil {
+		t.Errorf("expected an error")
+	}
+	if len(received) != 1 || received[0].Message != "failed" {
+		t.Errorf("unexpected events: %v", received)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	conn.failTTL = 0
+	if _, _, err := m.trace(cctx, dev, target, 60, conn.setTTL); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPathChanges(t *testing.T) {
+	hop := func(ttl int, addr string, rtt time.Duration) PathHop {
+		h := PathHop{TTL: ttl, RTT: rtt}
+		if len(addr) > 0 {
+			h.Addr = netip.MustParseAddr(addr)
+		}
+		return h
+	}
+	ms := time.Millisecond
+	prev := []PathHop{hop(1, "10.0.0.1", ms), hop(2, "", 0), hop(3, "10.0.2.1", 10*ms)}
+	cur := []PathHop{hop(1, "10.0.0.1", 30*ms), hop(2, "10.0.1.1", 5*ms), hop(3, "10.0.2.1", 70*ms), hop(4, "10.0.3.1", 80*ms)}
+	var got []string
+	for _, c := range pathChanges(prev, cur, 50*ms) {
+		got = append(got, c.change)
+	}
+	if want := []string{"added", "latency", "added"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got = nil
+	for _, c := range pathChanges(cur, prev[:1], 50*ms) {
+		got = append(got, c.change)
+	}
+	if want := []string{"removed", "removed", "removed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPathLoopback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := netip.MustParseAddr("127.0.0.1")
+	target, err := dedicatedICMPTarget(ctx, NewEventBus(), "path", "localhost", addr, 16, 0, false)
+	if err != nil {
+		t.Skipf("icmp sockets are not available: %v", err)
+	}
+	m := NewPathMonitor(NewEventBus())
+	dev := PathDevice{Name: "localhost", MaxHops: 5, Probes: 2, Timeout: time.Second, ipAddr: addr}
+	hops, reached, err := m.trace(ctx, dev, target, 0, setHopLimit)
+	if err != nil || !reached || len(hops) != 1 || hops[0].Addr != addr {
+		t.Errorf("unexpected result: %v %v %v", hops, reached, err)
+	}
+}
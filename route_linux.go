@@ -0,0 +1,212 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func platformRouteSources(interval time.Duration) []platformRouteSource {
+	return []platformRouteSource{
+		netlinkRoutes{},
+		routePoller{
+			label:    "/proc/net/route",
+			interval: interval,
+			read:     readProcRoutes,
+			check:    procRoutesAvailable,
+		},
+	}
+}
+
+// netlinkRoutes is an event driven routeSource that subscribes to
+// the RTNLGRP_IPV4_ROUTE and RTNLGRP_IPV6_ROUTE netlink groups and
+// sends a new snapshot of the routing table whenever a route is
+// added or removed.
+type netlinkRoutes struct{}
+
+func (netlinkRoutes) name() string {
+	return "netlink"
+}
+
+func (netlinkRoutes) available() bool {
+	f, err := subscribeRoutes()
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func subscribeRoutes() (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Using a non-blocking file allows for the read to be interrupted
+	// by closing the file.
+	return os.NewFile(uintptr(fd), "netlink-route"), nil
+}
+
+type netlinkRouteKey struct {
+	dst   netip.Prefix
+	table uint32
+	oif   uint32
+}
+
+func (netlinkRoutes) run(ctx context.Context, devices map[string]Device, ch chan<- []routeEntry) error {
+	f, err := subscribeRoutes()
+	if err != nil {
+		return fmt.Errorf("netlink route subscription: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	// Subscribe before dumping the current table so that no changes
+	// are missed.
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("netlink route dump: %w", err)
+	}
+	routes := map[netlinkRouteKey]routeEntry{}
+	if err := applyRouteMessages(rib, routes, devices); err != nil {
+		return err
+	}
+
+	send := func() error {
+		table := make([]routeEntry, 0, len(routes))
+		for _, e := range routes {
+			table = append(table, e)
+		}
+		sort.Slice(table, func(i, j int) bool { return table[i].dst < table[j].dst })
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch <- table:
+		}
+		return nil
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("netlink route subscription: %w", err)
+		}
+		if err := applyRouteMessages(buf[:n], routes, devices); err != nil {
+			return err
+		}
+		if err := send(); err != nil {
+			return err
+		}
+	}
+}
+
+func applyRouteMessages(buf []byte, routes map[netlinkRouteKey]routeEntry, devices map[string]Device) error {
+	msgs, err := syscall.ParseNetlinkMessage(buf)
+	if err != nil {
+		return fmt.Errorf("netlink route message: %w", err)
+	}
+	for i := range msgs {
+		msg := &msgs[i]
+		if msg.Header.Type != unix.RTM_NEWROUTE && msg.Header.Type != unix.RTM_DELROUTE {
+			continue
+		}
+		key, entry, ok := parseRouteMsg(msg)
+		if !ok {
+			continue
+		}
+		gw, _ := netip.ParseAddr(entry.gw)
+		if !routeForDevice(key.dst, gw, devices) {
+			continue
+		}
+		if msg.Header.Type == unix.RTM_DELROUTE {
+			delete(routes, key)
+			continue
+		}
+		routes[key] = entry
+	}
+	return nil
+}
+
+func parseRouteMsg(msg *syscall.NetlinkMessage) (netlinkRouteKey, routeEntry, bool) {
+	if len(msg.Data) < unix.SizeofRtMsg {
+		return netlinkRouteKey{}, routeEntry{}, false
+	}
+	rtm := (*unix.RtMsg)(unsafe.Pointer(&msg.Data[0]))
+	if rtm.Flags&unix.RTM_F_CLONED != 0 {
+		return netlinkRouteKey{}, routeEntry{}, false
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		return netlinkRouteKey{}, routeEntry{}, false
+	}
+	key := netlinkRouteKey{table: uint32(rtm.Table)}
+	var dst, gw netip.Addr
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case unix.RTA_DST:
+			dst, _ = netip.AddrFromSlice(a.Value)
+		case unix.RTA_GATEWAY:
+			gw, _ = netip.AddrFromSlice(a.Value)
+		case unix.RTA_OIF:
+			if len(a.Value) == 4 {
+				key.oif = binary.NativeEndian.Uint32(a.Value)
+			}
+		case unix.RTA_TABLE:
+			if len(a.Value) == 4 {
+				key.table = binary.NativeEndian.Uint32(a.Value)
+			}
+		}
+	}
+	if key.table != unix.RT_TABLE_MAIN {
+		return netlinkRouteKey{}, routeEntry{}, false
+	}
+	if !dst.IsValid() {
+		switch rtm.Family {
+		case unix.AF_INET:
+			dst = netip.IPv4Unspecified()
+		case unix.AF_INET6:
+			dst = netip.IPv6Unspecified()
+		default:
+			return netlinkRouteKey{}, routeEntry{}, false
+		}
+	}
+	key.dst = netip.PrefixFrom(dst, int(rtm.Dst_len))
+	entry := routeEntry{
+		dst:   key.dst.String(),
+		flags: routeFlags(true, gw.IsValid(), int(rtm.Dst_len) == dst.BitLen()),
+	}
+	if gw.IsValid() {
+		entry.gw = gw.String()
+	}
+	if ifc, err := net.InterfaceByIndex(int(key.oif)); err == nil {
+		entry.iface = ifc.Name
+	}
+	return key, entry, true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+func platformRouteSources(interval time.Duration) []platformRouteSource {
+	return nil
+}
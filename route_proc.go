@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	rtfUp      = 0x0001 // RTF_UP
+	rtfGateway = 0x0002 // RTF_GATEWAY
+	rtfHost    = 0x0004 // RTF_HOST
+	rtfLocal   = 0x80000000
+)
+
+// routeFlags returns a netstat style summary of a route's flags.
+func routeFlags(up, gateway, host bool) string {
+	var out strings.Builder
+	if up {
+		out.WriteByte('U')
+	}
+	if gateway {
+		out.WriteByte('G')
+	}
+	if host {
+		out.WriteByte('H')
+	}
+	return out.String()
+}
+
+// routeForDevice returns true if the route is relevant to any of the
+// specified devices, ie. the device is reachable via the route or
+// is the route's gateway.
+func routeForDevice(dst netip.Prefix, gw netip.Addr, devices map[string]Device) bool {
+	for _, d := range devices {
+		if !d.ipAddr.IsValid() {
+			continue
+		}
+		if dst.Contains(d.ipAddr) || gw == d.ipAddr {
+			return true
+		}
+	}
+	return false
+}
+
+func readProcRoutes(ctx context.Context, devices map[string]Device) ([]routeEntry, error) {
+	var table []routeEntry
+	for _, p := range []struct {
+		filename string
+		parse    func(io.Reader, map[string]Device) ([]routeEntry, error)
+	}{
+		{"/proc/net/route", parseProcRoute},
+		{"/proc/net/ipv6_route", parseProcIPv6Route},
+	} {
+		f, err := os.Open(p.filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		entries, err := p.parse(f, devices)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", p.filename, err)
+		}
+		table = append(table, entries...)
+	}
+	return table, nil
+}
+
+func procRoutesAvailable() bool {
+	_, err := os.Stat("/proc/net/route")
+	return err == nil
+}
+
+// parseProcRoute parses the contents of /proc/net/route, ie:
+//
+//	Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+//	eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+//
+// The addresses are in host byte order.
+func parseProcRoute(rd io.Reader, devices map[string]Device) (table []routeEntry, err error) {
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 8 || fields[0] == "Iface" {
+			continue
+		}
+		dst, err1 := procRouteAddr4(fields[1])
+		gw, err2 := procRouteAddr4(fields[2])
+		flags, err3 := strconv.ParseUint(fields[3], 16, 32)
+		mask, err4 := strconv.ParseUint(fields[7], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		prefix := netip.PrefixFrom(dst, bits.OnesCount32(uint32(mask)))
+		if !routeForDevice(prefix, gw, devices) {
+			continue
+		}
+		entry := routeEntry{
+			dst:   prefix.String(),
+			flags: routeFlags(flags&rtfUp != 0, flags&rtfGateway != 0, flags&rtfHost != 0),
+			iface: fields[0],
+		}
+		if !gw.IsUnspecified() {
+			entry.gw = gw.String()
+		}
+		table = append(table, entry)
+	}
+	return table, sc.Err()
+}
+
+func procRouteAddr4(s string) (netip.Addr, error) {
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], uint32(v))
+	return netip.AddrFrom4(b), nil
+}
+
+// parseProcIPv6Route parses the contents of /proc/net/ipv6_route, ie:
+//
+//	<dst> <dst-len> <src> <src-len> <next-hop> <metric> <refcnt> <use> <flags> <iface>
+//
+// where the addresses are 32 hex digits in network byte order.
+func parseProcIPv6Route(rd io.Reader, devices map[string]Device) (table []routeEntry, err error) {
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 10 {
+			continue
+		}
+		dst, err1 := procRouteAddr6(fields[0])
+		plen, err2 := strconv.ParseUint(fields[1], 16, 8)
+		gw, err3 := procRouteAddr6(fields[4])
+		flags, err4 := strconv.ParseUint(fields[8], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		if flags&rtfLocal != 0 {
+			continue
+		}
+		prefix := netip.PrefixFrom(dst, int(plen))
+		if !routeForDevice(prefix, gw, devices) {
+			continue
+		}
+		entry := routeEntry{
+			dst:   prefix.String(),
+			flags: routeFlags(flags&rtfUp != 0, flags&rtfGateway != 0, plen == 128),
+			iface: fields[9],
+		}
+		if !gw.IsUnspecified() {
+			entry.gw = gw.String()
+		}
+		table = append(table, entry)
+	}
+	return table, sc.Err()
+}
+
+func procRouteAddr6(s string) (netip.Addr, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok || !addr.Is6() {
+		return netip.Addr{}, fmt.Errorf("invalid IPv6 address: %q", s)
+	}
+	return addr, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProcRoutes(t *testing.T) {
+	devices := map[string]Device{
+		"192.168.1.20": {Name: "camera", IP: "192.168.1.20", ipAddr: netip.MustParseAddr("192.168.1.20")},
+		"fd00::20":     {Name: "camera6", IP: "fd00::20", ipAddr: netip.MustParseAddr("fd00::20")},
+	}
+
+	v4 := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth1	0000000A	00000000	0001	0	0	100	000000FF	0	0	0
+`
+	table, err := parseProcRoute(strings.NewReader(v4), devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := table, []routeEntry{
+		{dst: "0.0.0.0/0", gw: "192.168.1.1", flags: "UG", iface: "eth0"},
+		{dst: "192.168.1.0/24", flags: "U", iface: "eth0"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	v6 := `fd000000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+20010db8000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+fd000000000000000000000000000020 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000002 00000000 80200001       lo
+`
+	table, err = parseProcIPv6Route(strings.NewReader(v6), devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := table, []routeEntry{
+		{dst: "fd00::/64", flags: "U", iface: "eth0"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
 	"time"
 
 	"cloudeng.io/sync/errgroup"
@@ -12,23 +15,48 @@ import (
 	"github.com/bluenviron/gortsplib/v4/pkg/format"
 	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
 	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph265"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpmjpeg"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpmpeg4audio"
 	"github.com/pion/rtp"
 )
 
 type RTSPMonitor struct {
-	l *Logger
+	events *EventBus
 }
 
-func NewRTSPMonitor(l *Logger) *RTSPMonitor {
-	return &RTSPMonitor{l: l}
+func NewRTSPMonitor(events *EventBus) *RTSPMonitor {
+	return &RTSPMonitor{events: events}
 }
 
-func (m *RTSPMonitor) log(ctx context.Context, format string, args ...any) {
-	m.l.Log(ctx, "rtsp", format, args...)
+func (m *RTSPMonitor) publish(ctx context.Context, level slog.Level, kind EventKind, dev RTSPDevice, msg string, err error, args ...any) {
+	m.events.Publish(ctx, Event{
+		Level:   level,
+		Device:  dev.Name,
+		Module:  "rtsp",
+		Kind:    kind,
+		Message: msg,
+		Err:     err,
+		Attrs:   attrs(append(rtspAttrs(dev), args...)...),
+	})
+}
+
+func rtspAttrs(dev RTSPDevice) []any {
+	if len(dev.Media) == 0 {
+		return []any{"url", dev.SafeURL}
+	}
+	return []any{"url", dev.SafeURL, "media", dev.Media}
+}
+
+func (m *RTSPMonitor) debug(ctx context.Context, dev RTSPDevice, msg string, err error, args ...any) {
+	m.publish(ctx, slog.LevelDebug, EventInfo, dev, msg, err, args...)
+}
+
+func (m *RTSPMonitor) log(ctx context.Context, kind EventKind, dev RTSPDevice, msg string, args ...any) {
+	m.publish(ctx, slog.LevelInfo, kind, dev, msg, nil, args...)
 }
 
-func (m *RTSPMonitor) warn(ctx context.Context, format string, args ...any) {
-	m.l.Warn(ctx, "rtsp", format, args...)
+func (m *RTSPMonitor) warn(ctx context.Context, kind EventKind, dev RTSPDevice, msg string, err error, args ...any) {
+	m.publish(ctx, slog.LevelWarn, kind, dev, msg, err, args...)
 }
 
 func (m *RTSPMonitor) MonitorAll(ctx context.Context, devs []RTSPDevice) error {
@@ -43,10 +71,20 @@ func (m *RTSPMonitor) MonitorAll(ctx context.Context, devs []RTSPDevice) error {
 
 func (m *RTSPMonitor) MonitorDevice(ctx context.Context, dev RTSPDevice) error {
 	for {
-		m.log(ctx, "connecting", "name", dev.Name, "url", dev.SafeURL, "media", dev.Media)
+		dev = dev.current()
+		if !dev.ipAddr.IsValid() {
+			// The device's hostname has yet to be resolved.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(dev.Interval):
+			}
+			continue
+		}
+		m.log(ctx, EventInfo, dev, "connecting")
 		stream, err := m.connect(ctx, dev)
 		if err != nil {
-			m.warn(ctx, "failed to connect", "name", dev.Name, "url", dev.SafeURL, "media", dev.Media, "err", err)
+			m.warn(ctx, EventProbeFailed, dev, "failed to connect", err)
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
@@ -54,9 +92,9 @@ func (m *RTSPMonitor) MonitorDevice(ctx context.Context, dev RTSPDevice) error {
 			}
 			continue
 		}
-		m.log(ctx, "connected", "name", dev.Name, "url", dev.SafeURL, "media", dev.Media)
+		m.log(ctx, EventStateChange, dev, "connected", "tracks", stream.trackNames())
 		if err := stream.sink(ctx, time.Second*10); err != nil {
-			m.warn(ctx, "playback ended", "name", dev.Name, "url", dev.SafeURL, "media", dev.Media, "err", err)
+			m.warn(ctx, EventStateChange, dev, "playback ended", err)
 		}
 		stream.close()
 		select {
@@ -67,17 +105,211 @@ func (m *RTSPMonitor) MonitorDevice(ctx context.Context, dev RTSPDevice) error {
 	}
 }
 
+// rtspMediaName returns the canonical name of a supported media
+// configuration value.
+func rtspMediaName(media string) (string, error) {
+	switch strings.ToUpper(media) {
+	case "H264":
+		return "H264", nil
+	case "H265":
+		return "H265", nil
+	case "MJPEG":
+		return "MJPEG", nil
+	case "MPEG4AUDIO", "AAC":
+		return "MPEG4Audio", nil
+	case "OPUS":
+		return "Opus", nil
+	case "G711":
+		return "G711", nil
+	case "MPEGTS":
+		return "MPEGTS", nil
+	}
+	return "", fmt.Errorf("unsupported rtsp media %q, must be one of H264, H265, MJPEG, MPEG4Audio (or AAC), Opus, G711 or MPEGTS", media)
+}
+
+// rtspFormatMedia returns the media configuration value that selects
+// the specified format, or an empty string if it cannot be selected.
+func rtspFormatMedia(f format.Format) string {
+	switch f.(type) {
+	case *format.H264:
+		return "H264"
+	case *format.H265:
+		return "H265"
+	case *format.MJPEG:
+		return "MJPEG"
+	case *format.MPEG4Audio:
+		return "MPEG4Audio"
+	case *format.Opus:
+		return "Opus"
+	case *format.G711:
+		return "G711"
+	case *format.MPEGTS:
+		return "MPEGTS"
+	}
+	return ""
+}
+
+// rtspTrack is a media from the session description that is set up and
+// monitored.
+type rtspTrack struct {
+	name    string // eg. video/H264.
+	media   *description.Media
+	formats []format.Format
+}
+
+// rtspTracks returns the tracks to be set up for the device, either the
+// first media that contains the device's format or, for AllTracks, every
+// audio and video media in the session description. Other media, such as
+// ONVIF metadata, are only sent when there is something to report and so
+// cannot be monitored for liveness.
+func rtspTracks(desc *description.Session, dev RTSPDevice) ([]rtspTrack, error) {
+	var tracks []rtspTrack
+	found := len(dev.Media) == 0
+	names := map[string]int{}
+	for _, media := range desc.Medias {
+		if dev.AllTracks && media.Type != description.MediaTypeVideo && media.Type != description.MediaTypeAudio {
+			continue
+		}
+		track := rtspTrack{media: media}
+		for _, f := range media.Formats {
+			if rtspFormatMedia(f) == dev.Media {
+				found = true
+				if !dev.AllTracks {
+					track.formats = []format.Format{f}
+					break
+				}
+			}
+			if dev.AllTracks {
+				track.formats = append(track.formats, f)
+			}
+		}
+		if len(track.formats) == 0 {
+			continue
+		}
+		track.name = fmt.Sprintf("%s/%s", media.Type, track.formats[0].Codec())
+		if names[track.name]++; names[track.name] > 1 {
+			track.name = fmt.Sprintf("%s#%d", track.name, names[track.name])
+		}
+		tracks = append(tracks, track)
+		if !dev.AllTracks {
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s not supported", dev.Media)
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("no tracks found")
+	}
+	return tracks, nil
+}
+
+// rtspDecoder decodes a packet, it returns an error only for packets
+// that are invalid, rather than those that require further packets
+// before they can be decoded.
+type rtspDecoder func(pkt *rtp.Packet) error
+
+// newRTSPDecoder returns a decoder for the specified format, formats
+// that are not supported are monitored without being decoded.
+func newRTSPDecoder(f format.Format) (rtspDecoder, error) {
+	ignore := func(err error, expected ...error) error {
+		for _, e := range expected {
+			if errors.Is(err, e) {
+				return nil
+			}
+		}
+		return err
+	}
+	switch f := f.(type) {
+	case *format.H264:
+		d, err := f.CreateDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *rtp.Packet) error {
+			_, err := d.Decode(pkt)
+			return ignore(err, rtph264.ErrNonStartingPacketAndNoPrevious, rtph264.ErrMorePacketsNeeded)
+		}, nil
+	case *format.H265:
+		d, err := f.CreateDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *rtp.Packet) error {
+			_, err := d.Decode(pkt)
+			return ignore(err, rtph265.ErrNonStartingPacketAndNoPrevious, rtph265.ErrMorePacketsNeeded)
+		}, nil
+	case *format.MJPEG:
+		d, err := f.CreateDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *rtp.Packet) error {
+			_, err := d.Decode(pkt)
+			return ignore(err, rtpmjpeg.ErrNonStartingPacketAndNoPrevious, rtpmjpeg.ErrMorePacketsNeeded)
+		}, nil
+	case *format.MPEG4Audio:
+		d, err := f.CreateDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *rtp.Packet) error {
+			_, err := d.Decode(pkt)
+			return ignore(err, rtpmpeg4audio.ErrMorePacketsNeeded)
+		}, nil
+	case *format.Opus:
+		d, err := f.CreateDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *rtp.Packet) error {
+			_, err := d.Decode(pkt)
+			return err
+		}, nil
+	case *format.G711:
+		d, err := f.CreateDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return func(pkt *rtp.Packet) error {
+			_, err := d.Decode(pkt)
+			return err
+		}, nil
+	case *format.MPEGTS:
+		return decodeMPEGTS, nil
+	}
+	return func(*rtp.Packet) error { return nil }, nil
+}
+
+// decodeMPEGTS checks that the payload consists of whole transport
+// stream packets.
+func decodeMPEGTS(pkt *rtp.Packet) error {
+	const size = 188
+	if len(pkt.Payload) == 0 || len(pkt.Payload)%size != 0 {
+		return fmt.Errorf("payload of %d bytes is not a multiple of %d", len(pkt.Payload), size)
+	}
+	for i := 0; i < len(pkt.Payload); i += size {
+		if pkt.Payload[i] != 0x47 {
+			return fmt.Errorf("missing sync byte at offset %d", i)
+		}
+	}
+	return nil
+}
+
+type rtspPacket struct {
+	track int
+	pts   time.Duration
+}
+
 type rtspStream struct {
-	m      *RTSPMonitor
-	client *gortsplib.Client
-	decode func(ctx context.Context, decode func(pkt *rtp.Packet) ([][]byte, error), pkt *rtp.Packet) error
-	media  *description.Media
-	format format.Format
-	dev    RTSPDevice
-	pktPTS chan time.Duration
+	m       *RTSPMonitor
+	client  *gortsplib.Client
+	tracks  []rtspTrack
+	dev     RTSPDevice
+	packets chan rtspPacket
 }
 
-func (m *RTSPMonitor) connect(ctx context.Context, dev RTSPDevice) (*rtspStream, error) {
+func (m *RTSPMonitor) connect(ctx context.Context, dev RTSPDevice) (_ *rtspStream, err error) {
 	c := &gortsplib.Client{}
 
 	u, err := base.ParseURL(dev.URL)
@@ -89,101 +321,126 @@ func (m *RTSPMonitor) connect(ctx context.Context, dev RTSPDevice) (*rtspStream,
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
 
 	desc, _, err := c.Describe(u)
 	if err != nil {
 		return nil, err
 	}
 
+	tracks, err := rtspTracks(desc, dev)
+	if err != nil {
+		return nil, err
+	}
+
 	stream := &rtspStream{
-		m:      m,
-		client: c,
-		dev:    dev,
-		pktPTS: make(chan time.Duration, 1000),
+		m:       m,
+		client:  c,
+		tracks:  tracks,
+		dev:     dev,
+		packets: make(chan rtspPacket, 1000),
 	}
 
-	var decodePkt func(pkt *rtp.Packet) ([][]byte, error)
-	if dev.Media == "" || dev.Media == "H264" {
-		h264 := &format.H264{}
-		media := desc.FindFormat(&h264)
-		if media == nil {
-			return nil, fmt.Errorf("H264 not supported")
-		}
-		decoder, err := h264.CreateDecoder()
+	for i, track := range tracks {
+		_, err = c.Setup(desc.BaseURL, track.media, 0, 0)
 		if err != nil {
-			return nil, err
-		}
-		stream.decode = stream.h264Decode
-		stream.media = media
-		stream.format = h264
-		decodePkt = decoder.Decode
-	}
-	if dev.Media == "H265" {
-		h265 := &format.H265{}
-		media := desc.FindFormat(&h265)
-		if media == nil {
-			return nil, fmt.Errorf("H265 not supported")
+			return nil, fmt.Errorf("setup failed: %v: %v", track.name, err)
 		}
-		decoder, err := h265.CreateDecoder()
-		if err != nil {
-			return nil, err
+		for _, f := range track.formats {
+			decode, err := newRTSPDecoder(f)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", track.name, err)
+			}
+			// called when a RTP packet arrives
+			c.OnPacketRTP(track.media, f, func(pkt *rtp.Packet) {
+				stream.callback(ctx, i, decode, pkt)
+			})
 		}
-		stream.decode = stream.h265Decode
-		stream.media = media
-		stream.format = h265
-		decodePkt = decoder.Decode
 	}
 
-	_, err = c.Setup(desc.BaseURL, stream.media, 0, 0)
-	if err != nil {
-		return nil, fmt.Errorf("setup failed: %v", err)
-	}
-
-	// called when a RTP packet arrives
-	c.OnPacketRTP(stream.media, stream.format, func(pkt *rtp.Packet) {
-		stream.callback(ctx, decodePkt, pkt)
-	})
-
 	return stream, nil
 }
 
-func (s *rtspStream) h264Decode(ctx context.Context, decode func(*rtp.Packet) ([][]byte, error), pkt *rtp.Packet) error {
-	_, err := decode(pkt)
-	if err != nil {
-		if err != rtph264.ErrNonStartingPacketAndNoPrevious && err != rtph264.ErrMorePacketsNeeded {
-			s.m.warn(ctx, "H264 packet decoder error", "name", s.dev.Name, "url", s.dev.SafeURL, "err", err)
-			return err
-		}
+func (s *rtspStream) trackNames() string {
+	names := make([]string, len(s.tracks))
+	for i, t := range s.tracks {
+		names[i] = t.name
 	}
-	return nil
+	return strings.Join(names, ",")
 }
 
-func (s *rtspStream) h265Decode(ctx context.Context, decode func(*rtp.Packet) ([][]byte, error), pkt *rtp.Packet) error {
-	_, err := decode(pkt)
-	if err != nil {
-		if err != rtph265.ErrNonStartingPacketAndNoPrevious && err != rtph265.ErrMorePacketsNeeded {
-			s.m.warn(ctx, "H265 packet decoder error", "name", s.dev.Name, "url", s.dev.SafeURL, "err", err)
-			return err
-		}
-	}
-	return nil
-}
-
-func (s *rtspStream) callback(ctx context.Context, decode func(*rtp.Packet) ([][]byte, error), pkt *rtp.Packet) {
-	ntp, ok := s.client.PacketPTS(s.media, pkt)
+func (s *rtspStream) callback(ctx context.Context, track int, decode rtspDecoder, pkt *rtp.Packet) {
+	name := s.tracks[track].name
+	pts, ok := s.client.PacketPTS(s.tracks[track].media, pkt)
 	if !ok {
-		s.m.warn(ctx, "waiting for timestamp", "name", s.dev.Name, "url", s.dev.SafeURL)
+		s.m.debug(ctx, s.dev, "waiting for timestamp", nil, "track", name, "seq", pkt.SequenceNumber)
 		return
 	}
-	s.decode(ctx, decode, pkt)
+	if err := decode(pkt); err != nil {
+		s.m.debug(ctx, s.dev, "packet decoder error", err, "track", name, "seq", pkt.SequenceNumber)
+	}
 	select {
-	case s.pktPTS <- ntp:
+	case s.packets <- rtspPacket{track: track, pts: pts}:
 	case <-ctx.Done():
 		return
 	default:
 	}
 }
 
+// rtspLiveness records when packets were last received on each track.
+type rtspLiveness struct {
+	timeout time.Duration
+	any     time.Time
+	last    []time.Time
+	stopped []bool
+}
+
+func newRTSPLiveness(tracks int, timeout time.Duration, now time.Time) *rtspLiveness {
+	l := &rtspLiveness{
+		timeout: timeout,
+		any:     now,
+		last:    make([]time.Time, tracks),
+		stopped: make([]bool, tracks),
+	}
+	for i := range l.last {
+		l.last[i] = now
+	}
+	return l
+}
+
+// packet records a packet for the track and reports whether the track
+// had previously been reported as stopped.
+func (l *rtspLiveness) packet(track int, now time.Time) bool {
+	l.any, l.last[track] = now, now
+	resumed := l.stopped[track]
+	l.stopped[track] = false
+	return resumed
+}
+
+// check returns the tracks that have stopped since the previous check
+// and an error if no packets have been received on any track within the
+// timeout. A single track is only ever reported via the error.
+func (l *rtspLiveness) check(now time.Time) ([]int, error) {
+	if now.Sub(l.any) > l.timeout {
+		return nil, fmt.Errorf("timeout after %s", l.timeout)
+	}
+	if len(l.last) < 2 {
+		return nil, nil
+	}
+	var stopped []int
+	for i, last := range l.last {
+		if !l.stopped[i] && now.Sub(last) > l.timeout {
+			l.stopped[i] = true
+			stopped = append(stopped, i)
+		}
+	}
+	return stopped, nil
+}
+
 func (s *rtspStream) sink(ctx context.Context, progressDurationSecs time.Duration) error {
 	resp, err := s.client.Play(nil)
 	if err != nil {
@@ -192,23 +449,35 @@ func (s *rtspStream) sink(ctx context.Context, progressDurationSecs time.Duratio
 	if resp.StatusCode != base.StatusOK {
 		return fmt.Errorf("play failed: waiting for timestamp: %v", resp.StatusMessage)
 	}
+	live := newRTSPLiveness(len(s.tracks), s.dev.Timeout, time.Now())
+	ticker := time.NewTicker(max(s.dev.Timeout/4, time.Millisecond))
+	defer ticker.Stop()
 	last := 0 * time.Second
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case pts := <-s.pktPTS:
-			if n := pts.Round(progressDurationSecs); n > last {
+		case pkt := <-s.packets:
+			if live.packet(pkt.track, time.Now()) {
+				s.m.log(ctx, EventStateChange, s.dev, "track resumed", "track", s.tracks[pkt.track].name)
+			}
+			if n := pkt.pts.Round(progressDurationSecs); n > last {
 				last = n
-				s.m.log(ctx, "ok", "name", s.dev.Name, "url", s.dev.SafeURL, "pts", pts.String())
+				s.m.log(ctx, EventProbeOK, s.dev, "ok", slog.Duration("pts", pkt.pts))
+			}
+		case now := <-ticker.C:
+			stopped, err := live.check(now)
+			for _, i := range stopped {
+				s.m.warn(ctx, EventStateChange, s.dev, "track stopped", nil, "track", s.tracks[i].name, slog.Duration("timeout", s.dev.Timeout))
+			}
+			if err != nil {
+				return err
 			}
-		case <-time.After(s.dev.Timeout):
-			return fmt.Errorf("timeout after %s", s.dev.Timeout)
 		}
 	}
 }
 
 func (s *rtspStream) close() {
 	s.client.Close()
-	close(s.pktPTS)
+	close(s.packets)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/pion/rtp"
+)
+
+func TestRTSPMedia(t *testing.T) {
+	for _, tc := range []struct {
+		media, want string
+	}{
+		{"H264", "H264"},
+		{"h265", "H265"},
+		{"aac", "MPEG4Audio"},
+		{"MPEG4Audio", "MPEG4Audio"},
+		{"opus", "Opus"},
+		{"G711", "G711"},
+		{"mjpeg", "MJPEG"},
+		{"MPEGTS", "MPEGTS"},
+	} {
+		got, err := rtspMediaName(tc.media)
+		if err != nil {
+			t.Errorf("%v: %v", tc.media, err)
+		}
+		if got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.media, got, tc.want)
+		}
+	}
+	for _, media := range []string{"", "H266", "VP8"} {
+		if _, err := rtspMediaName(media); err == nil {
+			t.Errorf("%v: expected an error", media)
+		}
+	}
+}
+
+func TestRTSPTracks(t *testing.T) {
+	desc := &description.Session{Medias: []*description.Media{
+		{Type: description.MediaTypeVideo, Formats: []format.Format{&format.H264{PayloadTyp: 96, PacketizationMode: 1}}},
+		{Type: description.MediaTypeAudio, Formats: []format.Format{&format.MPEG4Audio{PayloadTyp: 97}}},
+		{Type: description.MediaTypeAudio, Formats: []format.Format{&format.G711{PayloadTyp: 0, MULaw: true, SampleRate: 8000, ChannelCount: 1}}},
+		{Type: description.MediaTypeApplication, Formats: []format.Format{&format.Generic{PayloadTyp: 107, RTPMa: "vnd.onvif.metadata/90000"}}},
+	}}
+	for i, tc := range []struct {
+		dev  RTSPDevice
+		want []string
+	}{
+		{RTSPDevice{Media: "H264"}, []string{"video/H264"}},
+		{RTSPDevice{Media: "MPEG4Audio"}, []string{"audio/MPEG-4 Audio"}},
+		{RTSPDevice{Media: "G711"}, []string{"audio/G711"}},
+		{RTSPDevice{AllTracks: true}, []string{"video/H264", "audio/MPEG-4 Audio", "audio/G711"}},
+		{RTSPDevice{AllTracks: true, Media: "G711"}, []string{"video/H264", "audio/MPEG-4 Audio", "audio/G711"}},
+	} {
+		tracks, err := rtspTracks(desc, tc.dev)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		var got []string
+		for _, track := range tracks {
+			got = append(got, track.name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+	for _, dev := range []RTSPDevice{{Media: "H265"}, {Media: "MJPEG", AllTracks: true}} {
+		if _, err := rtspTracks(desc, dev); err == nil {
+			t.Errorf("%v: expected an error", dev.Media)
+		}
+	}
+	for _, media := range desc.Medias {
+		for _, f := range media.Formats {
+			if _, err := newRTSPDecoder(f); err != nil {
+				t.Errorf("%v: %v", f.Codec(), err)
+			}
+		}
+	}
+}
+
+func TestRTSPMPEGTS(t *testing.T) {
+	ts := make([]byte, 2*188)
+	ts[0], ts[188] = 0x47, 0x47
+	if err := decodeMPEGTS(&rtp.Packet{Payload: ts}); err != nil {
+		t.Error(err)
+	}
+	ts[188] = 0
+	if err := decodeMPEGTS(&rtp.Packet{Payload: ts}); err == nil {
+		t.Errorf("expected an error")
+	}
+	if err := decodeMPEGTS(&rtp.Packet{Payload: ts[:100]}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestRTSPLiveness(t *testing.T) {
+	start := time.Now()
+	at := func(secs int) time.Time { return start.Add(time.Duration(secs) * time.Second) }
+	l := newRTSPLiveness(2, 5*time.Second, start)
+
+	// The audio track, 1, stops while video continues.
+	l.packet(1, at(1))
+	for s := 1; s <= 6; s++ {
+		l.packet(0, at(s))
+		if stopped, err := l.check(at(s)); err != nil || len(stopped) != 0 {
+			t.Errorf("%v: got %v, %v", s, stopped, err)
+		}
+	}
+	l.packet(0, at(7))
+	if stopped, err := l.check(at(7)); err != nil || !reflect.DeepEqual(stopped, []int{1}) {
+		t.Errorf("got %v, %v", stopped, err)
+	}
+	// A stopped track is only reported once.
+	if stopped, err := l.check(at(7)); err != nil || len(stopped) != 0 {
+		t.Errorf("got %v, %v", stopped, err)
+	}
+	if resumed := l.packet(1, at(8)); !resumed {
+		t.Errorf("expected track to have resumed")
+	}
+	if resumed := l.packet(1, at(9)); resumed {
+		t.Errorf("unexpected resumption")
+	}
+	// Neither track receives packets.
+	if _, err := l.check(at(15)); err == nil {
+		t.Errorf("expected a timeout")
+	}
+
+	// A single track is only reported via a timeout.
+	l = newRTSPLiveness(1, 5*time.Second, start)
+	if stopped, err := l.check(at(5)); err != nil || len(stopped) != 0 {
+		t.Errorf("got %v, %v", stopped, err)
+	}
+	if _, err := l.check(at(6)); err == nil {
+		t.Errorf("expected a timeout")
+	}
+}
@@ -2,29 +2,132 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 )
 
-// Logger provides structured logging.
+// Logger provides structured logging of the events published by
+// the monitors to one or more sinks.
 type Logger struct {
-	l *slog.Logger
+	sinks []LogSink
 }
 
 type logMod string
 
-func NewLogger(file io.Writer, opts *slog.HandlerOptions) (*Logger, error) {
-	return &Logger{
-		l: slog.New(slog.NewJSONHandler(file, opts)),
-	}, nil
+// LogLevels specifies the minimum level of the events to be logged,
+// with optional per-module overrides.
+type LogLevels struct {
+	Default slog.Level
+	Modules map[logMod]slog.Level
 }
 
-func (l *Logger) Log(ctx context.Context, module logMod, format string, args ...any) {
-	args = append([]any{"mod", module}, args...)
-	l.l.Log(ctx, slog.LevelInfo, format, args...)
+// ParseLogLevels parses a comma separated list of a default level and/or
+// per-module levels, eg. "warn", "rtsp=debug,ping=warn" or
+// "error,rtsp=debug". The default level is info if not specified.
+func ParseLogLevels(spec string) (LogLevels, error) {
+	levels := LogLevels{Default: slog.LevelInfo}
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		mod, lvl, ok := strings.Cut(s, "=")
+		if !ok {
+			lvl = mod
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(lvl)); err != nil {
+			return LogLevels{}, fmt.Errorf("invalid log level %q: %v", s, err)
+		}
+		if !ok {
+			levels.Default = level
+			continue
+		}
+		if levels.Modules == nil {
+			levels.Modules = map[logMod]slog.Level{}
+		}
+		levels.Modules[logMod(mod)] = level
+	}
+	return levels, nil
 }
 
-func (l *Logger) Warn(ctx context.Context, module logMod, format string, args ...any) {
-	args = append([]any{"mod", module}, args...)
-	l.l.Log(ctx, slog.LevelWarn, format, args...)
+// Level returns the minimum level to be logged for the specified module.
+func (l LogLevels) Level(module logMod) slog.Level {
+	if lvl, ok := l.Modules[module]; ok {
+		return lvl
+	}
+	return l.Default
+}
+
+func (l LogLevels) minimum() slog.Level {
+	lowest := l.Default
+	for _, lvl := range l.Modules {
+		if lvl < lowest {
+			lowest = lvl
+		}
+	}
+	return lowest
+}
+
+// LogSink is a destination for log records, such as a file, the console
+// or a remote syslog server, along with the levels to be logged to it.
+type LogSink struct {
+	Handler slog.Handler
+	Levels  LogLevels
+}
+
+// NewLogHandler returns a json or text slog.Handler that writes to w
+// and is enabled for all of the specified levels.
+func NewLogHandler(w io.Writer, format string, levels LogLevels) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: levels.minimum()}
+	switch format {
+	case "", "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unsupported log format %q", format)
+}
+
+func NewLogger(sinks ...LogSink) *Logger {
+	return &Logger{sinks: sinks}
+}
+
+// HandleEvent is an EventHandler that logs the event, the device,
+// kind, latency and error are logged as the "name", "kind", "took"
+// and "err" attributes respectively.
+func (l *Logger) HandleEvent(ctx context.Context, ev Event) {
+	var r slog.Record
+	created := false
+	for _, s := range l.sinks {
+		if ev.Level < s.Levels.Level(ev.Module) || !s.Handler.Enabled(ctx, ev.Level) {
+			continue
+		}
+		if !created {
+			r = newEventRecord(ev)
+			created = true
+		}
+		s.Handler.Handle(ctx, r)
+	}
+}
+
+func newEventRecord(ev Event) slog.Record {
+	r := slog.NewRecord(ev.When, ev.Level, ev.Message, 0)
+	r.AddAttrs(slog.String("mod", string(ev.Module)))
+	if len(ev.Device) > 0 {
+		r.AddAttrs(slog.String("name", ev.Device))
+	}
+	if ev.Kind != EventInfo && len(ev.Kind) > 0 {
+		r.AddAttrs(slog.String("kind", string(ev.Kind)))
+	}
+	r.AddAttrs(ev.Attrs...)
+	if ev.Latency > 0 {
+		r.AddAttrs(slog.Duration("took", ev.Latency))
+	}
+	if ev.Err != nil {
+		r.AddAttrs(slog.String("err", ev.Err.Error()))
+	}
+	return r
 }
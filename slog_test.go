@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want LogLevels
+	}{
+		{"", LogLevels{Default: slog.LevelInfo}},
+		{"debug", LogLevels{Default: slog.LevelDebug}},
+		{"rtsp=debug,ping=warn", LogLevels{Default: slog.LevelInfo, Modules: map[logMod]slog.Level{"rtsp": slog.LevelDebug, "ping": slog.LevelWarn}}},
+		{"error, rtsp=DEBUG", LogLevels{Default: slog.LevelError, Modules: map[logMod]slog.Level{"rtsp": slog.LevelDebug}}},
+	} {
+		got, err := ParseLogLevels(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+	for _, spec := range []string{"verbose", "rtsp=loud"} {
+		if _, err := ParseLogLevels(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestLoggerSinks(t *testing.T) {
+	ctx := context.Background()
+	var jsonOut, textOut bytes.Buffer
+	jsonLevels, _ := ParseLogLevels("warn,rtsp=debug")
+	textLevels, _ := ParseLogLevels("info,ping=error")
+	jh, _ := NewLogHandler(&jsonOut, "json", jsonLevels)
+	th, _ := NewLogHandler(&textOut, "text", textLevels)
+	l := NewLogger(LogSink{Handler: jh, Levels: jsonLevels}, LogSink{Handler: th, Levels: textLevels})
+	bus := NewEventBus()
+	bus.Subscribe(l.HandleEvent)
+
+	bus.Debug(ctx, "rtsp", "cam1", "decoder error")
+	bus.Info(ctx, "rtsp", "cam1", "connected")
+	bus.Warn(ctx, "ping", "cam1", "timeout")
+	bus.Debug(ctx, "ping", "cam1", "sent")
+	bus.Error(ctx, "ping", "cam1", "failed")
+
+	lines := func(out string) []string {
+		return strings.Split(strings.TrimSpace(out), "\n")
+	}
+	jsonLines, textLines := lines(jsonOut.String()), lines(textOut.String())
+	if got, want := len(jsonLines), 4; got != want {
+		t.Fatalf("got %v, want %v: %s", got, want, jsonOut.String())
+	}
+	for i, msg := range []string{"decoder error", "connected", "timeout", "failed"} {
+		if !strings.Contains(jsonLines[i], `"msg":"`+msg+`"`) {
+			t.Errorf("%v: %v does not contain %v", i, jsonLines[i], msg)
+		}
+	}
+	if got, want := len(textLines), 2; got != want {
+		t.Fatalf("got %v, want %v: %s", got, want, textOut.String())
+	}
+	for i, msg := range []string{"msg=connected", "msg=failed"} {
+		if !strings.Contains(textLines[i], msg) {
+			t.Errorf("%v: %v does not contain %v", i, textLines[i], msg)
+		}
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	ctx := context.Background()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var closers []io.Closer
+	sink, err := newLogSink(ctx, LogSinkConfig{Type: "syslog", Address: pc.LocalAddr().String(), Level: "warn"}, LogRotation{}, &closers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closers[0].Close()
+	l := NewLogger(sink)
+	l.HandleEvent(ctx, Event{When: time.Now(), Level: slog.LevelInfo, Module: "ping", Device: "cam1", Message: "ok"})
+	l.HandleEvent(ctx, Event{When: time.Now(), Level: slog.LevelError, Module: "ping", Device: "cam1", Message: "failed"})
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<131>1 ") || !strings.Contains(msg, " netmon ") || !strings.Contains(msg, `"msg":"failed"`) {
+		t.Errorf("unexpected syslog message: %v", msg)
+	}
+}
+
+func TestSyslogSinkUnavailable(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	w, err := newSyslogWriter("tcp", addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newSyslogQueue(w)
+	status := &strings.Builder{}
+	q.status = status
+	h, err := newSyslogHandler(q, "", "json", LogLevels{Default: slog.LevelInfo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLogger(LogSink{Handler: h, Levels: LogLevels{Default: slog.LevelInfo}})
+	for i := 0; i < 3; i++ {
+		l.HandleEvent(ctx, Event{When: time.Now(), Level: slog.LevelError, Module: "ping", Device: "cam1", Message: "failed"})
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(status.String()), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "syslog log sink "+addr+" failed") {
+		t.Errorf("unexpected status: %q", status.String())
+	}
+}
+
+func TestLogSinkString(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  LogSinkConfig
+		want string
+	}{
+		{LogSinkConfig{Type: "stderr"}, "stderr format text level info"},
+		{LogSinkConfig{Type: "file", Path: "/var/log/netmon.log", Level: "warn,rtsp=debug"}, "file /var/log/netmon.log format json level warn,rtsp=debug"},
+		{LogSinkConfig{Type: "syslog", Address: "10.0.0.2", Format: "text"}, "syslog udp://10.0.0.2 format text level info"},
+		{LogSinkConfig{Type: "syslog", Network: "tls", Address: "logs:6514"}, "syslog tls://logs:6514 format json level info"},
+	} {
+		if got := tc.cfg.String(); got != tc.want {
+			t.Errorf("got %v, want %v", got, tc.want)
+		}
+	}
+}
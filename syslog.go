@@ -2,62 +2,299 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	"cloudeng.io/sync/errgroup"
 	"gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
 )
 
+// syslogUnknownDevice is the device name used for messages from
+// senders that are not configured devices.
+const syslogUnknownDevice = "unknown"
+
 type syslogServer struct {
-	l *Logger
+	events     *EventBus
+	devices    []*SyslogDevice
+	byIP       map[string]*SyslogDevice
+	byHostname map[string]*SyslogDevice
+	unknown    map[string]int
+	archive    *syslogArchive
+	relays     []*syslogRelay
+	now        func() time.Time
+}
+
+func newSyslogServer(events *EventBus, devices []SyslogDevice) *syslogServer {
+	s := &syslogServer{
+		events:     events,
+		byIP:       map[string]*SyslogDevice{},
+		byHostname: map[string]*SyslogDevice{},
+		unknown:    map[string]int{},
+		now:        time.Now,
+	}
+	for i := range devices {
+		d := &devices[i]
+		s.devices = append(s.devices, d)
+		if len(d.IP) > 0 {
+			s.byIP[d.IP] = d
+		}
+		for _, h := range d.Hostnames {
+			s.byHostname[strings.ToLower(h)] = d
+		}
+	}
+	return s
+}
+
+// forwardTo configures the archive directory and relays that all
+// messages that are not dropped are forwarded to.
+func (s *syslogServer) forwardTo(archiveDir string, relays []SyslogRelayConfig) error {
+	if len(archiveDir) > 0 {
+		s.archive = newSyslogArchive(archiveDir)
+	}
+	for i, cfg := range relays {
+		r, err := newSyslogRelay(cfg)
+		if err != nil {
+			return fmt.Errorf("syslog relay %d: %w", i, err)
+		}
+		s.relays = append(s.relays, r)
+	}
+	return nil
 }
 
-func newSyslogServer(l *Logger) *syslogServer {
-	return &syslogServer{l: l}
+func (s *syslogServer) forward(ctx context.Context, device string, parts format.LogParts) {
+	received := s.now()
+	if s.archive != nil {
+		if err := s.archive.write(device, received, syslogParts(parts)); err != nil {
+			s.events.Error(ctx, "syslog", device, "archive failed", "err", err)
+		}
+	}
+	for _, r := range s.relays {
+		r.relay(received, syslogParts(parts))
+	}
 }
 
 func (s *syslogServer) log(ctx context.Context, format string, args []any) {
-	s.l.Log(ctx, "syslog", format, args...)
+	s.events.Info(ctx, "syslog", "", format, args...)
 }
 
 func kv(parts format.LogParts) []any {
-	var res []any
-	for k, v := range parts {
-		res = append(res, k, v)
+	keys := make([]string, 0, len(parts))
+	for k := range parts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]any, 0, len(parts)*2)
+	for _, k := range keys {
+		res = append(res, k, parts[k])
 	}
 	return res
 }
 
-func (s *syslogServer) run(ctx context.Context) error {
-	channel := make(syslog.LogPartsChannel)
-	handler := syslog.NewChannelHandler(channel)
+func syslogClientIP(parts format.LogParts) string {
+	client, _ := parts["client"].(string)
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if addr, err := netip.ParseAddr(client); err == nil {
+		return addr.Unmap().String()
+	}
+	return client
+}
 
+// updateAddrs re-indexes any devices whose hostname has been resolved
+// to a new address.
+func (s *syslogServer) updateAddrs() {
+	for _, d := range s.devices {
+		addr := d.addr.load(netip.Addr{})
+		if !addr.IsValid() || addr.String() == d.IP {
+			continue
+		}
+		if s.byIP[d.IP] == d {
+			delete(s.byIP, d.IP)
+		}
+		d.IP = addr.String()
+		s.byIP[d.IP] = d
+	}
+}
+
+// device returns the configured device that sent the message, matching
+// first by its current source IP address and then by hostname.
+func (s *syslogServer) device(parts format.LogParts) *SyslogDevice {
+	s.updateAddrs()
+	if d, ok := s.byIP[syslogClientIP(parts)]; ok {
+		return d
+	}
+	if hostname, ok := parts["hostname"].(string); ok {
+		return s.byHostname[strings.ToLower(hostname)]
+	}
+	return nil
+}
+
+func syslogContent(parts format.LogParts) string {
+	if c, ok := parts["content"].(string); ok {
+		return c
+	}
+	m, _ := parts["message"].(string)
+	return m
+}
+
+func (r SyslogRule) matches(parts format.LogParts) bool {
+	if len(r.Facilities) > 0 {
+		if f, ok := parts["facility"].(int); !ok || !r.Facilities[f] {
+			return false
+		}
+	}
+	if r.Severity >= 0 {
+		if sev, ok := parts["severity"].(int); !ok || sev > r.Severity {
+			return false
+		}
+	}
+	return r.Match == nil || r.Match.MatchString(syslogContent(parts))
+}
+
+func (d *SyslogDevice) action(parts format.LogParts) SyslogAction {
+	for _, r := range d.Rules {
+		if r.matches(parts) {
+			return r.Action
+		}
+	}
+	return SyslogKeep
+}
+
+func (s *syslogServer) handle(ctx context.Context, parts format.LogParts) {
+	ev := Event{Level: slog.LevelInfo, Module: "syslog", Kind: EventInfo, Message: "received syslog"}
+	d := s.device(parts)
+	if d == nil {
+		client := syslogClientIP(parts)
+		s.unknown[client]++
+		ev.Device = syslogUnknownDevice
+		ev.Attrs = attrs(append(kv(parts), "sender", client, "unknown_count", s.unknown[client])...)
+		s.events.Publish(ctx, ev)
+		s.forward(ctx, syslogUnknownDevice, parts)
+		return
+	}
+	switch d.action(parts) {
+	case SyslogDrop:
+		return
+	case SyslogEscalate:
+		ev.Level = slog.LevelWarn
+		ev.Message = "escalated syslog"
+	}
+	ev.Device = d.Name
+	ev.Attrs = attrs(kv(parts)...)
+	s.events.Publish(ctx, ev)
+	s.forward(ctx, d.Name, parts)
+}
+
+func syslogFormat(name string) format.Format {
+	switch name {
+	case "rfc3164":
+		return syslog.RFC3164
+	case "rfc5424":
+		return syslog.RFC5424
+	case "rfc6587":
+		return syslog.RFC6587
+	}
+	return syslog.Automatic
+}
+
+// listen creates a server for the specified listener, a separate server
+// is required for each listener since the format is per-server.
+func (s *syslogServer) listen(l SyslogListenerConfig, handler syslog.Handler) (*syslog.Server, error) {
 	server := syslog.NewServer()
-	server.SetFormat(syslog.RFC3164) // How to support other formats?
+	server.SetFormat(syslogFormat(l.Format))
 	server.SetHandler(handler)
-	server.ListenUDP("0.0.0.0:514")
-	server.Boot()
-
-	var g errgroup.T
-
-	g.Go(func() error {
-		for {
-			select {
-			case logParts, ok := <-channel:
-				if !ok {
-					return nil
-				}
-				s.log(ctx, "received syslog", kv(logParts))
-			case <-ctx.Done():
-				server.Kill()
-				close(channel)
-				return ctx.Err()
-			}
-		}
-	})
-	g.Go(func() error {
-		server.Wait()
-		return nil
-	})
-	return g.Wait()
+	var err error
+	switch l.Network {
+	case "udp":
+		err = server.ListenUDP(l.Address)
+	case "tcp":
+		err = server.ListenTCP(l.Address)
+	case "tls":
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+		if err != nil {
+			break
+		}
+		err = server.ListenTCPTLS(l.Address, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+	default:
+		err = fmt.Errorf("unsupported network %q", l.Network)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := server.Boot(); err != nil {
+		server.Kill()
+		return nil, err
+	}
+	return server, nil
+}
+
+func (s *syslogServer) run(ctx context.Context, listeners []SyslogListenerConfig) error {
+	channel := make(syslog.LogPartsChannel, 100)
+	handler := syslog.NewChannelHandler(channel)
+
+	servers := make([]*syslog.Server, 0, len(listeners))
+	kill := func() {
+		for _, server := range servers {
+			server.Kill()
+		}
+	}
+	for _, l := range listeners {
+		server, err := s.listen(l, handler)
+		if err != nil {
+			kill()
+			return fmt.Errorf("syslog listener %v %v: %w", l.Network, l.Address, err)
+		}
+		servers = append(servers, server)
+		s.log(ctx, "listening", []any{"network", l.Network, "address", l.Address, "format", l.Format})
+	}
+
+	if s.archive != nil {
+		defer s.archive.Close()
+	}
+	relayCtx, cancelRelays := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, r := range s.relays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.run(relayCtx, s.events)
+		}()
+	}
+	defer wg.Wait()
+	defer cancelRelays()
+
+	stopped := make(chan struct{})
+	go func() {
+		for _, server := range servers {
+			server.Wait()
+		}
+		close(stopped)
+	}()
+
+	// Keep draining the channel until the servers have stopped so
+	// that none of them block on delivering a message.
+	done := ctx.Done()
+	for {
+		select {
+		case logParts := <-channel:
+			s.handle(ctx, logParts)
+		case <-done:
+			kill()
+			done = nil
+		case <-stopped:
+			return ctx.Err()
+		}
+	}
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// syslogParts provides typed access to the fields of a received
+// message, which differ between RFC 3164 and RFC 5424.
+type syslogParts format.LogParts
+
+func (p syslogParts) str(keys ...string) string {
+	for _, k := range keys {
+		if v, ok := p[k].(string); ok && len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+func (p syslogParts) num(key string) (int, bool) {
+	v, ok := p[key].(int)
+	return v, ok
+}
+
+func (p syslogParts) timestamp(received time.Time) time.Time {
+	if t, ok := p["timestamp"].(time.Time); ok && !t.IsZero() {
+		return t
+	}
+	return received
+}
+
+func (p syslogParts) priority() int {
+	if pri, ok := p.num("priority"); ok {
+		return pri
+	}
+	facility, _ := p.num("facility")
+	severity, _ := p.num("severity")
+	return facility*8 + severity
+}
+
+func (p syslogParts) hostname() string {
+	if h := p.str("hostname"); len(h) > 0 {
+		return h
+	}
+	return syslogClientIP(format.LogParts(p))
+}
+
+// syslogArchive writes the messages received from each device to a
+// plain text file per device per day, ie. <dir>/<device>/2006-01-02.log.
+type syslogArchive struct {
+	dir   string
+	files map[string]*archiveFile
+}
+
+type archiveFile struct {
+	day string
+	f   *os.File
+}
+
+func newSyslogArchive(dir string) *syslogArchive {
+	return &syslogArchive{dir: dir, files: map[string]*archiveFile{}}
+}
+
+func (a *syslogArchive) file(device string, received time.Time) (*os.File, error) {
+	day := received.Format(time.DateOnly)
+	af, ok := a.files[device]
+	if ok && af.day == day {
+		return af.f, nil
+	}
+	if ok {
+		af.f.Close()
+		delete(a.files, device)
+	}
+	dir := filepath.Join(a.dir, strings.ReplaceAll(device, string(filepath.Separator), "_"))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, day+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a.files[device] = &archiveFile{day: day, f: f}
+	return f, nil
+}
+
+// write appends the message in the traditional syslog file format,
+// ie. <timestamp> <hostname> <app>[<pid>]: <content>.
+func (a *syslogArchive) write(device string, received time.Time, parts syslogParts) error {
+	f, err := a.file(device, received)
+	if err != nil {
+		return err
+	}
+	app := parts.str("app_name", "tag")
+	if pid := parts.str("proc_id"); len(pid) > 0 && pid != "-" {
+		app += "[" + pid + "]"
+	}
+	line := fmt.Sprintf("%s %s %s: %s\n", parts.timestamp(received).Format(time.RFC3339), parts.hostname(), app, strings.TrimSuffix(parts.str("content", "message"), "\n"))
+	_, err = f.WriteString(line)
+	return err
+}
+
+func (a *syslogArchive) Close() error {
+	var err error
+	for device, af := range a.files {
+		if cerr := af.f.Close(); err == nil {
+			err = cerr
+		}
+		delete(a.files, device)
+	}
+	return err
+}
+
+// syslogRelay relays received messages to an upstream collector. Messages
+// are queued so that a slow or unavailable collector does not delay the
+// processing of received messages, they are dropped if the queue is full.
+type syslogRelay struct {
+	address string
+	w       *syslogWriter
+	ch      chan []byte
+}
+
+func newSyslogRelay(cfg SyslogRelayConfig) (*syslogRelay, error) {
+	var tlsConfig *tls.Config
+	if len(cfg.CAFile) > 0 {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%v: no certificates found", cfg.CAFile)
+		}
+		tlsConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	w, err := newSyslogWriter(cfg.Network, cfg.Address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogRelay{address: w.address, w: w, ch: make(chan []byte, 1000)}, nil
+}
+
+func (r *syslogRelay) relay(received time.Time, parts syslogParts) {
+	msg := formatSyslogMessage(
+		parts.priority(),
+		parts.timestamp(received),
+		parts.hostname(),
+		parts.str("app_name", "tag"),
+		parts.str("proc_id"),
+		parts.str("msg_id"),
+		parts.str("structured_data"),
+		parts.str("content", "message"))
+	select {
+	case r.ch <- msg:
+	default:
+	}
+}
+
+// run sends queued messages until ctx is canceled, failures are logged
+// when the relay first fails and when it recovers.
+func (r *syslogRelay) run(ctx context.Context, events *EventBus) {
+	defer r.w.Close()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-r.ch:
+			err := r.w.write(msg)
+			switch {
+			case err != nil && !failing:
+				events.Error(ctx, "syslog", "", "relay failed", "relay", r.address, "err", err)
+			case err == nil && failing:
+				events.Info(ctx, "syslog", "", "relay recovered", "relay", r.address)
+			}
+			failing = err != nil
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+func TestSyslogListeners(t *testing.T) {
+	var cfg Config
+	listeners, err := cfg.SyslogListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listeners, []SyslogListenerConfig{{Network: "udp", Address: ":514", Format: "auto"}}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	cfg.Options.Syslog = &SyslogOption{Listeners: []SyslogListenerConfig{
+		{Address: "127.0.0.1:5514"},
+		{Network: "tcp", Address: "127.0.0.1", Format: "rfc5424"},
+		{Network: "tls", CertFile: "cert.pem", KeyFile: "key.pem"},
+	}}
+	listeners, err = cfg.SyslogListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []SyslogListenerConfig{
+		{Network: "udp", Address: "127.0.0.1:5514", Format: "auto"},
+		{Network: "tcp", Address: "127.0.0.1:514", Format: "rfc5424"},
+		{Network: "tls", Address: ":6514", Format: "auto", CertFile: "cert.pem", KeyFile: "key.pem"},
+	} {
+		if got := listeners[i]; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+
+	for _, l := range []SyslogListenerConfig{
+		{Network: "sctp"},
+		{Network: "tls", CertFile: "cert.pem"},
+		{Format: "rfc1234"},
+	} {
+		cfg.Options.Syslog.Listeners = []SyslogListenerConfig{l}
+		if _, err := cfg.SyslogListeners(); err == nil {
+			t.Errorf("%v: expected an error", l)
+		}
+	}
+}
+
+func freeTCPAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestSyslogServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, ev)
+	})
+
+	// A listener that fails to bind must be reported as an error.
+	inuse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inuse.Close()
+	srv := newSyslogServer(bus, nil)
+	err = srv.run(ctx, []SyslogListenerConfig{{Network: "tcp", Address: inuse.Addr().String(), Format: "auto"}})
+	if err == nil || !strings.Contains(err.Error(), inuse.Addr().String()) {
+		t.Fatalf("expected a bind error, got %v", err)
+	}
+
+	addr := freeTCPAddr(t)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.run(ctx, []SyslogListenerConfig{{Network: "tcp", Address: addr, Format: "auto"}})
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "<165>1 2024-10-01T10:00:00.000Z cam1 app 100 ID47 - hello world\n"
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	find := func() *Event {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ev := range received {
+			if ev.Message == "received syslog" {
+				return &ev
+			}
+		}
+		return nil
+	}
+	var ev *Event
+	for i := 0; i < 100 && ev == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		ev = find()
+	}
+	if ev == nil {
+		t.Fatal("syslog message not received")
+	}
+	if got, want := attrString(*ev, "hostname"), "cam1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := attrString(*ev, "message"), "hello world"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("syslog server did not stop")
+	}
+}
+
+func TestSyslogAttribution(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Devices: []Device{
+		{Name: "cam1", IP: "10.0.0.1", Syslog: &SyslogConfig{
+			Rules: []SyslogRuleConfig{
+				{Action: "drop", Facilities: []string{"daemon"}, Severity: "info"},
+				{Action: "escalate", Severity: "err"},
+				{Action: "escalate", Match: "link (up|down)"},
+			},
+		}},
+		{Name: "router", IP: "10.0.0.254", Syslog: &SyslogConfig{Hostnames: []string{"GW"}}},
+	}}
+	devices, err := cfg.SyslogDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	srv := newSyslogServer(bus, devices)
+
+	msg := func(client, hostname string, facility, severity int, content string) format.LogParts {
+		return format.LogParts{"client": client, "hostname": hostname, "facility": facility, "severity": severity, "content": content}
+	}
+	for _, parts := range []format.LogParts{
+		msg("10.0.0.1:514", "cam1", 3, 6, "dropped"),
+		msg("10.0.0.1:514", "cam1", 3, 7, "kept, debug is less severe than info"),
+		msg("10.0.0.1:514", "cam1", 1, 2, "critical"),
+		msg("10.0.0.1:514", "cam1", 1, 6, "eth0: link down"),
+		msg("10.0.0.1:514", "cam1", 1, 6, "kept"),
+		msg("192.168.1.1:514", "gw", 1, 6, "by hostname"),
+		msg("10.0.0.9:514", "new", 1, 6, "unknown 1"),
+		msg("10.0.0.9:514", "new", 1, 6, "unknown 2"),
+	} {
+		srv.handle(ctx, parts)
+	}
+
+	type result struct {
+		device, msg, content string
+		level                slog.Level
+	}
+	var got []result
+	for _, ev := range received {
+		got = append(got, result{ev.Device, ev.Message, attrString(ev, "content"), ev.Level})
+	}
+	want := []result{
+		{"cam1", "received syslog", "kept, debug is less severe than info", slog.LevelInfo},
+		{"cam1", "escalated syslog", "critical", slog.LevelWarn},
+		{"cam1", "escalated syslog", "eth0: link down", slog.LevelWarn},
+		{"cam1", "received syslog", "kept", slog.LevelInfo},
+		{"router", "received syslog", "by hostname", slog.LevelInfo},
+		{"unknown", "received syslog", "unknown 1", slog.LevelInfo},
+		{"unknown", "received syslog", "unknown 2", slog.LevelInfo},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	last := received[len(received)-1]
+	if got, want := attrString(last, "sender"), "10.0.0.9"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := attrString(last, "unknown_count"), "2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	cfg.Devices[0].Syslog.Rules = []SyslogRuleConfig{{Action: "escalate", Severity: "loud"}}
+	if _, err := cfg.SyslogDevices(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestSyslogAddressChange(t *testing.T) {
+	addr := newSharedAddr(netip.Addr{})
+	srv := newSyslogServer(NewEventBus(), []SyslogDevice{
+		{Name: "nas", IP: "nas.lan", addr: addr},
+		{Name: "cam", IP: "10.0.0.2"},
+	})
+	device := func(client string) string {
+		if d := srv.device(format.LogParts{"client": client}); d != nil {
+			return d.Name
+		}
+		return ""
+	}
+	if got, want := device("10.0.0.1:514"), ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	addr.store(netip.MustParseAddr("10.0.0.1"))
+	if got, want := device("10.0.0.1:514"), "nas"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	addr.store(netip.MustParseAddr("10.0.0.3"))
+	if got, want := device("10.0.0.1:514"), ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := device("10.0.0.3:514"), "nas"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// An address that moves to another device is attributed to it.
+	addr.store(netip.MustParseAddr("10.0.0.2"))
+	if got, want := device("10.0.0.2:514"), "nas"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSyslogForwarding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	cfg := Config{Devices: []Device{{Name: "cam1", IP: "10.0.0.1"}}}
+	devices, _ := cfg.SyslogDevices()
+	srv := newSyslogServer(NewEventBus(), devices)
+	if err := srv.forwardTo(dir, []SyslogRelayConfig{{Address: pc.LocalAddr().String()}}); err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2024, 10, 1, 23, 59, 0, 0, time.Local)
+	srv.now = func() time.Time { return received }
+	go srv.relays[0].run(ctx, srv.events)
+
+	sent := time.Date(2024, 10, 1, 23, 58, 0, 0, time.UTC)
+	srv.handle(ctx, format.LogParts{"client": "10.0.0.1:514", "hostname": "camera", "tag": "httpd", "priority": 30, "facility": 3, "severity": 6, "timestamp": sent, "content": "started"})
+	received = received.Add(2 * time.Minute)
+	srv.handle(ctx, format.LogParts{"client": "10.0.0.9:514", "hostname": "other", "app_name": "app", "proc_id": "42", "priority": 14, "facility": 1, "severity": 6, "message": "hello"})
+	srv.archive.Close()
+
+	for _, tc := range []struct {
+		file, line string
+	}{
+		{filepath.Join(dir, "cam1", "2024-10-01.log"), "2024-10-01T23:58:00Z camera httpd: started\n"},
+		{filepath.Join(dir, "unknown", "2024-10-02.log"), received.Format(time.RFC3339) + " other app[42]: hello\n"},
+	} {
+		buf, err := os.ReadFile(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf), tc.line; got != want {
+			t.Errorf("%v: got %q, want %q", tc.file, got, want)
+		}
+	}
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{
+		"<30>1 2024-10-01T23:58:00Z camera httpd - - - started",
+		"<14>1 " + received.Format(time.RFC3339Nano) + " other app 42 - - hello",
+	} {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloudeng.io/sync/errgroup"
+)
+
+// maxTCPBanner is the maximum number of bytes read when looking for
+// a banner line.
+const maxTCPBanner = 1024
+
+type TCPMonitor struct {
+	events *EventBus
+}
+
+func NewTCPMonitor(events *EventBus) *TCPMonitor {
+	return &TCPMonitor{events: events}
+}
+
+func (m *TCPMonitor) MonitorAll(ctx context.Context, probes []TCPProbe) error {
+	var g errgroup.T
+	for _, probe := range probes {
+		g.Go(func() error {
+			return m.MonitorPort(ctx, probe)
+		})
+	}
+	return g.Wait()
+}
+
+func (m *TCPMonitor) publish(ctx context.Context, probe TCPProbe, ev Event) {
+	ev.Module = "tcp"
+	ev.Device = probe.Name
+	ev.Attrs = append([]slog.Attr{slog.String("ip", probe.IPAddr.String()), slog.Int("port", probe.Port)}, ev.Attrs...)
+	m.events.Publish(ctx, ev)
+}
+
+// MonitorPort repeatedly connects to the probe's port until the context
+// is canceled, probes are skipped until the device has an address.
+func (m *TCPMonitor) MonitorPort(ctx context.Context, probe TCPProbe) error {
+	for {
+		if p := probe.current(); p.IPAddr.IsValid() {
+			m.probe(ctx, p)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(probe.Interval):
+		}
+	}
+}
+
+func (m *TCPMonitor) probe(ctx context.Context, probe TCPProbe) {
+	ctx, cancel := context.WithTimeout(ctx, probe.Timeout)
+	defer cancel()
+	start := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", probe.String())
+	latency := time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		m.failed(ctx, probe, latency, err)
+		return
+	}
+	defer conn.Close()
+	if probe.Banner == nil {
+		m.publish(ctx, probe, Event{Level: slog.LevelInfo, Kind: EventProbeOK, Message: "ok", Latency: latency})
+		return
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	banner, err := readBanner(conn)
+	if err != nil {
+		m.failed(ctx, probe, latency, err)
+		return
+	}
+	if !probe.Banner.MatchString(banner) {
+		m.publish(ctx, probe, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: "unexpected banner", Latency: latency, Attrs: attrs("banner", banner, "expected", probe.Banner.String())})
+		return
+	}
+	m.publish(ctx, probe, Event{Level: slog.LevelInfo, Kind: EventProbeOK, Message: "ok", Latency: latency, Attrs: attrs("banner", banner)})
+}
+
+// readBanner returns the first line sent by the peer with any trailing
+// line terminator removed.
+func readBanner(conn net.Conn) (string, error) {
+	line, err := bufio.NewReader(io.LimitReader(conn, maxTCPBanner)).ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || len(line) == 0) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (m *TCPMonitor) failed(ctx context.Context, probe TCPProbe, latency time.Duration, err error) {
+	reason := tcpFailure(err)
+	kind := EventProbeFailed
+	if reason == "timeout" {
+		kind = EventTimeout
+	}
+	m.publish(ctx, probe, Event{Level: slog.LevelWarn, Kind: kind, Message: reason, Latency: latency, Err: err, Attrs: attrs(slog.Duration("timeout", probe.Timeout))})
+}
+
+// tcpFailure classifies a connect or read error as a refused connection,
+// a timeout, a reset or closed connection, or some other failure.
+func tcpFailure(err error) string {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &nerr) && nerr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF):
+		return "closed"
+	}
+	return "failed"
+}
+
+func (p TCPProbe) String() string {
+	return net.JoinHostPort(p.IPAddr.String(), strconv.Itoa(p.Port))
+}
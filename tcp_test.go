@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// tcpTestServer accepts connections and handles each one with fn.
+func tcpTestServer(t *testing.T, fn func(*net.TCPConn)) (*net.TCPListener, int) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go fn(conn)
+		}
+	}()
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestTCPProbe(t *testing.T) {
+	ctx := context.Background()
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	m := NewTCPMonitor(bus)
+
+	_, silent := tcpTestServer(t, func(c *net.TCPConn) {
+		time.Sleep(time.Second)
+		c.Close()
+	})
+	_, greeter := tcpTestServer(t, func(c *net.TCPConn) {
+		c.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+		c.Close()
+	})
+	_, resetter := tcpTestServer(t, func(c *net.TCPConn) {
+		c.SetLinger(0)
+		c.Close()
+	})
+	closed, refused := tcpTestServer(t, func(c *net.TCPConn) {})
+	closed.Close()
+
+	localhost := netip.MustParseAddr("127.0.0.1")
+	for i, tc := range []struct {
+		port   int
+		banner string
+		kind   EventKind
+		msg    string
+		attr   string
+	}{
+		{silent, "", EventProbeOK, "ok", ""},
+		{greeter, "^SSH-2.0-", EventProbeOK, "ok", "SSH-2.0-OpenSSH_9.6"},
+		{greeter, "^220 ", EventProbeFailed, "unexpected banner", "SSH-2.0-OpenSSH_9.6"},
+		{silent, ".", EventTimeout, "timeout", ""},
+		{resetter, ".", EventProbeFailed, "reset", ""},
+		{refused, "", EventProbeFailed, "refused", ""},
+	} {
+		probe := TCPProbe{Name: "nas", Port: tc.port, Timeout: 100 * time.Millisecond, IPAddr: localhost}
+		if len(tc.banner) > 0 {
+			probe.Banner = regexp.MustCompile(tc.banner)
+		}
+		received = nil
+		m.probe(ctx, probe)
+		if len(received) != 1 {
+			t.Fatalf("%v: got %v events", i, len(received))
+		}
+		ev := received[0]
+		if got, want := ev.Kind, tc.kind; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := ev.Message, tc.msg; got != want {
+			t.Errorf("%v: got %v, want %v: %v", i, got, want, ev.Err)
+		}
+		if got, want := attrString(ev, "banner"), tc.attr; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := ev.Module, logMod("tcp"); got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloudeng.io/sync/errgroup"
+)
+
+type TLSMonitor struct {
+	events *EventBus
+	now    func() time.Time
+}
+
+func NewTLSMonitor(events *EventBus) *TLSMonitor {
+	return &TLSMonitor{events: events, now: time.Now}
+}
+
+// tlsState is the state retained between successive checks of the
+// same port.
+type tlsState struct {
+	fingerprint string
+	// threshold is the smallest expiry threshold that has been
+	// warned about, zero if none.
+	threshold time.Duration
+}
+
+func (m *TLSMonitor) publish(ctx context.Context, probe TLSProbe, ev Event) {
+	ev.Module = "tls"
+	ev.Device = probe.Name
+	ev.Attrs = append([]slog.Attr{slog.String("ip", probe.IPAddr.String()), slog.Int("port", probe.Port)}, ev.Attrs...)
+	m.events.Publish(ctx, ev)
+}
+
+func (m *TLSMonitor) MonitorAll(ctx context.Context, probes []TLSProbe) error {
+	var g errgroup.T
+	for _, probe := range probes {
+		g.Go(func() error {
+			var state tlsState
+			for {
+				if p := probe.current(); p.IPAddr.IsValid() {
+					m.check(ctx, p, &state)
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(probe.Interval):
+				}
+			}
+		})
+	}
+	return g.Wait()
+}
+
+// check performs a handshake and reports on the certificate presented.
+// Certificates are not verified as part of the handshake since many
+// devices use self-signed certificates, instead whether the chain is
+// trusted is reported along with the other details of the certificate.
+func (m *TLSMonitor) check(ctx context.Context, probe TLSProbe, state *tlsState) {
+	ctx, cancel := context.WithTimeout(ctx, probe.Timeout)
+	defer cancel()
+	dialer := tls.Dialer{Config: &tls.Config{
+		ServerName:         probe.ServerName,
+		InsecureSkipVerify: true, // the chain is verified by verifyChain.
+	}}
+	addr := net.JoinHostPort(probe.IPAddr.String(), strconv.Itoa(probe.Port))
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	latency := time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return
+		}
+		var nerr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &nerr) && nerr.Timeout() {
+			m.publish(ctx, probe, Event{Level: slog.LevelWarn, Kind: EventTimeout, Message: "timeout", Latency: latency, Err: err, Attrs: attrs(slog.Duration("timeout", probe.Timeout))})
+			return
+		}
+		m.publish(ctx, probe, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: "handshake failed", Latency: latency, Err: err})
+		return
+	}
+	cs := conn.(*tls.Conn).ConnectionState()
+	conn.Close()
+	if len(cs.PeerCertificates) == 0 {
+		m.publish(ctx, probe, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: "no certificate", Latency: latency})
+		return
+	}
+	leaf := cs.PeerCertificates[0]
+	sum := sha256.Sum256(leaf.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	now := m.now()
+	remaining := leaf.NotAfter.Sub(now)
+	verifyErr := verifyChain(probe, cs.PeerCertificates, now)
+
+	details := attrs(
+		"subject", leaf.Subject.String(),
+		"issuer", leaf.Issuer.String(),
+		"expires", leaf.NotAfter,
+		slog.Duration("remaining", remaining.Round(time.Second)),
+		"sans", strings.Join(certSANs(leaf), ","),
+		"version", tls.VersionName(cs.Version),
+		"cipher", tls.CipherSuiteName(cs.CipherSuite),
+		"chain", strings.Join(certChain(cs.PeerCertificates), " < "),
+		"fingerprint", fingerprint,
+		"verified", verifyErr == nil,
+	)
+	if verifyErr != nil {
+		details = append(details, slog.String("verify_error", verifyErr.Error()))
+	}
+
+	if len(state.fingerprint) > 0 && state.fingerprint != fingerprint {
+		m.publish(ctx, probe, Event{Level: slog.LevelWarn, Kind: EventStateChange, Message: "changed certificate", Attrs: attrs("subject", leaf.Subject.String(), "fingerprint", fingerprint, "previous", state.fingerprint)})
+		state.threshold = 0
+	}
+	state.fingerprint = fingerprint
+
+	switch {
+	case remaining <= 0:
+		m.publish(ctx, probe, Event{Level: slog.LevelError, Kind: EventProbeFailed, Message: "certificate expired", Latency: latency, Attrs: details})
+		return
+	case now.Before(leaf.NotBefore):
+		m.publish(ctx, probe, Event{Level: slog.LevelWarn, Kind: EventProbeFailed, Message: "certificate not yet valid", Latency: latency, Attrs: details})
+		return
+	}
+	if threshold := expiryThreshold(probe.Thresholds, remaining); threshold > 0 && (state.threshold == 0 || threshold < state.threshold) {
+		state.threshold = threshold
+		m.publish(ctx, probe, Event{Level: slog.LevelWarn, Kind: EventInfo, Message: "certificate expiring", Attrs: append(attrs(slog.Duration("threshold", threshold)), details...)})
+	}
+	m.publish(ctx, probe, Event{Level: slog.LevelInfo, Kind: EventProbeOK, Message: "ok", Latency: latency, Attrs: details})
+}
+
+// expiryThreshold returns the smallest threshold that remaining is
+// within, or zero if it is not within any of them.
+func expiryThreshold(thresholds []time.Duration, remaining time.Duration) time.Duration {
+	var res time.Duration
+	for _, t := range thresholds {
+		if remaining <= t && (res == 0 || t < res) {
+			res = t
+		}
+	}
+	return res
+}
+
+// verifyChain verifies the presented chain against the system's roots
+// and the probe's server name, if any.
+func verifyChain(probe TLSProbe, certs []*x509.Certificate, now time.Time) error {
+	opts := x509.VerifyOptions{
+		DNSName:       probe.ServerName,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if len(opts.DNSName) == 0 {
+		opts.DNSName = probe.IPAddr.String()
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+func certSANs(c *x509.Certificate) []string {
+	sans := append([]string(nil), c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+func certChain(certs []*x509.Certificate) []string {
+	chain := make([]string, len(certs))
+	for i, c := range certs {
+		chain[i] = c.Subject.CommonName
+		if len(chain[i]) == 0 {
+			chain[i] = c.Subject.String()
+		}
+	}
+	return chain
+}
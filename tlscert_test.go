@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSCheck(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	// The monitor closes the connection immediately after the handshake.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	ap := netip.MustParseAddrPort(srv.Listener.Addr().String())
+	expires := srv.Certificate().NotAfter
+
+	var received []Event
+	bus := NewEventBus()
+	bus.Subscribe(func(_ context.Context, ev Event) {
+		received = append(received, ev)
+	})
+	m := NewTLSMonitor(bus)
+	probe := TLSProbe{
+		Name:       "nvr",
+		Port:       int(ap.Port()),
+		Timeout:    time.Second,
+		Thresholds: []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour},
+		IPAddr:     ap.Addr(),
+	}
+	var state tlsState
+
+	check := func(now time.Time) []string {
+		m.now = func() time.Time { return now }
+		received = nil
+		m.check(ctx, probe, &state)
+		var msgs []string
+		for _, ev := range received {
+			msgs = append(msgs, ev.Message+" "+attrString(ev, "threshold"))
+		}
+		return msgs
+	}
+
+	if got, want := check(time.Now()), []string{"ok "}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	ev := received[0]
+	if got, want := attrString(ev, "verified"), "false"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := attrString(ev, "sans"); !strings.Contains(got, "127.0.0.1") {
+		t.Errorf("missing ip san: %v", got)
+	}
+	if got := attrString(ev, "version"); !strings.HasPrefix(got, "TLS 1.") {
+		t.Errorf("unexpected version: %v", got)
+	}
+	if got := attrString(ev, "fingerprint"); len(got) != 64 {
+		t.Errorf("unexpected fingerprint: %v", got)
+	}
+
+	// Each threshold is warned about once.
+	for i, tc := range []struct {
+		remaining time.Duration
+		want      []string
+	}{
+		{10 * 24 * time.Hour, []string{"certificate expiring 720h0m0s", "ok "}},
+		{9 * 24 * time.Hour, []string{"ok "}},
+		{2 * 24 * time.Hour, []string{"certificate expiring 168h0m0s", "ok "}},
+		{time.Hour, []string{"certificate expiring 24h0m0s", "ok "}},
+		{time.Minute, []string{"ok "}},
+		{-time.Minute, []string{"certificate expired "}},
+	} {
+		if got := check(expires.Add(-tc.remaining)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %v, want %v", i, got, tc.want)
+		}
+	}
+
+	// A new certificate resets the warnings.
+	state.fingerprint = "previous"
+	got := check(expires.Add(-time.Hour))
+	if want := []string{"changed certificate ", "certificate expiring 24h0m0s", "ok "}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := attrString(received[0], "previous"), "previous"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	srv.Close()
+	if got, want := check(time.Now()), []string{"handshake failed "}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
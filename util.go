@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"time"
 )
 
@@ -15,18 +14,17 @@ func renameIfExisting(name string) error {
 		return nil
 	}
 	f.Close()
-	date := time.Now().Format(time.RFC3339)
-	fmt.Printf("renaming %v to %v\n", name, name+"."+date)
-	return os.Rename(name, name+"."+date)
+	rotated := rotatedName(name, time.Now())
+	fmt.Printf("renaming %v to %v\n", name, rotated)
+	return os.Rename(name, rotated)
 }
 
-func newLogfile(name string) (io.WriteCloser, error) {
+func newLogfile(name string, rotation LogRotation) (io.WriteCloser, error) {
 	if len(name) == 0 || name == "-" {
 		return os.Stdout, nil
 	}
 	if err := renameIfExisting(name); err != nil {
 		return nil, err
 	}
-	os.MkdirAll(filepath.Dir(name), 0700)
-	return os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	return newRotatingFile(name, rotation)
 }